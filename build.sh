@@ -5,3 +5,5 @@ upx out/syncReader
 
 #CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags "$LDFlags" -o out/syncWriter server/syncWriter/*.go
 #upx out/syncWriter
+
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags "$LDFlags" -o out/aofCheck server/aofCheck/*.go
@@ -3,12 +3,20 @@ package aofStorage
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"path/filepath"
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/utils/encrypt"
+	rotate "redisFlutter/internal/utils/file_rotate"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func test_repeatSetBytes(buffer []byte, v byte) []byte {
@@ -35,7 +43,7 @@ func Test_BadgerAofStorage01(t *testing.T) {
 
 		valBuffer = valBuffer[:0]
 		valBuffer = strconv.AppendInt(valBuffer, int64(i), 10)
-		err = target.Append(keyBuffer, valBuffer)
+		_, err = target.Append(valBuffer)
 		if err != nil {
 			t.Error(err)
 		}
@@ -83,7 +91,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(0))
 	valBuffer = valBuffer[:0]
 	valBuffer = strconv.AppendInt(valBuffer, int64(0), 10)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -91,7 +99,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(1))
 	valBuffer = make([]byte, 1024)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -99,7 +107,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(2))
 	valBuffer = make([]byte, 1024*2)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -107,7 +115,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(3))
 	valBuffer = make([]byte, 1024*3)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -115,7 +123,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(4))
 	valBuffer = make([]byte, 1024*2)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -123,7 +131,7 @@ func Test_BadgerAofStorage02(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(5))
 	valBuffer = make([]byte, 200)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -210,7 +218,7 @@ func Test_BadgerAofStorage03(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(0))
 	valBuffer = make([]byte, 300)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -218,7 +226,7 @@ func Test_BadgerAofStorage03(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(1))
 	valBuffer = make([]byte, 800)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -226,7 +234,7 @@ func Test_BadgerAofStorage03(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(2))
 	valBuffer = make([]byte, 1024*2)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -301,7 +309,7 @@ func Test_BadgerAofStorage04(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(0))
 	valBuffer = make([]byte, 600)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -309,7 +317,7 @@ func Test_BadgerAofStorage04(t *testing.T) {
 	binary.BigEndian.PutUint64(keyBuffer, uint64(1))
 	valBuffer = make([]byte, 2048)
 	valBuffer = test_repeatSetBytes(valBuffer, 1)
-	err = target.Append(keyBuffer, valBuffer)
+	_, err = target.Append(valBuffer)
 	if err != nil {
 		t.Error(err)
 	}
@@ -373,14 +381,14 @@ func Test_BadgerAofStorage_check_value_reuse_single_buffer(t *testing.T) {
 
 	binary.BigEndian.PutUint64(keyBuffer, uint64(0))
 	valBuffer0 = test_repeatSetBytes(valBuffer0, 1)
-	err = target.Append(keyBuffer, valBuffer0)
+	_, err = target.Append(valBuffer0)
 	if err != nil {
 		t.Error(err)
 	}
 
 	binary.BigEndian.PutUint64(keyBuffer, uint64(1))
 	valBuffer1 = test_repeatSetBytes(valBuffer1, 2)
-	err = target.Append(keyBuffer, valBuffer1)
+	_, err = target.Append(valBuffer1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -417,7 +425,7 @@ func Test_BadgerAofStorage09(t *testing.T) {
 
 		valBuffer = valBuffer[:0]
 		valBuffer = strconv.AppendInt(valBuffer, int64(i), 10)
-		err = target.Append(keyBuffer, valBuffer)
+		_, err = target.Append(valBuffer)
 		if err != nil {
 			t.Error(err)
 		}
@@ -524,3 +532,167 @@ func Test_BadgerAofStorage09(t *testing.T) {
 	iterator.Reset()
 	buffer.Reset()
 }
+
+func Test_BadgerAofStorage_restore(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "badger")
+	target, err := NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		seq, err := target.Append([]byte(testBatch(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i), seq)
+	}
+	assert.Nil(t, target.TruncateBefore(30))
+	assert.Nil(t, target.Close())
+
+	// the sequences go on after a reopen
+	target, err = NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	defer target.Destroy()
+	stats := target.Stats()
+	assert.Equal(t, uint64(30), stats.FirstSeq)
+	assert.Equal(t, uint64(100), stats.NextSeq)
+	assert.Equal(t, int64(len(testBatches(30, 100))), stats.StoredBytes)
+	seq, err := target.Append([]byte(testBatch(100)))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), seq)
+	assert.NotNil(t, target.AppendBatch(102, []byte(testBatch(102))))
+	assert.Equal(t, testBatches(30, 101), readTestStorage(t, target, 30))
+}
+
+func Test_BadgerAofStorage_concurrent(t *testing.T) {
+	target, err := NewBadgerAofStorage(filepath.Join(t.TempDir(), "badger"))
+	assert.Nil(t, err)
+	defer target.Destroy()
+
+	wg := sync.WaitGroup{}
+	values := make([]string, 4000)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				value := fmt.Sprintf("%d-%d;", g, i)
+				seq, err := target.Append([]byte(value))
+				assert.Nil(t, err)
+				values[seq] = value
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(4000), target.Stats().NextSeq)
+	assert.Equal(t, strings.Join(values, ""), readTestStorage(t, target, 0))
+}
+
+func Test_BadgerAofStorage_maxBytes(t *testing.T) {
+	config.Opt.Advanced.AofStorageMaxBytes = 1000
+	defer func() { config.Opt.Advanced.AofStorageMaxBytes = 0 }()
+	target, err := NewBadgerAofStorage(filepath.Join(t.TempDir(), "badger"))
+	assert.Nil(t, err)
+	defer target.Destroy()
+
+	value := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		_, err = target.Append(value)
+		assert.Nil(t, err)
+	}
+	// full, the append waits for batches to be deleted
+	appended := make(chan uint64)
+	go func() {
+		seq, err := target.Append(value)
+		assert.Nil(t, err)
+		appended <- seq
+	}()
+	select {
+	case <-appended:
+		t.Fatal("append to a full storage did not wait")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Nil(t, target.TruncateBefore(5))
+	select {
+	case seq := <-appended:
+		assert.Equal(t, uint64(10), seq)
+	case <-time.After(5 * time.Second):
+		t.Fatal("append did not go on after a delete")
+	}
+
+	// closing fails the appends waiting
+	for target.Stats().StoredBytes < 1000 {
+		_, err = target.Append(value)
+		assert.Nil(t, err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		target.Close()
+	}()
+	_, err = target.Append(value)
+	assert.Equal(t, ErrStorageClosed, err)
+}
+
+func setTestEncryptionKeys(t *testing.T, keys ...string) {
+	old := config.Opt.Advanced.EncryptionKeyFile
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	assert.Nil(t, os.WriteFile(keyFile, []byte(strings.Join(keys, "\n")), 0600))
+	config.Opt.Advanced.EncryptionKeyFile = keyFile
+	t.Cleanup(func() { config.Opt.Advanced.EncryptionKeyFile = old })
+}
+
+func Test_BadgerAofStorage_encryption(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "badger")
+	target, err := NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	appendTestBatches(t, target, 0, 50)
+	assert.Nil(t, target.Close())
+
+	// a db written without encryption is encrypted from now on
+	key := make([]byte, encrypt.KeySize)
+	oldKey := hex.EncodeToString(key)
+	key[0] = 1
+	newKey := hex.EncodeToString(key)
+	setTestEncryptionKeys(t, oldKey)
+	target, err = NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	appendTestBatches(t, target, 50, 100)
+	assert.Nil(t, target.Close())
+
+	// the registry of data keys is rewrapped by a new key, then the old one can go
+	setTestEncryptionKeys(t, newKey, oldKey)
+	target, err = NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	assert.Nil(t, target.Close())
+	setTestEncryptionKeys(t, newKey)
+	target, err = NewBadgerAofStorage(dataPath)
+	assert.Nil(t, err)
+	assert.Equal(t, testBatches(0, 100), readTestStorage(t, target, 0))
+	assert.Nil(t, target.Close())
+
+	setTestEncryptionKeys(t, oldKey)
+	_, err = NewBadgerAofStorage(dataPath)
+	assert.NotNil(t, err)
+}
+
+func Test_BadgerAofStorage_retention(t *testing.T) {
+	target, err := NewBadgerAofStorage(filepath.Join(t.TempDir(), "badger"))
+	assert.Nil(t, err)
+	defer target.Destroy()
+
+	appendTestBatches(t, target, 0, 500)
+	// the batches appended so far are two hours old
+	now := time.Now()
+	target.marks[0].at = now.Add(-2 * time.Hour)
+	appendTestBatches(t, target, 500, 1000)
+
+	policy := rotate.RetentionPolicy{MaxAge: time.Hour}
+	assert.Equal(t, uint64(500), checkBadgerRetention("test", target, policy, now))
+	assert.Equal(t, testBatches(500, 1000), readTestStorage(t, target, 500))
+
+	policy.MaxTotalBytes = int64(len(testBatches(800, 1000)))
+	assert.Equal(t, uint64(800), checkBadgerRetention("test", target, policy, now))
+	assert.Equal(t, testBatches(800, 1000), readTestStorage(t, target, 800))
+
+	// the last batch is always kept
+	assert.Equal(t, uint64(999), checkBadgerRetention("test", target, policy, now.Add(3*time.Hour)))
+	assert.Equal(t, testBatches(999, 1000), readTestStorage(t, target, 999))
+	appendTestBatches(t, target, 1000, 1010)
+	assert.Equal(t, testBatches(999, 1010), readTestStorage(t, target, 999))
+}
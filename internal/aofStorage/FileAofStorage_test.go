@@ -0,0 +1,197 @@
+package aofStorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	rotate "redisFlutter/internal/utils/file_rotate"
+)
+
+func testBatch(i int) string {
+	value := fmt.Sprintf("value%d", i)
+	return fmt.Sprintf("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$%d\r\n%s\r\n", len(value), value)
+}
+
+func testBatches(from int, to int) string {
+	sb := strings.Builder{}
+	for i := from; i < to; i++ {
+		sb.WriteString(testBatch(i))
+	}
+	return sb.String()
+}
+
+func appendTestBatches(t *testing.T, s Storage, from int, to int) {
+	for i := from; i < to; i++ {
+		assert.Nil(t, s.AppendBatch(uint64(i), []byte(testBatch(i))))
+	}
+}
+
+// readTestStorage reads every batch from seq with a small buffer.
+func readTestStorage(t *testing.T, s Storage, seq uint64) string {
+	sb := strings.Builder{}
+	iterator := NewKeyStartIterator(4096)
+	iterator.SetStartKey(seq)
+	for {
+		assert.Nil(t, s.ReadFunc(iterator))
+		next := iterator.GetCurrentKeyIndex()
+		assert.Equal(t, int(next-seq), len(iterator.GetCommitKeys()))
+		sb.WriteString(iterator.buffer.String())
+		if next == seq {
+			return sb.String()
+		}
+		seq = next
+		iterator.Reset()
+		iterator.SetStartKey(seq)
+	}
+}
+
+func testStorages(t *testing.T) map[string]func() Storage {
+	return map[string]func() Storage{
+		StorageFile: func() Storage {
+			s, err := NewFileAofStorage("test", t.TempDir(), 1024)
+			assert.Nil(t, err)
+			return s
+		},
+		StorageBadger: func() Storage {
+			s, err := NewBadgerAofStorage(filepath.Join(t.TempDir(), "badger"))
+			assert.Nil(t, err)
+			return s
+		},
+	}
+}
+
+func Test_Storage(t *testing.T) {
+	for name, open := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			defer s.Destroy()
+
+			appendTestBatches(t, s, 100, 1100)
+			assert.NotNil(t, s.AppendBatch(99, []byte(testBatch(99))))
+			assert.NotNil(t, s.AppendBatch(1101, []byte(testBatch(1101))))
+			stats := s.Stats()
+			assert.Equal(t, uint64(100), stats.FirstSeq)
+			assert.Equal(t, uint64(1100), stats.NextSeq)
+			assert.Equal(t, int64(len(testBatches(100, 1100))), stats.AppendedBytes)
+			assert.Equal(t, testBatches(100, 1100), readTestStorage(t, s, 100))
+			assert.Equal(t, testBatches(700, 1100), readTestStorage(t, s, 700))
+			assert.Equal(t, "", readTestStorage(t, s, 1100))
+
+			assert.Nil(t, s.TruncateBefore(600))
+			assert.Equal(t, uint64(600), s.Stats().FirstSeq)
+			assert.Equal(t, "", readTestStorage(t, s, 100))
+			assert.Equal(t, testBatches(600, 1100), readTestStorage(t, s, 600))
+
+			// appends go on after a truncate
+			writer := NewStorageWriter(s)
+			_, err := writer.Write([]byte(testBatch(1100)))
+			assert.Nil(t, err)
+			assert.Equal(t, testBatches(1000, 1101), readTestStorage(t, s, 1000))
+
+			// an empty storage starts anywhere
+			assert.Nil(t, s.TruncateBefore(s.Stats().NextSeq))
+			assert.Equal(t, s.Stats().FirstSeq, s.Stats().NextSeq)
+			appendTestBatches(t, s, 5000, 5010)
+			assert.Equal(t, testBatches(5000, 5010), readTestStorage(t, s, 5000))
+		})
+	}
+}
+
+func Test_FileAofStorage_reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileAofStorage("test", dir, 1024)
+	assert.Nil(t, err)
+	appendTestBatches(t, s, 10, 200)
+	assert.Nil(t, s.TruncateBefore(50))
+	assert.Nil(t, s.Close())
+
+	// a record torn by a crash is dropped
+	file, err := os.OpenFile(filepath.Join(dir, SeqFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("torn"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	s, err = NewFileAofStorage("test", dir, 1024)
+	assert.Nil(t, err)
+	defer s.Destroy()
+	assert.Equal(t, uint64(50), s.Stats().FirstSeq)
+	assert.Equal(t, uint64(200), s.Stats().NextSeq)
+	appendTestBatches(t, s, 200, 250)
+	assert.Equal(t, testBatches(50, 250), readTestStorage(t, s, 50))
+}
+
+func Test_FileAofStorage_truncate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileAofStorage("test", dir, 1024)
+	assert.Nil(t, err)
+	defer s.Destroy()
+	appendTestBatches(t, s, 0, 1000)
+	size := s.Stats().DiskBytes
+	assert.Equal(t, testBatches(0, 1000), readTestStorage(t, s, 0))
+
+	assert.Nil(t, s.TruncateBefore(900))
+	assert.Less(t, s.Stats().DiskBytes, size/5)
+	assert.Equal(t, testBatches(900, 1000), readTestStorage(t, s, 900))
+}
+
+func Test_Storage_firstSeqWithin(t *testing.T) {
+	for name, open := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			defer s.Destroy()
+
+			appendTestBatches(t, s, 0, 1000)
+			assert.Equal(t, uint64(1000), s.NextSeq())
+			size := int64(len(testBatches(800, 1000)))
+			assert.Equal(t, uint64(800), s.FirstSeqWithin(size))
+			assert.Equal(t, uint64(801), s.FirstSeqWithin(size-1))
+			assert.Equal(t, uint64(0), s.FirstSeqWithin(1<<40))
+			// the last batch is always kept
+			assert.Equal(t, uint64(999), s.FirstSeqWithin(1))
+		})
+	}
+}
+
+func Test_FileAofStorage_retention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileAofStorage("test", dir, 1024)
+	assert.Nil(t, err)
+	defer s.Destroy()
+	appendTestBatches(t, s, 0, 1000)
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.aof"))
+	assert.Greater(t, len(segments), 20)
+	check := func(policy rotate.RetentionPolicy) uint64 {
+		rotate.NewTruncateRetention("test", dir, policy, s.truncateBeforeOffset).Check()
+		first := s.Stats().FirstSeq
+		assert.Equal(t, testBatches(int(first), 1000), readTestStorage(t, s, first))
+		return first
+	}
+
+	// segments every cursor read past go
+	unregister := rotate.RegisterCursor(dir, "consumer", func() int64 { return 5 })
+	consumed := check(rotate.RetentionPolicy{DeleteConsumed: true})
+	unregister()
+	assert.Greater(t, consumed, uint64(0))
+
+	// old segments go
+	old := time.Now().Add(-2 * time.Hour)
+	for _, segment := range rotate.ScanAddIndexSuffixFiles(dir, ".aof")[:5] {
+		fp := filepath.Join(dir, fmt.Sprintf("%d.aof", segment))
+		assert.Nil(t, os.Chtimes(fp, old, old))
+	}
+	aged := check(rotate.RetentionPolicy{MaxAge: time.Hour})
+	assert.Greater(t, aged, consumed)
+
+	// the oldest segments go while the dir is larger
+	sized := check(rotate.RetentionPolicy{MaxTotalBytes: 4096})
+	assert.Greater(t, sized, aged)
+	assert.LessOrEqual(t, rotate.SegmentsSize(dir), int64(4096))
+	assert.Equal(t, uint64(1000), s.NextSeq())
+}
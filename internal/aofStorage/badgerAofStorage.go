@@ -1,18 +1,70 @@
 package aofStorage
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/dgraph-io/badger/v4/options"
 	"log/slog"
 	"os"
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/utils/encrypt"
+	rotate "redisFlutter/internal/utils/file_rotate"
+	"sort"
 	"sync"
+	"time"
 )
 
+// truncateBatchKeys is how many keys TruncateBefore deletes in one transaction.
+const truncateBatchKeys = 1000
+
+// keyRotationDuration is how long badger encrypts new tables with one data key.
+const keyRotationDuration = 10 * 24 * time.Hour
+
+// gcDiscardRatio is the share of a value log file that must be garbage for GC to rewrite it.
+const gcDiscardRatio = 0.5
+
+var ErrStorageClosed = errors.New("storage is closed")
+
+// BadgerAofStorage stores batches in a badger db under 8-byte big-endian sequence
+// keys. Appends are group committed: the first appender writes every pending batch
+// with one WriteBatch while the others wait for it. Badger transactions are safe for
+// concurrent use, lock only guards the sequences and the appenders.
 type BadgerAofStorage struct {
-	locker *sync.RWMutex
-	dbPath string
-	db     *badger.DB
+	dbPath   string
+	db       *badger.DB
+	maxBytes int64 // appenders wait while the live batches take more, 0 means no limit
+
+	lock     sync.Mutex
+	cond     *sync.Cond // signaled when batches are flushed or deleted
+	firstSeq uint64
+	nextSeq  uint64
+	pending  []*appendRequest
+	flushing bool
+	closed   bool
+	appended int64
+	stored   int64 // value bytes of the live batches, not the size on disk
+	marks    []seqMark
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// seqMark is when batches from seq on were appended. Marks are at least a second
+// apart, the batches of a mark are appended within a second.
+type seqMark struct {
+	seq uint64
+	at  time.Time
+}
+
+type appendRequest struct {
+	seq      uint64 // the sequence wanted, set to the one allocated when allocate
+	allocate bool
+	value    []byte
+	done     chan struct{}
+	err      error
 }
 
 func NewBadgerAofStorage(dbPath string) (*BadgerAofStorage, error) {
@@ -22,53 +74,446 @@ func NewBadgerAofStorage(dbPath string) (*BadgerAofStorage, error) {
 	opts.ValueLogFileSize = 1 << 30 // 1GB value log文件
 	opts.Compression = options.ZSTD //
 	opts.ZSTDCompressionLevel = 1
+	opts.SyncWrites = config.Opt.Advanced.AofFsync == rotate.FsyncAlways
+	ring, err := encrypt.ConfigKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if ring != nil {
+		opts.EncryptionKey = ring.Current()
+		opts.EncryptionKeyRotationDuration = keyRotationDuration
+		// badger requires the cache with encryption
+		opts.IndexCacheSize = 100 << 20
+	}
 	db, err := badger.Open(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) && ring != nil {
+		if err = rewrapKeyRegistry(dbPath, ring); err == nil {
+			db, err = badger.Open(opts)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	c := &BadgerAofStorage{
-		dbPath: dbPath,
-		db:     db,
-		locker: new(sync.RWMutex),
+		dbPath:   dbPath,
+		db:       db,
+		maxBytes: config.Opt.Advanced.AofStorageMaxBytes,
+	}
+	c.cond = sync.NewCond(&c.lock)
+	if err = c.restore(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	if interval := config.Opt.Advanced.AofStorageGcIntervalSec; interval > 0 {
+		c.wg.Add(1)
+		go c.runGC(ctx, time.Duration(interval)*time.Second)
 	}
+	slog.Info("open badger storage success", slog.String("dbPath", dbPath),
+		slog.Uint64("firstSeq", c.firstSeq), slog.Uint64("nextSeq", c.nextSeq), slog.Int64("storedBytes", c.stored))
 	return c, nil
 }
 
-func (c *BadgerAofStorage) Append(key []byte, value []byte) error {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-	slog.Debug("BadgerAofStorage append", slog.String("key", string(key)), slog.Int("val_len", len(value)))
-	return c.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, value)
+// rewrapKeyRegistry encrypts the key registry of the db at dbPath with the current key
+// of ring, when it was written with an older key or without encryption. Tables written
+// before keep their data keys and stay readable.
+func rewrapKeyRegistry(dbPath string, ring *encrypt.KeyRing) error {
+	for _, old := range append(ring.Keys()[1:], nil) {
+		kr, err := badger.OpenKeyRegistry(badger.KeyRegistryOptions{
+			Dir:                           dbPath,
+			ReadOnly:                      true,
+			EncryptionKey:                 old,
+			EncryptionKeyRotationDuration: keyRotationDuration,
+		})
+		if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = badger.WriteKeyRegistry(kr, badger.KeyRegistryOptions{
+			Dir:                           dbPath,
+			EncryptionKey:                 ring.Current(),
+			EncryptionKeyRotationDuration: keyRotationDuration,
+		})
+		kr.Close()
+		if err != nil {
+			return err
+		}
+		slog.Info("rewrap badger key registry success", slog.String("dbPath", dbPath), slog.Bool("encrypted", old != nil))
+		return nil
+	}
+	return badger.ErrEncryptionKeyMismatch
+}
+
+// restore finds the sequences and the stored bytes of an existing db, from its keys.
+func (c *BadgerAofStorage) restore() error {
+	return c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		first := true
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if len(key) != 8 {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(key)
+			if first {
+				c.firstSeq = seq
+				first = false
+			}
+			c.nextSeq = seq + 1
+			c.stored += it.Item().ValueSize()
+		}
+		// the append times are not stored, batches of a db age from its opening
+		if !first {
+			c.marks = []seqMark{{seq: c.firstSeq, at: time.Now()}}
+		}
+		return nil
 	})
 }
 
-func (c *BadgerAofStorage) Delete(key []byte) error {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-	return c.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(key)
+// runGC rewrites the value log files deleted batches left garbage in, until there is
+// nothing left to rewrite.
+func (c *BadgerAofStorage) runGC(ctx context.Context, interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rewrites := 0
+			for c.db.RunValueLogGC(gcDiscardRatio) == nil {
+				rewrites++
+			}
+			if rewrites > 0 {
+				slog.Info("badger value log gc success", slog.String("dbPath", c.dbPath), slog.Int("rewrites", rewrites))
+			}
+		}
+	}
+}
+
+// seqKey is the key of batch seq, keys sort like sequences.
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// Append stores value as the next batch and returns its sequence.
+func (c *BadgerAofStorage) Append(value []byte) (uint64, error) {
+	slog.Debug("BadgerAofStorage append", slog.Int("val_len", len(value)))
+	req := &appendRequest{allocate: true, value: value}
+	err := c.append(req)
+	return req.seq, err
+}
+
+func (c *BadgerAofStorage) AppendBatch(seq uint64, batch []byte) error {
+	return c.append(&appendRequest{seq: seq, value: batch})
+}
+
+// append queues req and waits until it is flushed. While the storage is full, it
+// waits for batches to be deleted first.
+func (c *BadgerAofStorage) append(req *appendRequest) error {
+	req.done = make(chan struct{})
+	c.lock.Lock()
+	for !c.closed && c.maxBytes > 0 && c.stored > 0 && c.stored+c.pendingBytes() >= c.maxBytes {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.lock.Unlock()
+		return ErrStorageClosed
+	}
+	c.pending = append(c.pending, req)
+	leader := !c.flushing
+	c.flushing = true
+	c.lock.Unlock()
+	if leader {
+		c.flush()
+	}
+	<-req.done
+	return req.err
+}
+
+func (c *BadgerAofStorage) pendingBytes() int64 {
+	var n int64
+	for _, req := range c.pending {
+		n += int64(len(req.value))
+	}
+	return n
+}
+
+// flush writes the pending batches until there are none left.
+func (c *BadgerAofStorage) flush() {
+	c.lock.Lock()
+	for len(c.pending) > 0 {
+		reqs := c.pending
+		c.pending = nil
+		first, next := c.firstSeq, c.nextSeq
+		c.lock.Unlock()
+
+		newFirst, newNext, size := c.writeBatch(reqs, first, next)
+
+		c.lock.Lock()
+		if newNext > next {
+			c.mark(max(next, newFirst), time.Now())
+		}
+		first, next = newFirst, newNext
+		c.firstSeq, c.nextSeq = first, next
+		c.appended += size
+		c.stored += size
+		for _, req := range reqs {
+			close(req.done)
+		}
+	}
+	c.flushing = false
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+// mark records that the batches from seq on were appended at, unless the last mark
+// is less than a second older.
+func (c *BadgerAofStorage) mark(seq uint64, at time.Time) {
+	if n := len(c.marks); n > 0 && at.Sub(c.marks[n-1].at) < time.Second {
+		return
+	}
+	c.marks = append(c.marks, seqMark{seq: seq, at: at})
+}
+
+// writeBatch writes reqs with one WriteBatch after the batches first..next and
+// returns the sequences and bytes with those written.
+func (c *BadgerAofStorage) writeBatch(reqs []*appendRequest, first uint64, next uint64) (uint64, uint64, int64) {
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	newFirst, newNext := first, next
+	var size int64
+	var written []*appendRequest
+	for _, req := range reqs {
+		if !req.allocate {
+			if req.err = checkSeq(req.seq, newNext, newFirst == newNext); req.err != nil {
+				continue
+			}
+			if newFirst == newNext {
+				newFirst, newNext = req.seq, req.seq
+			}
+		}
+		req.seq = newNext
+		if err := wb.Set(seqKey(req.seq), req.value); err != nil {
+			req.err = err
+			continue
+		}
+		newNext++
+		size += int64(len(req.value))
+		written = append(written, req)
+	}
+	if err := wb.Flush(); err != nil {
+		for _, req := range written {
+			req.err = err
+		}
+		return first, next, 0
+	}
+	return newFirst, newNext, size
+}
+
+// TruncateBefore deletes the batches before seq, in transactions of at most
+// truncateBatchKeys keys.
+func (c *BadgerAofStorage) TruncateBefore(seq uint64) error {
+	c.lock.Lock()
+	for c.flushing {
+		c.cond.Wait()
+	}
+	if seq > c.firstSeq {
+		c.firstSeq = seq
+	}
+	if c.firstSeq > c.nextSeq {
+		c.nextSeq = c.firstSeq
+	}
+	c.dropMarks()
+	c.lock.Unlock()
+
+	end := seqKey(seq)
+	for {
+		var keys [][]byte
+		err := c.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid() && len(keys) < truncateBatchKeys; it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if bytes.Compare(key, end) >= 0 {
+					break
+				}
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		if err = c.DeleteArray(keys); err != nil {
+			return err
+		}
+	}
+}
+
+// dropMarks drops the marks of the batches before firstSeq.
+func (c *BadgerAofStorage) dropMarks() {
+	if c.firstSeq >= c.nextSeq {
+		c.marks = nil
+		return
+	}
+	i := sort.Search(len(c.marks), func(i int) bool { return c.marks[i].seq > c.firstSeq })
+	if i > 0 {
+		c.marks = c.marks[i-1:]
+		c.marks[0].seq = c.firstSeq
+	}
+}
+
+// firstSeqSince returns the first sequence appended at or after t, to a second. The
+// last batch is always kept.
+func (c *BadgerAofStorage) firstSeqSince(t time.Time) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.nextSeq <= c.firstSeq+1 {
+		return c.firstSeq
+	}
+	i := sort.Search(len(c.marks), func(i int) bool { return !c.marks[i].at.Before(t) })
+	if i == len(c.marks) {
+		return c.nextSeq - 1
+	}
+	return min(max(c.marks[i].seq, c.firstSeq), c.nextSeq-1)
+}
+
+func (c *BadgerAofStorage) NextSeq() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nextSeq
+}
+
+func (c *BadgerAofStorage) Synced() int64 {
+	if !c.db.Opts().SyncWrites {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.appended
+}
+
+// FirstSeqWithin adds up the value sizes from the last batch back, like restore.
+func (c *BadgerAofStorage) FirstSeqWithin(maxBytes int64) uint64 {
+	c.lock.Lock()
+	first, next := c.firstSeq, c.nextSeq
+	c.lock.Unlock()
+	if next <= first+1 {
+		return first
+	}
+	keep := next - 1
+	_ = c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var size int64
+		for it.Seek(seqKey(next - 1)); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if len(key) != 8 {
+				continue
+			}
+			size += it.Item().ValueSize()
+			if size > maxBytes {
+				break
+			}
+			keep = binary.BigEndian.Uint64(key)
+		}
+		return nil
 	})
+	return keep
+}
+
+func (c *BadgerAofStorage) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lsm, vlog := c.db.Size()
+	stats := Stats{
+		Name:          c.dbPath,
+		Type:          StorageBadger,
+		FirstSeq:      c.firstSeq,
+		NextSeq:       c.nextSeq,
+		AppendedBytes: c.appended,
+		StoredBytes:   c.stored,
+		DiskBytes:     lsm + vlog,
+	}
+	if c.db.Opts().SyncWrites {
+		stats.SyncedBytes = c.appended
+	}
+	return stats
+}
+
+// Close waits for the appends in flight, appenders waiting for space get ErrStorageClosed.
+func (c *BadgerAofStorage) Close() error {
+	unregisterStorage(c)
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	for c.flushing {
+		c.cond.Wait()
+	}
+	c.lock.Unlock()
+	c.cancel()
+	c.wg.Wait()
+	return c.db.Close()
 }
 
+func (c *BadgerAofStorage) Delete(key []byte) error {
+	return c.DeleteArray([][]byte{key})
+}
+
+// DeleteArray deletes keys in one transaction, appenders waiting for space may go on.
 func (c *BadgerAofStorage) DeleteArray(keys [][]byte) error {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-	return c.db.Update(func(txn *badger.Txn) error {
+	var freed int64
+	err := c.db.Update(func(txn *badger.Txn) error {
 		for _, key := range keys {
-			if err := txn.Delete(key); err != nil {
+			item, err := txn.Get(key)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			freed += item.ValueSize()
+			if err = txn.Delete(key); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	// value sizes of the value log are estimated by badger
+	c.stored = max(c.stored-freed, 0)
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	return nil
 }
 
 func (c *BadgerAofStorage) Read(key []byte) ([]byte, error) {
-	c.locker.RLock()
-	defer c.locker.RUnlock()
-
 	var valCopy []byte
 	err := c.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
@@ -84,9 +529,6 @@ func (c *BadgerAofStorage) Read(key []byte) ([]byte, error) {
 }
 
 func (c *BadgerAofStorage) ReadFunc(iterator DbWriteIterator) error {
-	c.locker.RLock()
-	defer c.locker.RUnlock()
-
 	var writeCount int64 = 0
 	err := c.db.View(func(txn *badger.Txn) error {
 		for {
@@ -134,6 +576,6 @@ func (c *BadgerAofStorage) ReadFunc(iterator DbWriteIterator) error {
 }
 
 func (c *BadgerAofStorage) Destroy() {
-	c.db.Close()
+	c.Close()
 	os.RemoveAll(c.dbPath)
 }
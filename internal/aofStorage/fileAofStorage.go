@@ -0,0 +1,385 @@
+package aofStorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"redisFlutter/internal/config"
+	rotate "redisFlutter/internal/utils/file_rotate"
+)
+
+// SeqFileName is the file next to the segments that maps sequences to the stream.
+const SeqFileName = "storage.seq"
+
+var seqMagic = []byte("AOFSEQ01")
+
+const (
+	seqHeaderSize = 16 // magic, first sequence
+	seqRecordSize = 16 // start offset, length
+)
+
+// seqRecord is where a batch is in the stream stored by the writer, see rotate.SegmentIndex.
+type seqRecord struct {
+	start  int64
+	length int64
+}
+
+// FileAofStorage stores batches in rotating segments of an AofAddIndexWriter, the
+// sequence of batch i of the seq file is firstSeq+i.
+type FileAofStorage struct {
+	lock     sync.Mutex
+	name     string
+	dir      string
+	writer   *rotate.AofAddIndexWriter
+	seqFile  *os.File
+	firstSeq uint64
+	records  []seqRecord
+	appended int64
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	reader  *rotate.AofAddIndexReader // reads on from readPos, nil until the first read
+	readPos int64
+	scratch []byte
+}
+
+func NewFileAofStorage(name string, dir string, segmentSize int64) (*FileAofStorage, error) {
+	writer, err := rotate.NewAofAddIndexWriter(name, dir, segmentSize)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	c := &FileAofStorage{
+		name:   name,
+		dir:    dir,
+		writer: writer,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err = c.openSeqFile(); err != nil {
+		c.cancel()
+		writer.Close()
+		return nil, err
+	}
+	slog.Info("open file storage success", slog.String("name", name), slog.String("dir", dir),
+		slog.Uint64("firstSeq", c.firstSeq), slog.Uint64("nextSeq", c.nextSeq()))
+	return c, nil
+}
+
+func (c *FileAofStorage) seqPath() string {
+	return filepath.Join(c.dir, SeqFileName)
+}
+
+// openSeqFile loads the seq file. A torn record and batches the writer lost, cut by
+// the verification of the segments for example, are dropped.
+func (c *FileAofStorage) openSeqFile() error {
+	file, err := os.OpenFile(c.seqPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	c.seqFile = file
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if len(data) < seqHeaderSize {
+		return c.writeSeqHeader(0)
+	}
+	if !bytes.Equal(data[:len(seqMagic)], seqMagic) {
+		return fmt.Errorf("invalid seq file [%s]", c.seqPath())
+	}
+	c.firstSeq = binary.LittleEndian.Uint64(data[len(seqMagic):seqHeaderSize])
+	end := c.writer.Offset()
+	for pos := seqHeaderSize; pos+seqRecordSize <= len(data); pos += seqRecordSize {
+		r := seqRecord{
+			start:  int64(binary.LittleEndian.Uint64(data[pos:])),
+			length: int64(binary.LittleEndian.Uint64(data[pos+8:])),
+		}
+		if r.start+r.length > end {
+			break
+		}
+		c.records = append(c.records, r)
+	}
+	size := int64(seqHeaderSize + len(c.records)*seqRecordSize)
+	if size != int64(len(data)) {
+		slog.Warn("seq file has a torn or lost tail, cut", slog.String("name", c.name), slog.String("filepath", c.seqPath()),
+			slog.Int("size", len(data)), slog.Int64("keep", size))
+		return file.Truncate(size)
+	}
+	return nil
+}
+
+func (c *FileAofStorage) writeSeqHeader(firstSeq uint64) error {
+	header := make([]byte, seqHeaderSize)
+	copy(header, seqMagic)
+	binary.LittleEndian.PutUint64(header[len(seqMagic):], firstSeq)
+	if _, err := c.seqFile.WriteAt(header, 0); err != nil {
+		return err
+	}
+	c.firstSeq = firstSeq
+	return nil
+}
+
+// rewriteSeqFile replaces the seq file atomically with firstSeq and records.
+func (c *FileAofStorage) rewriteSeqFile(firstSeq uint64, records []seqRecord) error {
+	buf := make([]byte, seqHeaderSize+len(records)*seqRecordSize)
+	copy(buf, seqMagic)
+	binary.LittleEndian.PutUint64(buf[len(seqMagic):], firstSeq)
+	for i, r := range records {
+		pos := seqHeaderSize + i*seqRecordSize
+		binary.LittleEndian.PutUint64(buf[pos:], uint64(r.start))
+		binary.LittleEndian.PutUint64(buf[pos+8:], uint64(r.length))
+	}
+	tmp := c.seqPath() + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.seqPath())
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	c.seqFile.Close()
+	c.seqFile = file
+	c.firstSeq = firstSeq
+	c.records = records
+	return nil
+}
+
+func (c *FileAofStorage) nextSeq() uint64 {
+	return c.firstSeq + uint64(len(c.records))
+}
+
+func (c *FileAofStorage) AppendBatch(seq uint64, batch []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := checkSeq(seq, c.nextSeq(), len(c.records) == 0); err != nil {
+		return err
+	}
+	if len(c.records) == 0 && seq != c.firstSeq {
+		if err := c.writeSeqHeader(seq); err != nil {
+			return err
+		}
+	}
+	r := seqRecord{start: c.writer.Offset(), length: int64(len(batch))}
+	if _, err := c.writer.Write(batch); err != nil {
+		// bytes written without a record are skipped by readers
+		return err
+	}
+	rec := make([]byte, seqRecordSize)
+	binary.LittleEndian.PutUint64(rec, uint64(r.start))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(r.length))
+	if _, err := c.seqFile.WriteAt(rec, int64(seqHeaderSize+len(c.records)*seqRecordSize)); err != nil {
+		return err
+	}
+	if config.Opt.Advanced.AofFsync == rotate.FsyncAlways {
+		if err := c.seqFile.Sync(); err != nil {
+			return err
+		}
+	}
+	c.records = append(c.records, r)
+	c.appended += r.length
+	return nil
+}
+
+func (c *FileAofStorage) ReadFunc(iterator DbWriteIterator) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var writeCount int64 = 0
+	for {
+		if writeCount >= int64(iterator.GetBufferCap()) {
+			return nil
+		}
+
+		cindex := iterator.GetCurrentKeyIndex()
+		key := iterator.NextKey()
+		if cindex < c.firstSeq || cindex >= c.nextSeq() {
+			iterator.SetStartKey(cindex)
+			return nil
+		}
+		r := c.records[cindex-c.firstSeq]
+
+		if r.length > int64(iterator.GetBufferCap()) {
+			slog.Warn("get max size data from file storage", slog.Int64("size", r.length))
+			if writeCount > 0 {
+				iterator.SetStartKey(cindex)
+				return nil
+			}
+		} else if writeCount+r.length > int64(iterator.GetBufferCap()) {
+			iterator.SetStartKey(cindex)
+			return nil
+		}
+		wcnt, err := c.readBatch(r, iterator.GetWriter())
+		writeCount += int64(wcnt)
+		if err != nil {
+			iterator.SetStartKey(cindex)
+			return err
+		}
+		iterator.CommitKey(key)
+	}
+}
+
+// readBatch copies the batch at r to w. Batches are mostly read in order, the reader
+// is only reopened when r does not start where it is.
+func (c *FileAofStorage) readBatch(r seqRecord, w io.Writer) (int, error) {
+	if c.reader == nil || c.readPos != r.start {
+		c.closeReader()
+		reader := rotate.NewAofAddIndexReader(c.ctx, c.name+"_storage", c.dir, 0)
+		if err := reader.SeekOffset(r.start); err != nil {
+			reader.Close()
+			return 0, err
+		}
+		c.reader = reader
+		c.readPos = r.start
+	}
+	if int64(cap(c.scratch)) < r.length {
+		c.scratch = make([]byte, r.length)
+	}
+	buf := c.scratch[:r.length]
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		c.closeReader()
+		return 0, err
+	}
+	c.readPos += r.length
+	return w.Write(buf)
+}
+
+func (c *FileAofStorage) closeReader() {
+	if c.reader != nil {
+		c.reader.Close()
+		c.reader = nil
+	}
+}
+
+// TruncateBefore drops the batches before seq and deletes the segments holding only
+// those. When every batch goes, the segments are reinitialized and the stream starts over.
+func (c *FileAofStorage) TruncateBefore(seq uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.truncateBefore(seq)
+}
+
+// truncateBeforeOffset drops the batches that start before offset of the stream, the
+// last batch is always kept. It is the truncate of the retention of the segments.
+func (c *FileAofStorage) truncateBeforeOffset(offset int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.records) == 0 {
+		return nil
+	}
+	i := sort.Search(len(c.records)-1, func(i int) bool {
+		return c.records[i].start >= offset
+	})
+	return c.truncateBefore(c.firstSeq + uint64(i))
+}
+
+func (c *FileAofStorage) truncateBefore(seq uint64) error {
+	if seq <= c.firstSeq {
+		return nil
+	}
+	if seq >= c.nextSeq() {
+		c.closeReader()
+		if err := c.writer.Reinit(); err != nil {
+			return err
+		}
+		return c.rewriteSeqFile(seq, nil)
+	}
+	records := append([]seqRecord(nil), c.records[seq-c.firstSeq:]...)
+	if err := c.rewriteSeqFile(seq, records); err != nil {
+		return err
+	}
+	start := records[0].start
+	if c.reader != nil && c.readPos < start {
+		c.closeReader()
+	}
+	files, err := rotate.RemoveSegmentsBefore(c.dir, start)
+	if err != nil {
+		return err
+	}
+	slog.Info("truncate file storage success", slog.String("name", c.name), slog.Uint64("seq", seq), slog.Int("files", files))
+	return nil
+}
+
+func (c *FileAofStorage) NextSeq() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nextSeq()
+}
+
+func (c *FileAofStorage) Synced() int64 {
+	return c.writer.Synced()
+}
+
+func (c *FileAofStorage) FirstSeqWithin(maxBytes int64) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.records) == 0 {
+		return c.firstSeq
+	}
+	last := c.records[len(c.records)-1]
+	end := last.start + last.length
+	// records are in stream order, the sizes from a record on only decrease
+	i := sort.Search(len(c.records)-1, func(i int) bool {
+		return end-c.records[i].start <= maxBytes
+	})
+	return c.firstSeq + uint64(i)
+}
+
+func (c *FileAofStorage) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var seqSize int64
+	if info, err := c.seqFile.Stat(); err == nil {
+		seqSize = info.Size()
+	}
+	var stored int64
+	if len(c.records) > 0 {
+		last := c.records[len(c.records)-1]
+		stored = last.start + last.length - c.records[0].start
+	}
+	return Stats{
+		Name:          c.name,
+		Type:          StorageFile,
+		FirstSeq:      c.firstSeq,
+		NextSeq:       c.nextSeq(),
+		AppendedBytes: c.appended,
+		SyncedBytes:   c.writer.Synced(),
+		StoredBytes:   stored,
+		DiskBytes:     rotate.SegmentsSize(c.dir) + seqSize,
+	}
+}
+
+func (c *FileAofStorage) Close() error {
+	unregisterStorage(c)
+	// a read waiting for the writer gives up
+	c.cancel()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeReader()
+	err := c.writer.Close()
+	if serr := c.seqFile.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func (c *FileAofStorage) Destroy() {
+	c.Close()
+	c.writer.RemoveAll()
+	os.Remove(c.seqPath())
+}
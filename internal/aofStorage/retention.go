@@ -0,0 +1,78 @@
+package aofStorage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	rotate "redisFlutter/internal/utils/file_rotate"
+)
+
+// RunRetention deletes the oldest batches of s the policy allows until ctx is done and
+// returns the func that stops it and waits. The segments of a storage must not be
+// deleted behind its back, the storage would still point at them, so the retention of
+// a storage goes through TruncateBefore:
+//   - the file storage runs a rotate.Retention on its segments that truncates the
+//     storage to the segments kept, with the size, age and consumed policies.
+//   - the badger storage drops batches by size and by the time they were appended. It
+//     has no segments for cursors to consume, delete consumed does not apply to it.
+func RunRetention(ctx context.Context, name string, s Storage, policy rotate.RetentionPolicy) (stop func()) {
+	switch s := s.(type) {
+	case *FileAofStorage:
+		r := rotate.NewTruncateRetention(name, s.dir, policy, s.truncateBeforeOffset)
+		if !r.Run(ctx) {
+			return func() {}
+		}
+		return r.Stop
+	case *BadgerAofStorage:
+		return runBadgerRetention(ctx, name, s, policy)
+	}
+	return func() {}
+}
+
+func runBadgerRetention(ctx context.Context, name string, s *BadgerAofStorage, policy rotate.RetentionPolicy) (stop func()) {
+	if policy.DeleteConsumed {
+		slog.Warn("badger storage has no segments to consume, delete consumed is ignored", slog.String("name", name))
+	}
+	if policy.MaxTotalBytes <= 0 && policy.MaxAge <= 0 {
+		return func() {}
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = time.Minute
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkBadgerRetention(name, s, policy, time.Now())
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// checkBadgerRetention truncates s to the policy at now and returns the first
+// sequence kept.
+func checkBadgerRetention(name string, s *BadgerAofStorage, policy rotate.RetentionPolicy, now time.Time) uint64 {
+	seq := s.Stats().FirstSeq
+	if policy.MaxTotalBytes > 0 {
+		seq = max(seq, s.FirstSeqWithin(policy.MaxTotalBytes))
+	}
+	if policy.MaxAge > 0 {
+		seq = max(seq, s.firstSeqSince(now.Add(-policy.MaxAge)))
+	}
+	if err := s.TruncateBefore(seq); err != nil {
+		slog.Error("storage retention truncate error", slog.String("name", name), slog.Uint64("seq", seq), slog.String("error", err.Error()))
+	}
+	return seq
+}
@@ -1,6 +1,21 @@
 package aofStorage
 
-import "io"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/status"
+)
+
+const (
+	StorageFile   = "file"
+	StorageBadger = "badger"
+)
 
 type DbWriteIterator interface {
 	GetBufferCap() int
@@ -14,16 +29,114 @@ type DbWriteIterator interface {
 	Reset()
 }
 
+// Storage stores the aof stream as batches numbered by a sequence. Sequences are
+// contiguous, an empty storage starts at the sequence first appended.
 type Storage interface {
-	Append(key []byte, value []byte) error
-	DeleteArray(keys [][]byte) error
+	// AppendBatch stores batch as seq, the next sequence. batch may be reused after it returns.
+	AppendBatch(seq uint64, batch []byte) error
+	// ReadFunc writes the batches from the iterator's current key to its writer, as many
+	// as fit, and commits their keys. The current key is left at the first batch not read.
 	ReadFunc(iterator DbWriteIterator) error
+	// TruncateBefore deletes the batches before seq.
+	TruncateBefore(seq uint64) error
+	// NextSeq returns the sequence AppendBatch expects next.
+	NextSeq() uint64
+	// Synced returns how many of the bytes appended since the storage was opened are durable.
+	Synced() int64
+	// FirstSeqWithin returns the first sequence to keep so the batches from it on take
+	// at most maxBytes. The last batch is always kept.
+	FirstSeqWithin(maxBytes int64) uint64
+	Stats() Stats
+	Close() error
+	// Destroy closes the storage and removes its data.
 	Destroy()
 }
 
-type FileStorage interface {
-	Append(key []byte, value []byte) error
-	DeleteArray(keys [][]byte) error
-	ReadFunc(iterator DbWriteIterator) error
-	Destroy()
+type Stats struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	FirstSeq      uint64 `json:"first_seq"`
+	NextSeq       uint64 `json:"next_seq"`
+	AppendedBytes int64  `json:"appended_bytes"` // since the storage was opened
+	SyncedBytes   int64  `json:"synced_bytes"`   // of the appended bytes, durable
+	StoredBytes   int64  `json:"stored_bytes"`   // of the batches from FirstSeq
+	DiskBytes     int64  `json:"disk_bytes"`
+}
+
+var (
+	storagesLock sync.Mutex
+	storages     []Storage
+)
+
+func init() {
+	status.RegisterHandler("/storage", storageStatusHandler)
+}
+
+// NewStorage opens the storage of aof_storage in dir. Segments of the file storage
+// rotate at segmentSize, the badger storage lives in dir/badger.
+func NewStorage(name string, dir string, segmentSize int64) (Storage, error) {
+	var s Storage
+	var err error
+	switch config.Opt.Advanced.AofStorage {
+	case "", StorageFile:
+		s, err = NewFileAofStorage(name, dir, segmentSize)
+	case StorageBadger:
+		s, err = NewBadgerAofStorage(filepath.Join(dir, "badger"))
+	default:
+		return nil, fmt.Errorf("unknown aof_storage [%s]", config.Opt.Advanced.AofStorage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	storagesLock.Lock()
+	storages = append(storages, s)
+	storagesLock.Unlock()
+	return s, nil
+}
+
+func unregisterStorage(s Storage) {
+	storagesLock.Lock()
+	defer storagesLock.Unlock()
+	for i, registered := range storages {
+		if registered == s {
+			storages = append(storages[:i], storages[i+1:]...)
+			return
+		}
+	}
+}
+
+// checkSeq checks seq is next of a storage that has batches, an empty one starts at any.
+func checkSeq(seq uint64, next uint64, empty bool) error {
+	if !empty && seq != next {
+		return fmt.Errorf("append sequence %d, expect %d", seq, next)
+	}
+	return nil
+}
+
+type storageWriter struct {
+	storage Storage
+}
+
+// NewStorageWriter returns a writer that appends every write as the next batch.
+func NewStorageWriter(s Storage) io.Writer {
+	return &storageWriter{storage: s}
+}
+
+func (w *storageWriter) Write(p []byte) (int, error) {
+	if err := w.storage.AppendBatch(w.storage.NextSeq(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func storageStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	storagesLock.Lock()
+	ret := make([]Stats, 0, len(storages))
+	for _, s := range storages {
+		ret = append(ret, s.Stats())
+	}
+	storagesLock.Unlock()
+	jsonBytes, _ := json.Marshal(ret)
+	_, _ = w.Write(jsonBytes)
 }
@@ -26,3 +26,14 @@ func (r *Redis) IsCluster() bool {
 	reply := r.DoWithStringReply("INFO", "Cluster")
 	return strings.Contains(reply, "cluster_enabled:1")
 }
+
+// ServerVersion returns redis_version of INFO server, such as "7.2.4".
+func (r *Redis) ServerVersion() string {
+	reply := r.DoWithStringReply("INFO", "server")
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+		}
+	}
+	return ""
+}
@@ -2,7 +2,6 @@ package commands
 
 import (
 	"fmt"
-	"math"
 	"strconv"
 	"strings"
 
@@ -57,18 +56,17 @@ func CalcKeys(argv []string) (cmaName string, group string, keys []string, keysI
 			var lastKeyInx int
 			if spec.findKeysRangeLastKey >= 0 {
 				lastKeyInx = begin + spec.findKeysRangeLastKey
+			} else if spec.findKeysRangeLimit > 0 {
+				// same as redis: keys are the first 1/limit of the remaining args,
+				// XREAD STREAMS k1 k2 id1 id2 has limit 2
+				lastKeyInx = begin + (argc-begin)/spec.findKeysRangeLimit + spec.findKeysRangeLastKey
 			} else {
 				lastKeyInx = argc + spec.findKeysRangeLastKey
 			}
-			limitCount := math.MaxInt32
-			if spec.findKeysRangeLimit <= -2 {
-				limitCount = (argc - begin) / (-spec.findKeysRangeLimit)
-			}
 			keyStep := spec.findKeysRangeKeyStep
-			for inx := begin; inx <= lastKeyInx && limitCount > 0; inx += keyStep {
+			for inx := begin; inx <= lastKeyInx; inx += keyStep {
 				keys = append(keys, argv[inx])
 				keysIndexes = append(keysIndexes, inx+1)
-				limitCount -= 1
 			}
 		case "keynum":
 			keynumIdx := begin + spec.findKeysKeynumIndex
@@ -102,6 +100,12 @@ func CalcSlots(keys []string) []int {
 }
 
 func keyHash(key string) uint16 {
+	return utils.Crc16(KeyHashTag(key)) & 0x3FFF
+}
+
+// KeyHashTag returns the part of key that decides its slot, the hashtag between
+// the first '{' and the next '}' if it is not empty, else the whole key.
+func KeyHashTag(key string) string {
 	hashtag := ""
 findHashTag:
 	for i, s := range key {
@@ -115,7 +119,7 @@ findHashTag:
 		}
 	}
 	if len(hashtag) > 0 {
-		key = hashtag
+		return hashtag
 	}
-	return utils.Crc16(key) & 0x3FFF
+	return key
 }
@@ -41,6 +41,12 @@ func TestCalcKeys(t *testing.T) {
 		t.Errorf("CalcKeys(ZUNIONSTORE key 2 key1 key2) failed. cmd=%s, group=%s, keys=%v", cmd, group, keys)
 	}
 
+	// XREAD, keys are the first half after STREAMS
+	cmd, group, keys, _ = CalcKeys([]string{"XREAD", "COUNT", "2", "STREAMS", "s1", "s2", "0", "0"})
+	if cmd != "XREAD" || group != "STREAM" || !testEq(keys, []string{"s1", "s2"}) {
+		t.Errorf("CalcKeys(XREAD COUNT 2 STREAMS s1 s2 0 0) failed. cmd=%s, group=%s, keys=%v", cmd, group, keys)
+	}
+
 	// COMMAND
 	cmd, group, keys, _ = CalcKeys([]string{"COMMAND"})
 	if cmd != "COMMAND" || group != "SERVER" || !testEq(keys, []string{}) {
@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Versions are encoded as major*10000 + minor*100 + patch, 7.4.0 is 70400.
+
+// ParseVersion parses a redis_version string such as "6.2.14", it returns 0 if the
+// string can not be parsed.
+func ParseVersion(version string) int {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	ret := 0
+	for inx, weight := range []int{10000, 100, 1} {
+		if inx >= len(parts) {
+			break
+		}
+		v, err := strconv.Atoi(parts[inx])
+		if err != nil {
+			return 0
+		}
+		ret += v * weight
+	}
+	return ret
+}
+
+// commandSince is the first redis version that has the command, commands not listed
+// are assumed to exist in every version this tool supports as a target.
+// Keys are the same command names as in redisCommands.
+var commandSince = map[string]int{
+	// 4.0
+	"UNLINK": 40000,
+	"SWAPDB": 40000,
+	"MEMORY": 40000,
+	// 5.0
+	"XADD":               50000,
+	"XTRIM":              50000,
+	"XDEL":               50000,
+	"XSETID":             50000,
+	"XGROUP-CREATE":      50000,
+	"XGROUP-SETID":       50000,
+	"XGROUP-DESTROY":     50000,
+	"XGROUP-DELCONSUMER": 50000,
+	"XCLAIM":             50000,
+	"XACK":               50000,
+	"ZPOPMIN":            50000,
+	"ZPOPMAX":            50000,
+	"BZPOPMIN":           50000,
+	"BZPOPMAX":           50000,
+	// 6.2
+	"GETDEL":                60200,
+	"GETEX":                 60200,
+	"COPY":                  60200,
+	"LMOVE":                 60200,
+	"BLMOVE":                60200,
+	"ZRANGESTORE":           60200,
+	"ZDIFFSTORE":            60200,
+	"XAUTOCLAIM":            60200,
+	"XGROUP-CREATECONSUMER": 60200,
+	// 7.0
+	"FUNCTION-LOAD":    70000,
+	"FUNCTION-DELETE":  70000,
+	"FUNCTION-FLUSH":   70000,
+	"FUNCTION-RESTORE": 70000,
+	"FCALL":            70000,
+	"LMPOP":            70000,
+	"BLMPOP":           70000,
+	"ZMPOP":            70000,
+	"BZMPOP":           70000,
+	"SINTERCARD":       70000,
+	"EXPIRETIME":       70000,
+	"PEXPIRETIME":      70000,
+	// 7.4
+	"HEXPIRE":    70400,
+	"HPEXPIRE":   70400,
+	"HEXPIREAT":  70400,
+	"HPEXPIREAT": 70400,
+	"HPERSIST":   70400,
+	// 8.0
+	"HGETDEL": 80000,
+	"HGETEX":  80000,
+	"HSETEX":  80000,
+}
+
+// CommandSince returns the first version that has the command, 0 if it is not in the table.
+func CommandSince(cmdName string) int {
+	return commandSince[strings.ToUpper(cmdName)]
+}
+
+// optionSince is the first version that accepts an option of a command.
+// Options are matched case-insensitively against the arguments after the keys.
+var optionSince = map[string]map[string]int{
+	"SET": {
+		"KEEPTTL": 60000,
+		"GET":     60200,
+		"EXAT":    60200,
+		"PXAT":    60200,
+	},
+	"RESTORE": {
+		"ABSTTL":   50000,
+		"IDLETIME": 50000,
+		"FREQ":     50000,
+	},
+	"XSETID": {
+		"ENTRIESADDED": 70000,
+		"MAXDELETEDID": 70000,
+	},
+	"XADD": {
+		"NOMKSTREAM": 60200,
+		"MINID":      60200,
+		"LIMIT":      60200,
+	},
+	"XTRIM": {
+		"MINID": 60200,
+		"LIMIT": 60200,
+	},
+	"ZADD": {
+		"GT": 60200,
+		"LT": 60200,
+	},
+	"EXPIRE": {
+		"NX": 70000,
+		"XX": 70000,
+		"GT": 70000,
+		"LT": 70000,
+	},
+	"PEXPIRE": {
+		"NX": 70000,
+		"XX": 70000,
+		"GT": 70000,
+		"LT": 70000,
+	},
+	"EXPIREAT": {
+		"NX": 70000,
+		"XX": 70000,
+		"GT": 70000,
+		"LT": 70000,
+	},
+	"PEXPIREAT": {
+		"NX": 70000,
+		"XX": 70000,
+		"GT": 70000,
+		"LT": 70000,
+	},
+}
+
+// OptionSince returns the first version that accepts the option of the command,
+// 0 if it is not in the table.
+func OptionSince(cmdName string, option string) int {
+	options, ok := optionSince[strings.ToUpper(cmdName)]
+	if !ok {
+		return 0
+	}
+	return options[strings.ToUpper(option)]
+}
+
+// CommandNamesSince returns the commands that need a version newer than version.
+func CommandNamesSince(version int) []string {
+	names := make([]string, 0)
+	for name, since := range commandSince {
+		if since > version {
+			names = append(names, name)
+		}
+	}
+	return names
+}
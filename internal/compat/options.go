@@ -0,0 +1,94 @@
+package compat
+
+import "strings"
+
+// optionLayout tells where the options of a command are and how many values follow each option.
+type optionLayout struct {
+	start int // index in argv of the first option
+	// leading options come before the payload (XADD id field value, ZADD score member),
+	// scanning stops at the first argument that is not an option
+	leading bool
+	arity   map[string]int
+	// conditional options decide whether the command writes at all, the command can
+	// not go without them
+	conditional map[string]bool
+}
+
+// expireConditions are the conditional options of the expire commands.
+var expireConditions = map[string]bool{"NX": true, "XX": true, "GT": true, "LT": true}
+
+var optionLayouts = map[string]optionLayout{
+	"SET": {start: 3, arity: map[string]int{
+		"NX": 0, "XX": 0, "GET": 0, "KEEPTTL": 0, "EX": 1, "PX": 1, "EXAT": 1, "PXAT": 1,
+	}},
+	"RESTORE": {start: 4, arity: map[string]int{
+		"REPLACE": 0, "ABSTTL": 0, "IDLETIME": 1, "FREQ": 1,
+	}},
+	"XSETID": {start: 3, arity: map[string]int{
+		"ENTRIESADDED": 1, "MAXDELETEDID": 1,
+	}},
+	"XADD": {start: 2, leading: true, arity: map[string]int{
+		"NOMKSTREAM": 0, "MAXLEN": 1, "MINID": 1, "LIMIT": 1,
+	}, conditional: map[string]bool{"NOMKSTREAM": true}},
+	"XTRIM": {start: 2, arity: map[string]int{
+		"MAXLEN": 1, "MINID": 1, "LIMIT": 1,
+	}},
+	"ZADD": {start: 2, leading: true, arity: map[string]int{
+		"NX": 0, "XX": 0, "GT": 0, "LT": 0, "CH": 0, "INCR": 0,
+	}, conditional: map[string]bool{"NX": true, "XX": true, "GT": true, "LT": true}},
+	"EXPIRE":    {start: 3, arity: map[string]int{"NX": 0, "XX": 0, "GT": 0, "LT": 0}, conditional: expireConditions},
+	"PEXPIRE":   {start: 3, arity: map[string]int{"NX": 0, "XX": 0, "GT": 0, "LT": 0}, conditional: expireConditions},
+	"EXPIREAT":  {start: 3, arity: map[string]int{"NX": 0, "XX": 0, "GT": 0, "LT": 0}, conditional: expireConditions},
+	"PEXPIREAT": {start: 3, arity: map[string]int{"NX": 0, "XX": 0, "GT": 0, "LT": 0}, conditional: expireConditions},
+}
+
+// option is one option found in argv, values are argv[index+1 : index+1+arity]
+type option struct {
+	name        string
+	index       int
+	arity       int
+	conditional bool
+}
+
+// scanOptions returns the options of argv according to the layout of cmdName.
+func scanOptions(cmdName string, argv []string) []option {
+	layout, ok := optionLayouts[cmdName]
+	if !ok {
+		return nil
+	}
+	ret := make([]option, 0, 2)
+	for inx := layout.start; inx < len(argv); inx++ {
+		name := strings.ToUpper(argv[inx])
+		arity, ok := layout.arity[name]
+		if !ok {
+			if layout.leading {
+				break
+			}
+			continue
+		}
+		// MAXLEN ~ 1000, the = and ~ modifiers count as a value of the option
+		if arity > 0 && inx+1 < len(argv) && (argv[inx+1] == "=" || argv[inx+1] == "~") {
+			arity++
+		}
+		ret = append(ret, option{name: name, index: inx, arity: arity, conditional: layout.conditional[name]})
+		inx += arity
+	}
+	return ret
+}
+
+// removeOptions returns a copy of argv without the given options and their values.
+func removeOptions(argv []string, options []option) []string {
+	skip := make(map[int]bool)
+	for _, opt := range options {
+		for i := 0; i <= opt.arity; i++ {
+			skip[opt.index+i] = true
+		}
+	}
+	ret := make([]string, 0, len(argv))
+	for inx, arg := range argv {
+		if !skip[inx] {
+			ret = append(ret, arg)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,220 @@
+package compat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redisFlutter/internal/commands"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+)
+
+const (
+	ModeOff     = "off"
+	ModeRewrite = "rewrite"
+	ModeStrict  = "strict"
+)
+
+// ruleFunc rewrites an entry into forms the target understands. It returns
+// the entries to send, nil to drop the entry, or an error when it can not be rewritten.
+type ruleFunc func(r *Rewriter, e *entry.Entry, unsupported []option) ([]*entry.Entry, error)
+
+// Rewriter is the stage that rewrites entries for a target older than the source.
+// Commands newer than the target are rewritten into older equivalents by rules,
+// options newer than the target are dropped with a warning, unless they make the write
+// conditional, anything else is rejected.
+type Rewriter struct {
+	targetVersion int
+	strict        bool
+
+	lock   sync.Mutex
+	warned map[string]bool
+	stat   rewriterStat
+}
+
+type rewriterStat struct {
+	TargetVersion int              `json:"target_version"`
+	Rewritten     map[string]int64 `json:"rewritten"`
+	Rejected      map[string]int64 `json:"rejected"`
+}
+
+// reportedVersions holds the target versions whose Report is logged already.
+var reportedVersions sync.Map
+
+// NewRewriter returns nil when mode is off, a nil *Rewriter passes entries through.
+func NewRewriter(mode string, targetVersion string) *Rewriter {
+	switch mode {
+	case "", ModeOff:
+		return nil
+	case ModeRewrite, ModeStrict:
+	default:
+		log.Panicf("unknown target compat mode: %s", mode)
+	}
+	version := commands.ParseVersion(targetVersion)
+	if version == 0 {
+		log.Panicf("can not parse target redis_version: [%s]", targetVersion)
+	}
+	r := &Rewriter{
+		targetVersion: version,
+		strict:        mode == ModeStrict,
+		warned:        make(map[string]bool),
+	}
+	r.stat.TargetVersion = version
+	r.stat.Rewritten = make(map[string]int64)
+	r.stat.Rejected = make(map[string]int64)
+	// writers with several connections build a rewriter each, the report is the same
+	if _, reported := reportedVersions.LoadOrStore(version, true); !reported {
+		for _, line := range r.Report() {
+			log.Warnf("target compat: %s", line)
+		}
+	}
+	return r
+}
+
+// Report describes, before the sync starts, what the target version can not run as is.
+func (r *Rewriter) Report() []string {
+	lines := make([]string, 0)
+	names := commands.CommandNamesSince(r.targetVersion)
+	sort.Strings(names)
+	var rewritten, rejected []string
+	for _, name := range names {
+		if _, ok := rules[name]; ok {
+			rewritten = append(rewritten, name)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+	if len(rewritten) > 0 {
+		lines = append(lines, fmt.Sprintf("target version %d, commands rewritten into older forms: %s", r.targetVersion, strings.Join(rewritten, " ")))
+	}
+	if len(rejected) > 0 {
+		lines = append(lines, fmt.Sprintf("target version %d, commands rejected: %s", r.targetVersion, strings.Join(rejected, " ")))
+	}
+	return lines
+}
+
+// Rewrite returns the entries to send in place of e.
+func (r *Rewriter) Rewrite(e *entry.Entry) []*entry.Entry {
+	if r == nil {
+		return []*entry.Entry{e}
+	}
+	if e.CmdName == "" {
+		e.Parse()
+	}
+	cmdTooNew := commands.CommandSince(e.CmdName) > r.targetVersion
+	var unsupported []option
+	for _, opt := range scanOptions(e.CmdName, e.Argv) {
+		if commands.OptionSince(e.CmdName, opt.name) > r.targetVersion {
+			unsupported = append(unsupported, opt)
+		}
+	}
+	rule, hasRule := rules[e.CmdName]
+	needRule := cmdTooNew || (hasRule && r.ruleWantsArgv(e))
+	if !needRule && len(unsupported) == 0 {
+		return []*entry.Entry{e}
+	}
+	if hasRule {
+		ret, err := rule(r, e, unsupported)
+		if err == nil {
+			r.count(r.stat.Rewritten, e.CmdName)
+			return ret
+		}
+		r.reject(e, err.Error())
+		return nil
+	}
+	if cmdTooNew {
+		r.reject(e, "command not supported by target")
+		return nil
+	}
+	for _, opt := range unsupported {
+		// without the condition the target would write what the source did not
+		if opt.conditional {
+			r.reject(e, fmt.Sprintf("conditional option %s not supported by target", opt.name))
+			return nil
+		}
+	}
+	return []*entry.Entry{r.dropOptions(e, unsupported)}
+}
+
+// ruleWantsArgv tells whether a rule must look at a command the target knows,
+// for example HSET with several fields before 4.0.
+func (r *Rewriter) ruleWantsArgv(e *entry.Entry) bool {
+	return e.CmdName == "HSET" && r.targetVersion < 40000 && len(e.Argv) > 4
+}
+
+func (r *Rewriter) dropOptions(e *entry.Entry, unsupported []option) *entry.Entry {
+	for _, opt := range unsupported {
+		r.warnOnce(e.CmdName+" "+opt.name, "option %s of %s is not supported by target, dropped. cmd=[%s]", opt.name, e.CmdName, e.String())
+	}
+	r.count(r.stat.Rewritten, e.CmdName)
+	return newEntry(e, removeOptions(e.Argv, unsupported))
+}
+
+func (r *Rewriter) reject(e *entry.Entry, reason string) {
+	if r.strict {
+		log.Panicf("target compat: %s. target_version=[%d], cmd=[%s]", reason, r.targetVersion, e.String())
+	}
+	r.count(r.stat.Rejected, e.CmdName)
+	r.warnOnce("reject "+e.CmdName, "target compat: %s, entries of %s are dropped. cmd=[%s]", reason, e.CmdName, e.String())
+}
+
+func (r *Rewriter) warnOnce(key string, format string, args ...interface{}) {
+	r.lock.Lock()
+	warned := r.warned[key]
+	r.warned[key] = true
+	r.lock.Unlock()
+	if !warned {
+		log.Warnf(format, args...)
+	}
+}
+
+func (r *Rewriter) count(counter map[string]int64, cmdName string) {
+	r.lock.Lock()
+	counter[cmdName]++
+	r.lock.Unlock()
+}
+
+func (r *Rewriter) Status() interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stat := r.stat
+	stat.Rewritten = make(map[string]int64, len(r.stat.Rewritten))
+	for k, v := range r.stat.Rewritten {
+		stat.Rewritten[k] = v
+	}
+	stat.Rejected = make(map[string]int64, len(r.stat.Rejected))
+	for k, v := range r.stat.Rejected {
+		stat.Rejected[k] = v
+	}
+	return stat
+}
+
+func newEntry(from *entry.Entry, argv []string) *entry.Entry {
+	e := entry.NewEntry()
+	e.DbId = from.DbId
+	e.FromRdb = from.FromRdb
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
+
+// relativeTtl turns an absolute unix time into a ttl counted from now, at least 1.
+func relativeTtl(absolute string, unit time.Duration) (string, error) {
+	at, err := strconv.ParseInt(absolute, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UnixMilli()
+	if unit == time.Second {
+		now = time.Now().Unix()
+	}
+	ttl := at - now
+	if ttl <= 0 {
+		ttl = 1
+	}
+	return strconv.FormatInt(ttl, 10), nil
+}
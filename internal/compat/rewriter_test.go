@@ -0,0 +1,82 @@
+package compat
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/entry"
+)
+
+func newTestEntry(argv ...string) *entry.Entry {
+	e := entry.NewEntry()
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
+
+func rewriteArgv(r *Rewriter, argv ...string) [][]string {
+	ret := make([][]string, 0)
+	for _, e := range r.Rewrite(newTestEntry(argv...)) {
+		ret = append(ret, e.Argv)
+	}
+	return ret
+}
+
+func Test_Rewriter_off(t *testing.T) {
+	var r *Rewriter = NewRewriter(ModeOff, "3.2.0")
+	assert.Nil(t, r)
+	assert.Equal(t, [][]string{{"HSET", "k", "f1", "v1", "f2", "v2"}}, rewriteArgv(r, "HSET", "k", "f1", "v1", "f2", "v2"))
+}
+
+func Test_Rewriter_redis3(t *testing.T) {
+	r := NewRewriter(ModeRewrite, "3.2.12")
+	assert.Equal(t, [][]string{{"HMSET", "k", "f1", "v1", "f2", "v2"}}, rewriteArgv(r, "HSET", "k", "f1", "v1", "f2", "v2"))
+	assert.Equal(t, [][]string{{"HSET", "k", "f1", "v1"}}, rewriteArgv(r, "HSET", "k", "f1", "v1"))
+	assert.Equal(t, [][]string{{"DEL", "a", "b"}}, rewriteArgv(r, "UNLINK", "a", "b"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "UNLINK"))
+	assert.Equal(t, [][]string{{"SET", "k", "v", "NX"}}, rewriteArgv(r, "SET", "k", "v", "NX", "GET"))
+	assert.Equal(t, [][]string{{"EVAL", setKeepTtlScript, "1", "k", "v"}}, rewriteArgv(r, "SET", "k", "v", "KEEPTTL"))
+	assert.Equal(t, [][]string{{"RPOPLPUSH", "a", "b"}}, rewriteArgv(r, "LMOVE", "a", "b", "RIGHT", "LEFT"))
+	assert.Equal(t, [][]string{{"EVAL", lmoveScript, "2", "a", "b", "lpop", "rpush"}}, rewriteArgv(r, "LMOVE", "a", "b", "LEFT", "RIGHT"))
+	assert.Equal(t, [][]string{{"DEL", "k"}}, rewriteArgv(r, "GETDEL", "k"))
+	assert.Equal(t, [][]string{{"PEXPIRE", "k", "100"}}, rewriteArgv(r, "GETEX", "k", "PX", "100"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "FUNCTION", "LOAD", "#!lua name=lib\n"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "HPEXPIREAT", "k", "1000", "FIELDS", "1", "f"))
+	assert.Equal(t, int64(1), r.Status().(rewriterStat).Rejected["FUNCTION-LOAD"])
+	// malformed commands are rejected, not read out of range
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "LMOVE", "a", "b", "LEFT"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "BLMOVE", "a", "b", "RIGHT"))
+	assert.Equal(t, int64(2), r.Status().(rewriterStat).Rejected["LMOVE"]+r.Status().(rewriterStat).Rejected["BLMOVE"])
+	assert.True(t, len(r.Report()) == 2)
+}
+
+func Test_Rewriter_setExAt(t *testing.T) {
+	r := NewRewriter(ModeRewrite, "6.0.9")
+	at := strconv.FormatInt(time.Now().Unix()+100, 10)
+	ret := rewriteArgv(r, "SET", "k", "v", "EXAT", at)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, "EX", ret[0][3])
+	ttl, _ := strconv.Atoi(ret[0][4])
+	assert.True(t, ttl > 90 && ttl <= 100)
+	// KEEPTTL exists since 6.0
+	assert.Equal(t, [][]string{{"SET", "k", "v", "KEEPTTL"}}, rewriteArgv(r, "SET", "k", "v", "KEEPTTL"))
+}
+
+func Test_Rewriter_options(t *testing.T) {
+	r := NewRewriter(ModeRewrite, "6.2.0")
+	assert.Equal(t, [][]string{{"XSETID", "s", "1-1"}}, rewriteArgv(r, "XSETID", "s", "1-1", "ENTRIESADDED", "3", "MAXDELETEDID", "0-1"))
+	// conditional options can not be dropped, the target would write unconditionally
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "EXPIRE", "k", "10", "NX"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r, "PEXPIREAT", "k", "10", "GT"))
+	assert.Equal(t, int64(1), r.Status().(rewriterStat).Rejected["EXPIRE"])
+	assert.Equal(t, [][]string{{"XADD", "s", "MAXLEN", "~", "10", "*", "LIMIT", "v"}}, rewriteArgv(r, "XADD", "s", "MAXLEN", "~", "10", "*", "LIMIT", "v"))
+
+	r5 := NewRewriter(ModeRewrite, "5.0.14")
+	assert.Equal(t, [][]string{{"XADD", "s", "MAXLEN", "~", "10", "*", "f", "v"}}, rewriteArgv(r5, "XADD", "s", "MAXLEN", "~", "10", "LIMIT", "5", "*", "f", "v"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r5, "XADD", "s", "NOMKSTREAM", "*", "f", "v"))
+	assert.Equal(t, [][]string{}, rewriteArgv(r5, "ZADD", "z", "XX", "GT", "1", "GT"))
+	assert.Equal(t, [][]string{{"ZADD", "z", "XX", "1", "GT"}}, rewriteArgv(r5, "ZADD", "z", "XX", "1", "GT"))
+}
@@ -0,0 +1,174 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"redisFlutter/internal/entry"
+)
+
+// rules rewrite commands, or options of commands, that are newer than the target.
+var rules = map[string]ruleFunc{
+	"HSET":    ruleHSet,
+	"SET":     ruleSet,
+	"RESTORE": ruleRestore,
+	"GETDEL":  ruleGetDel,
+	"GETEX":   ruleGetEx,
+	"LMOVE":   ruleLMove,
+	"BLMOVE":  ruleLMove,
+	"UNLINK":  ruleUnlink,
+}
+
+// setKeepTtlScript runs SET without KEEPTTL and puts the old ttl back.
+const setKeepTtlScript = "local t = redis.call('pttl', KEYS[1]) " +
+	"local r = redis.call('set', KEYS[1], unpack(ARGV)) " +
+	"if t > 0 then redis.call('pexpire', KEYS[1], t) end " +
+	"return r"
+
+// lmoveScript pops from one side of KEYS[1] and pushes to one side of KEYS[2].
+const lmoveScript = "local v = redis.call(ARGV[1], KEYS[1]) " +
+	"if v then redis.call(ARGV[2], KEYS[2], v) end " +
+	"return v"
+
+// checkArgc fails entries with fewer than n arguments, command name included, which
+// a rule could not read without going out of range.
+func checkArgc(e *entry.Entry, n int) error {
+	if len(e.Argv) < n {
+		return fmt.Errorf("%s with %d arguments, expect at least %d", e.CmdName, len(e.Argv)-1, n-1)
+	}
+	return nil
+}
+
+// HSET key field value [field value ...] => HMSET key field value [field value ...]
+func ruleHSet(_ *Rewriter, e *entry.Entry, _ []option) ([]*entry.Entry, error) {
+	argv := append([]string{"HMSET"}, e.Argv[1:]...)
+	return []*entry.Entry{newEntry(e, argv)}, nil
+}
+
+// SET key value GET     => SET key value, the reply is not needed when replaying
+// SET key value EXAT ts => SET key value EX ttl
+// SET key value KEEPTTL => EVAL shim
+func ruleSet(r *Rewriter, e *entry.Entry, unsupported []option) ([]*entry.Entry, error) {
+	argv := make([]string, len(e.Argv))
+	copy(argv, e.Argv)
+	keepTtl := false
+	drop := make([]option, 0, len(unsupported))
+	for _, opt := range unsupported {
+		switch opt.name {
+		case "GET":
+			drop = append(drop, opt)
+		case "KEEPTTL":
+			keepTtl = true
+			drop = append(drop, opt)
+		case "EXAT", "PXAT":
+			unit := time.Second
+			argv[opt.index] = "EX"
+			if opt.name == "PXAT" {
+				unit = time.Millisecond
+				argv[opt.index] = "PX"
+			}
+			ttl, err := relativeTtl(argv[opt.index+1], unit)
+			if err != nil {
+				return nil, err
+			}
+			argv[opt.index+1] = ttl
+		}
+	}
+	argv = removeOptions(argv, drop)
+	if !keepTtl {
+		return []*entry.Entry{newEntry(e, argv)}, nil
+	}
+	if r.targetVersion < 20600 {
+		return nil, fmt.Errorf("KEEPTTL needs EVAL, target has no scripting")
+	}
+	shim := append([]string{"EVAL", setKeepTtlScript, "1", argv[1]}, argv[2:]...)
+	return []*entry.Entry{newEntry(e, shim)}, nil
+}
+
+// RESTORE key ttl value ABSTTL => RESTORE key relative_ttl value, IDLETIME and FREQ are dropped
+func ruleRestore(r *Rewriter, e *entry.Entry, unsupported []option) ([]*entry.Entry, error) {
+	if err := checkArgc(e, 4); err != nil {
+		return nil, err
+	}
+	argv := make([]string, len(e.Argv))
+	copy(argv, e.Argv)
+	for _, opt := range unsupported {
+		if opt.name == "ABSTTL" && argv[2] != "0" {
+			ttl, err := relativeTtl(argv[2], time.Millisecond)
+			if err != nil {
+				return nil, err
+			}
+			argv[2] = ttl
+		}
+		if opt.name != "ABSTTL" {
+			r.warnOnce("RESTORE "+opt.name, "option %s of RESTORE is not supported by target, dropped", opt.name)
+		}
+	}
+	return []*entry.Entry{newEntry(e, removeOptions(argv, unsupported))}, nil
+}
+
+// GETDEL key => DEL key
+func ruleGetDel(_ *Rewriter, e *entry.Entry, _ []option) ([]*entry.Entry, error) {
+	if err := checkArgc(e, 2); err != nil {
+		return nil, err
+	}
+	return []*entry.Entry{newEntry(e, []string{"DEL", e.Argv[1]})}, nil
+}
+
+// GETEX only changes the ttl, replay it with the matching expire command.
+func ruleGetEx(_ *Rewriter, e *entry.Entry, _ []option) ([]*entry.Entry, error) {
+	if err := checkArgc(e, 2); err != nil {
+		return nil, err
+	}
+	if len(e.Argv) == 2 {
+		return nil, nil // plain GETEX is a read
+	}
+	key := e.Argv[1]
+	option := strings.ToUpper(e.Argv[2])
+	if option == "PERSIST" {
+		return []*entry.Entry{newEntry(e, []string{"PERSIST", key})}, nil
+	}
+	if len(e.Argv) < 4 {
+		return nil, fmt.Errorf("GETEX %s without value", option)
+	}
+	switch option {
+	case "EX":
+		return []*entry.Entry{newEntry(e, []string{"EXPIRE", key, e.Argv[3]})}, nil
+	case "PX":
+		return []*entry.Entry{newEntry(e, []string{"PEXPIRE", key, e.Argv[3]})}, nil
+	case "EXAT":
+		return []*entry.Entry{newEntry(e, []string{"EXPIREAT", key, e.Argv[3]})}, nil
+	case "PXAT":
+		return []*entry.Entry{newEntry(e, []string{"PEXPIREAT", key, e.Argv[3]})}, nil
+	}
+	return nil, fmt.Errorf("unknown GETEX option %s", e.Argv[2])
+}
+
+// LMOVE src dst RIGHT LEFT => RPOPLPUSH src dst, other directions use an EVAL shim.
+// BLMOVE is propagated as LMOVE by the master, the timeout is ignored if it shows up.
+func ruleLMove(r *Rewriter, e *entry.Entry, _ []option) ([]*entry.Entry, error) {
+	if err := checkArgc(e, 5); err != nil {
+		return nil, err
+	}
+	src, dst := e.Argv[1], e.Argv[2]
+	from, to := strings.ToUpper(e.Argv[3]), strings.ToUpper(e.Argv[4])
+	if from == "RIGHT" && to == "LEFT" {
+		return []*entry.Entry{newEntry(e, []string{"RPOPLPUSH", src, dst})}, nil
+	}
+	if r.targetVersion < 20600 {
+		return nil, fmt.Errorf("LMOVE %s %s needs EVAL, target has no scripting", from, to)
+	}
+	pop := map[string]string{"LEFT": "lpop", "RIGHT": "rpop"}[from]
+	push := map[string]string{"LEFT": "lpush", "RIGHT": "rpush"}[to]
+	return []*entry.Entry{newEntry(e, []string{"EVAL", lmoveScript, "2", src, dst, pop, push})}, nil
+}
+
+// UNLINK key [key ...] => DEL key [key ...]
+func ruleUnlink(_ *Rewriter, e *entry.Entry, _ []option) ([]*entry.Entry, error) {
+	if err := checkArgc(e, 2); err != nil {
+		return nil, err
+	}
+	argv := append([]string{"DEL"}, e.Argv[1:]...)
+	return []*entry.Entry{newEntry(e, argv)}, nil
+}
@@ -23,6 +23,8 @@ type FilterOptions struct {
 	BlockKeySuffix    []string `mapstructure:"block_key_suffix" default:"[]"`
 	AllowKeyRegex     []string `mapstructure:"allow_key_regex" default:"[]"`
 	BlockKeyRegex     []string `mapstructure:"block_key_regex" default:"[]"`
+	AllowKeyGlob      []string `mapstructure:"allow_key_glob" default:"[]"`
+	BlockKeyGlob      []string `mapstructure:"block_key_glob" default:"[]"`
 	AllowDB           []int    `mapstructure:"allow_db" default:"[]"`
 	BlockDB           []int    `mapstructure:"block_db" default:"[]"`
 	AllowCommand      []string `mapstructure:"allow_command" default:"[]"`
@@ -30,6 +32,43 @@ type FilterOptions struct {
 	AllowCommandGroup []string `mapstructure:"allow_command_group" default:"[]"`
 	BlockCommandGroup []string `mapstructure:"block_command_group" default:"[]"`
 	Function          string   `mapstructure:"function" default:""`
+	// function_timeout_ms is the time budget of one call of the function, 0 for no budget.
+	// With a budget, also consider a function_error_policy other than panic.
+	FunctionTimeoutMs int64 `mapstructure:"function_timeout_ms" default:"0"`
+	// function_error_policy is what happens to an entry when the function fails or
+	// runs out of time: drop, pass (send the entry unchanged) or panic
+	FunctionErrorPolicy string `mapstructure:"function_error_policy" default:"panic"`
+
+	// sample_ratio keeps this fraction of the keyspace, for example 0.01, chosen by
+	// the crc16 of the key, so a key is in or out the same way in the rdb and aof phases.
+	// Keys with a hashtag are sampled by the hashtag. 0 or 1 keeps all keys.
+	SampleRatio float64 `mapstructure:"sample_ratio" default:"0"`
+	// sample_seed changes which keys are in the sample for the same ratio
+	SampleSeed string `mapstructure:"sample_seed" default:""`
+
+	// big_key_rules match keys of the rdb phase by size, "<type>:<elements|bytes>:<threshold>",
+	// type is string, list, set, zset, hash, stream, module or *.
+	// For example ["hash:elements:500000", "string:bytes:52428800"]
+	BigKeyRules []string `mapstructure:"big_key_rules" default:"[]"`
+	// big_key_action is skip, or slow_lane to send big keys on a separate connection.
+	// The writers are built for it at start, a reload can not change it.
+	BigKeyAction string `mapstructure:"big_key_action" default:"skip"`
+	// big_key_report_file gets one line for every big key, empty for no report
+	BigKeyReportFile string `mapstructure:"big_key_report_file" default:""`
+}
+
+type TransformOptions struct {
+	// db_map maps source db to target db, for example ["1:0", "2:5"]. Dbs not listed are kept.
+	DbMap []string `mapstructure:"db_map" default:"[]"`
+	// flatten_db moves every db into target db0 and prefixes the keys with "db<n>:",
+	// <n> is the db after db_map. Used for cluster targets that only have db0. MOVE and
+	// COPY are dropped unless their keys have a hashtag, they would span slots.
+	FlattenDb bool `mapstructure:"flatten_db" default:"false"`
+	// key_replace_prefix replaces the prefix of keys, for example ["old:=>new:"].
+	// The first matching rule wins.
+	KeyReplacePrefix []string `mapstructure:"key_replace_prefix" default:"[]"`
+	// key_add_prefix is added to every key after key_replace_prefix, for example "tenantA:"
+	KeyAddPrefix string `mapstructure:"key_add_prefix" default:""`
 }
 
 type AdvancedOptions struct {
@@ -62,10 +101,74 @@ type AdvancedOptions struct {
 	PipelineCountLimit              uint64 `mapstructure:"pipeline_count_limit" default:"1024"`
 	TargetRedisClientMaxQuerybufLen int64  `mapstructure:"target_redis_client_max_querybuf_len" default:"1024000000"`
 	TargetRedisProtoMaxBulkLen      uint64 `mapstructure:"target_redis_proto_max_bulk_len" default:"512000000"`
+	// TargetRedisMaxInflightEntries limits the entries sent to target but not answered yet, 0 means no limit.
+	// The bytes in flight are limited by TargetRedisClientMaxQuerybufLen.
+	TargetRedisMaxInflightEntries int64 `mapstructure:"target_redis_max_inflight_entries" default:"0"`
+
+	// rate limit of writing to target, 0 means no limit. The rdb limits are used for
+	// entries of full sync when set, otherwise the same limits apply to both phases.
+	// They can be changed at runtime through http://localhost:<status_port>/rate_limit
+	RateLimitOps      int64 `mapstructure:"rate_limit_ops" default:"0"`
+	RateLimitBytes    int64 `mapstructure:"rate_limit_bytes" default:"0"`
+	RateLimitRdbOps   int64 `mapstructure:"rate_limit_rdb_ops" default:"0"`
+	RateLimitRdbBytes int64 `mapstructure:"rate_limit_rdb_bytes" default:"0"`
+
+	// target_compat rewrites commands and options the target redis version does not support:
+	// off:     send entries as they are.
+	// rewrite: rewrite into older equivalent forms, drop what can not be rewritten with a warning.
+	// strict:  rewrite into older equivalent forms, stop when meet what can not be rewritten.
+	TargetCompat string `mapstructure:"target_compat" default:"off"`
 
 	AwsPSync string `mapstructure:"aws_psync" default:""` // 10.0.0.1:6379@nmfu2sl5osync,10.0.0.1:6379@xhma21xfkssync
 
 	EmptyDBBeforeSync bool `mapstructure:"empty_db_before_sync" default:"false"`
+
+	// retention of rotated aof segments, checked every aof_retention_interval_sec.
+	// The segment being written and segments a reader has open are never deleted.
+	// aof_retention_max_bytes deletes the oldest segments while the dir is larger, 0 means no limit.
+	// aof_retention_max_age_sec deletes segments not written for longer, 0 means no limit.
+	// aof_retention_delete_consumed deletes segments every registered cursor has read past.
+	// The aof storage of the readers and the sync server deletes its oldest batches
+	// instead, so it never points at deleted segments. The badger storage has no
+	// segments, it applies max_bytes and max_age_sec to its batches and ignores consumed.
+	AofRetentionMaxBytes       int64 `mapstructure:"aof_retention_max_bytes" default:"0"`
+	AofRetentionMaxAgeSec      int64 `mapstructure:"aof_retention_max_age_sec" default:"0"`
+	AofRetentionDeleteConsumed bool  `mapstructure:"aof_retention_delete_consumed" default:"false"`
+	AofRetentionIntervalSec    int64 `mapstructure:"aof_retention_interval_sec" default:"60"`
+	// aof_compression compresses aof segments once they are rotated: zstd, gzip or none.
+	// Readers read raw and compressed segments, so it can be changed at any time.
+	AofCompression string `mapstructure:"aof_compression" default:"zstd"`
+	// aof_verify checks the aof segments when a writer starts: off, tail (the last segment) or full.
+	// aof_repair cuts a truncated or invalid tail back to the last complete command.
+	AofVerify string `mapstructure:"aof_verify" default:"tail"`
+	AofRepair bool   `mapstructure:"aof_repair" default:"true"`
+	// aof_fsync is when aof writes are fsynced, like appendfsync of redis: always before a
+	// write returns, everysec within a second, or no, left to the os and file close.
+	// With always the reader only acknowledges the synced offset to the master.
+	AofFsync string `mapstructure:"aof_fsync" default:"everysec"`
+	// aof_storage is where the aof stream received is stored: file, rotating segments in
+	// the aof dir, or badger, a badger db in the badger dir of it.
+	AofStorage string `mapstructure:"aof_storage" default:"file"`
+	// aof_storage_max_bytes makes the badger storage hold at most about that many bytes of
+	// live batches, appends wait for batches to be deleted first. 0 means no limit. It
+	// counts the values not deleted yet, not the size on disk: deleted values stay in the
+	// value log until it is garbage collected. The reader deletes batches only through
+	// aof_retention_max_bytes, which must then be set below it.
+	// aof_storage_gc_interval_sec is how often the badger value log is garbage collected.
+	AofStorageMaxBytes      int64 `mapstructure:"aof_storage_max_bytes" default:"0"`
+	AofStorageGcIntervalSec int64 `mapstructure:"aof_storage_gc_interval_sec" default:"60"`
+	// encryption_key_file and encryption_key_env, the name of an environment variable, hold
+	// the master keys that encrypt the rdb and aof data at rest with AES-256-GCM. Keys are
+	// the hex or base64 of 32 bytes, one per line or separated by commas. The first key
+	// encrypts, the others only decrypt: to rotate, put the new key first and keep the old
+	// ones until the data keys are re-wrapped when the aof writers start. Only the dirs an
+	// aof writer opens are re-wrapped, the rdb files and other dirs keep the data keys of
+	// the old key until they are written again. An aof writer does not start when a file
+	// of its dir can not be re-wrapped, files of a key not configured are left alone.
+	// Both empty means no encryption, files encrypted before are still read while their
+	// key is configured.
+	EncryptionKeyFile string `mapstructure:"encryption_key_file" default:""`
+	EncryptionKeyEnv  string `mapstructure:"encryption_key_env" default:""`
 }
 
 type ModuleOptions struct {
@@ -84,13 +187,17 @@ func (opt *AdvancedOptions) GetPSyncCommand(address string) string {
 }
 
 type ShakeOptions struct {
-	Filter   FilterOptions
-	Advanced AdvancedOptions
-	Module   ModuleOptions
+	Filter    FilterOptions
+	Transform TransformOptions
+	Advanced  AdvancedOptions
+	Module    ModuleOptions
 }
 
 var Opt ShakeOptions
 
+// configFile is the file LoadConfig read, ReadFilterOptions reads it again.
+var configFile string
+
 func LoadConfig() *viper.Viper {
 	defaults.SetDefaults(&Opt)
 
@@ -107,15 +214,8 @@ func LoadConfig() *viper.Viper {
 	// load config from file
 	if len(os.Args) == 2 {
 		logger.Info().Msgf("load config from file: %s", os.Args[1])
-		configFile := os.Args[1]
-		file, err := os.ReadFile(configFile)
-		if err != nil {
-			logger.Error().Msgf("failed to read config file: %v", err)
-			os.Exit(1)
-		}
-		fallback := envWithFallback(string(file))
-		v.SetConfigType("toml")
-		err = v.ReadConfig(bytes.NewReader([]byte(fallback)))
+		configFile = os.Args[1]
+		err := readConfigFile(v, configFile)
 		if err != nil {
 			logger.Error().Msgf("failed to read config file: %v", err)
 			os.Exit(1)
@@ -133,6 +233,34 @@ func LoadConfig() *viper.Viper {
 	return v
 }
 
+func readConfigFile(v *viper.Viper, path string) error {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fallback := envWithFallback(string(file))
+	v.SetConfigType("toml")
+	return v.ReadConfig(bytes.NewReader([]byte(fallback)))
+}
+
+// ReadFilterOptions reads the filter section of the config file again, for reloading
+// filters without restarting. Opt is not changed.
+func ReadFilterOptions() (*FilterOptions, error) {
+	if configFile == "" {
+		return nil, fmt.Errorf("config is not loaded from a file")
+	}
+	opt := new(ShakeOptions)
+	defaults.SetDefaults(opt)
+	v := viper.New()
+	if err := readConfigFile(v, configFile); err != nil {
+		return nil, fmt.Errorf("read config file failed: %v", err)
+	}
+	if err := v.Unmarshal(opt); err != nil {
+		return nil, fmt.Errorf("unmarshal config failed: %v", err)
+	}
+	return &opt.Filter, nil
+}
+
 // Custom substitution function that returns as is if the environment variable is empty
 func envWithFallback(input string) string {
 	re := regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*?)}`)
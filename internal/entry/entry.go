@@ -21,6 +21,18 @@ type Entry struct {
 
 	// for stat
 	SerializedSize int64
+
+	// FromRdb marks entries rewritten from the rdb file during full sync
+	FromRdb bool
+
+	// Value info of the key, set on the entries of the rdb phase.
+	// ValueElements and ValueBytes are only measured when big key limits are set,
+	// they are lower bounds once a limit is reached.
+	ValueType     string
+	ValueElements int64
+	ValueBytes    int64
+	// SlowLane asks the writer to send the entry on a separate connection
+	SlowLane bool
 }
 
 func (e *Entry) Reset() {
@@ -33,6 +45,11 @@ func (e *Entry) Reset() {
 	e.KeyIndexes = e.KeyIndexes[:0]
 	e.Slots = e.Slots[:0]
 	e.SerializedSize = 0
+	e.FromRdb = false
+	e.ValueType = ""
+	e.ValueElements = 0
+	e.ValueBytes = 0
+	e.SlowLane = false
 }
 
 func NewEntry() *Entry {
@@ -50,6 +67,11 @@ func (e *Entry) Clone() *Entry {
 	m.CmdName = e.CmdName
 	m.Group = e.Group
 	m.SerializedSize = e.SerializedSize
+	m.FromRdb = e.FromRdb
+	m.ValueType = e.ValueType
+	m.ValueElements = e.ValueElements
+	m.ValueBytes = e.ValueBytes
+	m.SlowLane = e.SlowLane
 
 	m.Argv = make([]string, 0, len(e.Argv))
 	m.Argv = append(m.Argv, e.Argv...)
@@ -89,3 +111,17 @@ func (e *Entry) Parse() {
 	e.CmdName, e.Group, e.Keys, e.KeyIndexes = commands.CalcKeys(e.Argv)
 	e.Slots = commands.CalcSlots(e.Keys)
 }
+
+// RewriteKeys replaces every key of the entry with rename(key), in Argv and Keys,
+// and recomputes Slots. KeyIndexes are 1-based positions in Argv.
+func (e *Entry) RewriteKeys(rename func(key string) string) {
+	if e.CmdName == "" {
+		e.Parse()
+	}
+	for inx, keyIndex := range e.KeyIndexes {
+		newKey := rename(e.Argv[keyIndex-1])
+		e.Argv[keyIndex-1] = newKey
+		e.Keys[inx] = newKey
+	}
+	e.Slots = commands.CalcSlots(e.Keys)
+}
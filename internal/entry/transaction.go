@@ -0,0 +1,143 @@
+package entry
+
+import (
+	"strings"
+
+	"redisFlutter/internal/log"
+)
+
+// TransactionCollector holds back the entries of a MULTI ... EXEC block until the block
+// is complete, so a transaction is never written partially. Entries outside a block
+// pass straight through. The collector keeps the pointers it is given, callers that
+// reuse one Entry object must Clone before Push.
+type TransactionCollector struct {
+	block []*Entry
+}
+
+func NewTransactionCollector() *TransactionCollector {
+	return &TransactionCollector{
+		block: make([]*Entry, 0, 16),
+	}
+}
+
+// Push returns the entries that are ready to be written. Inside a block nothing is
+// ready until EXEC arrives, then the whole block (MULTI and EXEC included) is returned.
+// DISCARD drops the block, the dropped entries are returned as discarded.
+func (c *TransactionCollector) Push(e *Entry) (ready []*Entry, discarded []*Entry) {
+	cmd := ""
+	if len(e.Argv) > 0 {
+		cmd = e.Argv[0]
+	}
+	if len(c.block) == 0 {
+		if strings.EqualFold(cmd, "multi") {
+			c.block = append(c.block, e)
+			return nil, nil
+		}
+		return []*Entry{e}, nil
+	}
+	c.block = append(c.block, e)
+	if strings.EqualFold(cmd, "exec") {
+		ready = c.block
+		c.block = make([]*Entry, 0, 16)
+		return ready, nil
+	}
+	if strings.EqualFold(cmd, "discard") {
+		discarded = c.block
+		c.block = make([]*Entry, 0, 16)
+		return nil, discarded
+	}
+	return nil, nil
+}
+
+// InTransaction reports whether a MULTI has been seen without its EXEC/DISCARD.
+func (c *TransactionCollector) InTransaction() bool {
+	return len(c.block) > 0
+}
+
+// Reset drops an incomplete block, for example when the source stream is reconnected
+// and the rest of the block will never arrive. The dropped entries are returned.
+func (c *TransactionCollector) Reset() []*Entry {
+	dropped := c.block
+	c.block = make([]*Entry, 0, 16)
+	return dropped
+}
+
+// IsTransactionBlock reports whether entries is a MULTI ... EXEC block returned by Push.
+func IsTransactionBlock(entries []*Entry) bool {
+	return len(entries) >= 2 && len(entries[0].Argv) > 0 && strings.EqualFold(entries[0].Argv[0], "multi")
+}
+
+// SplitTransactionBySlot splits a MULTI ... EXEC block for cluster targets, where a
+// transaction can not span slots. The order of the commands is kept: a new block starts
+// when a command is on another slot than the keyed command before it, keyless commands
+// stay in the block they are in. The blocks are atomic each, but the transaction as a
+// whole is not any more. A command whose own keys span slots fails in any block, it is
+// returned as rejected instead.
+func SplitTransactionBySlot(block []*Entry) (blocks [][]*Entry, rejected []*Entry) {
+	if !IsTransactionBlock(block) {
+		return [][]*Entry{block}, nil
+	}
+	multi := block[0]
+	exec := block[len(block)-1]
+	var commands [][]*Entry
+	var current []*Entry
+	slot := -1
+	for _, e := range block[1 : len(block)-1] {
+		if e.CmdName == "" {
+			e.Parse()
+		}
+		if len(e.Slots) > 0 {
+			if spansSlots(e) {
+				log.Warnf("command in transaction spans slots, dropped. cmd=[%s]", e.String())
+				rejected = append(rejected, e)
+				continue
+			}
+			if slot >= 0 && e.Slots[0] != slot {
+				commands = append(commands, current)
+				current = nil
+			}
+			slot = e.Slots[0]
+		}
+		current = append(current, e)
+	}
+	commands = append(commands, current)
+	if len(commands) == 1 && len(rejected) == 0 {
+		return [][]*Entry{block}, nil
+	}
+	if len(commands) > 1 {
+		log.Warnf("transaction spans slots, split into %d blocks and atomicity is lost. multi=[%s]", len(commands), multi.String())
+	}
+	blocks = make([][]*Entry, 0, len(commands))
+	for inx, sub := range commands {
+		begin, end := multi, exec
+		if inx > 0 {
+			begin = newTransactionEntry(multi, "multi")
+		}
+		if inx < len(commands)-1 {
+			end = newTransactionEntry(exec, "exec")
+		}
+		wrapped := make([]*Entry, 0, len(sub)+2)
+		wrapped = append(wrapped, begin)
+		wrapped = append(wrapped, sub...)
+		wrapped = append(wrapped, end)
+		blocks = append(blocks, wrapped)
+	}
+	return blocks, rejected
+}
+
+func spansSlots(e *Entry) bool {
+	for _, slot := range e.Slots[1:] {
+		if slot != e.Slots[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func newTransactionEntry(from *Entry, cmd string) *Entry {
+	e := NewEntry()
+	e.DbId = from.DbId
+	e.Argv = append(e.Argv, cmd)
+	e.Parse()
+	return e
+}
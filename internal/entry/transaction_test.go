@@ -0,0 +1,90 @@
+package entry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEntry(argv ...string) *Entry {
+	e := NewEntry()
+	e.Argv = append(e.Argv, argv...)
+	return e
+}
+
+func Test_TransactionCollector(t *testing.T) {
+	c := NewTransactionCollector()
+
+	ready, discarded := c.Push(newTestEntry("set", "a", "1"))
+	assert.Equal(t, 1, len(ready))
+	assert.Nil(t, discarded)
+
+	ready, _ = c.Push(newTestEntry("MULTI"))
+	assert.Nil(t, ready)
+	ready, _ = c.Push(newTestEntry("set", "a", "2"))
+	assert.Nil(t, ready)
+	assert.True(t, c.InTransaction())
+	ready, _ = c.Push(newTestEntry("EXEC"))
+	assert.Equal(t, 3, len(ready))
+	assert.True(t, IsTransactionBlock(ready))
+	assert.False(t, c.InTransaction())
+
+	c.Push(newTestEntry("multi"))
+	c.Push(newTestEntry("set", "a", "3"))
+	ready, discarded = c.Push(newTestEntry("discard"))
+	assert.Nil(t, ready)
+	assert.Equal(t, 3, len(discarded))
+
+	c.Push(newTestEntry("multi"))
+	c.Push(newTestEntry("set", "a", "4"))
+	assert.Equal(t, 2, len(c.Reset()))
+	assert.False(t, c.InTransaction())
+}
+
+func Test_SplitTransactionBySlot(t *testing.T) {
+	block := []*Entry{
+		newTestEntry("multi"),
+		newTestEntry("ping"),
+		newTestEntry("set", "{a}1", "1"),
+		newTestEntry("set", "{b}1", "1"),
+		newTestEntry("ping"),
+		newTestEntry("set", "{a}2", "1"),
+		newTestEntry("exec"),
+	}
+	blocks, rejected := SplitTransactionBySlot(block)
+	assert.Empty(t, rejected)
+	// the order is kept, a block starts when the slot changes
+	var order []string
+	for _, sub := range blocks {
+		assert.True(t, IsTransactionBlock(sub))
+		assert.Equal(t, "exec", sub[len(sub)-1].Argv[0])
+		for _, e := range sub[1 : len(sub)-1] {
+			order = append(order, e.String())
+		}
+	}
+	assert.Equal(t, 3, len(blocks))
+	assert.Equal(t, []string{"ping", "set {a}1 1", "set {b}1 1", "ping", "set {a}2 1"}, order)
+	assert.Equal(t, block[0], blocks[0][0])
+	assert.Equal(t, block[len(block)-1], blocks[2][len(blocks[2])-1])
+
+	sameSlot := []*Entry{
+		newTestEntry("multi"),
+		newTestEntry("set", "{a}1", "1"),
+		newTestEntry("incr", "{a}2"),
+		newTestEntry("exec"),
+	}
+	blocks, rejected = SplitTransactionBySlot(sameSlot)
+	assert.Equal(t, [][]*Entry{sameSlot}, blocks)
+	assert.Empty(t, rejected)
+
+	// a command spanning slots itself can not be sent
+	crossSlot := []*Entry{
+		newTestEntry("multi"),
+		newTestEntry("mset", "a", "1", "b", "1"),
+		newTestEntry("set", "{a}1", "1"),
+		newTestEntry("exec"),
+	}
+	blocks, rejected = SplitTransactionBySlot(crossSlot)
+	assert.Equal(t, []*Entry{crossSlot[1]}, rejected)
+	assert.Equal(t, [][]*Entry{{crossSlot[0], crossSlot[2], crossSlot[3]}}, blocks)
+}
@@ -1,196 +1,294 @@
 package filter
 
 import (
-	"redisFlutter/internal/config"
-	"redisFlutter/internal/entry"
-	"redisFlutter/internal/log"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+	"redisFlutter/internal/status"
 )
 
-// Filter returns:
-// - true if the entry should be processed
-// - false if it should be filtered out
-func Filter(e *entry.Entry) bool {
-	keyResults := make([]bool, len(e.Keys))
-	for i := range keyResults {
-		keyResults[i] = true
-	}
+const (
+	ruleDefault      = "default"
+	ruleSplit        = "split"
+	ruleInconsistent = "inconsistent_keys"
+	ruleAllowKeyMiss = "allow_key:no_match"
+	ruleBigKeyPrefix = "big_key:"
+)
 
-	for inx, key := range e.Keys {
-		// Check if the key matches any of the blocked patterns
-		if blockKeyFilter(key) {
-			keyResults[inx] = false
-			continue
-		}
-		if !allowKeyFilter(key) {
-			keyResults[inx] = false
+// Engine decides which entries are synced. It is built once from FilterOptions,
+// so several engines with different rules can live in one process.
+type Engine struct {
+	allowKeys *keyMatcher
+	blockKeys *keyMatcher
+	sampler   *sampler
+
+	allowDB           map[int]struct{}
+	blockDB           map[int]struct{}
+	allowCommand      map[string]struct{}
+	blockCommand      map[string]struct{}
+	allowCommandGroup map[string]struct{}
+	blockCommandGroup map[string]struct{}
+
+	bigKeyRules  []bigKeyRule
+	bigKeyAction string
+	bigKeyReport *bigKeyReport
+
+	hits sync.Map // rule name -> *atomic.Int64
+
+	splitLock  sync.Mutex
+	splitStats map[string]*splitCounter
+}
+
+// Explanation tells which rule accepted or rejected an entry.
+type Explanation struct {
+	Accepted bool   `json:"accepted"`
+	Rule     string `json:"rule"`
+	// KeyRules is the rule matched by each key, empty when there are no key rules
+	KeyRules []string `json:"key_rules,omitempty"`
+	// BigKey is the big key rule of an accepted entry that goes to the slow lane
+	BigKey string `json:"big_key,omitempty"`
+}
+
+func NewEngine(opts *config.FilterOptions) (*Engine, error) {
+	var err error
+	f := &Engine{
+		allowDB:           toSet(opts.AllowDB),
+		blockDB:           toSet(opts.BlockDB),
+		allowCommand:      toSet(opts.AllowCommand),
+		blockCommand:      toSet(opts.BlockCommand),
+		allowCommandGroup: toSet(opts.AllowCommandGroup),
+		blockCommandGroup: toSet(opts.BlockCommandGroup),
+		splitStats:        make(map[string]*splitCounter),
+	}
+	f.allowKeys, err = newKeyMatcher("allow", opts.AllowKeys, opts.AllowKeyPrefix, opts.AllowKeySuffix, opts.AllowKeyRegex, opts.AllowKeyGlob)
+	if err != nil {
+		return nil, err
+	}
+	f.blockKeys, err = newKeyMatcher("block", opts.BlockKeys, opts.BlockKeyPrefix, opts.BlockKeySuffix, opts.BlockKeyRegex, opts.BlockKeyGlob)
+	if err != nil {
+		return nil, err
+	}
+	f.sampler, err = newSampler(opts.SampleRatio, opts.SampleSeed)
+	if err != nil {
+		return nil, err
+	}
+	for _, text := range opts.BigKeyRules {
+		rule, err := parseBigKeyRule(text)
+		if err != nil {
+			return nil, err
 		}
+		f.bigKeyRules = append(f.bigKeyRules, rule)
+	}
+	switch opts.BigKeyAction {
+	case "", BigKeyActionSkip:
+		f.bigKeyAction = BigKeyActionSkip
+	case BigKeyActionSlowLane:
+		f.bigKeyAction = BigKeyActionSlowLane
+	default:
+		return nil, fmt.Errorf("big_key_action [%s] should be %s or %s", opts.BigKeyAction, BigKeyActionSkip, BigKeyActionSlowLane)
+	}
+	if opts.BigKeyReportFile != "" {
+		f.bigKeyReport = &bigKeyReport{path: opts.BigKeyReportFile}
 	}
+	return f, nil
+}
 
-	allTrue := true
-	allFalse := true
-	var passedKeys, filteredKeys []string
-	for i, result := range keyResults {
-		if result {
-			allFalse = false
-			passedKeys = append(passedKeys, e.Keys[i])
-		} else {
-			allTrue = false
-			filteredKeys = append(filteredKeys, e.Keys[i])
+func toSet[T comparable](items []T) map[T]struct{} {
+	set := make(map[T]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+// Filter returns:
+// - true if the entry should be processed
+// - false if it should be filtered out
+//
+// Multi-key commands such as MSET and DEL with only some keys allowed are
+// rewritten in place to the allowed keys.
+func (f *Engine) Filter(e *entry.Entry) bool {
+	ex, keyResults := f.explain(e)
+	for _, rule := range ex.KeyRules {
+		if rule != "" {
+			f.hit(rule)
 		}
 	}
-	if allTrue {
-		// All keys are allowed, continue checking
-	} else if allFalse {
-		return false
-	} else {
-		// If we reach here, it means some keys are true and some are false
+	if ex.BigKey != "" {
+		f.hit(ex.BigKey)
+	} else if !slices.Contains(ex.KeyRules, ex.Rule) {
+		f.hit(ex.Rule)
+	}
+	switch {
+	case ex.Rule == ruleInconsistent:
+		f.countSplit(e.CmdName, func(c *splitCounter) { c.Rejected++ })
+		var passedKeys, filteredKeys []string
+		for i, result := range keyResults {
+			if result {
+				passedKeys = append(passedKeys, e.Keys[i])
+			} else {
+				filteredKeys = append(filteredKeys, e.Keys[i])
+			}
+		}
 		log.Infof("Error: Inconsistent filter results for entry with %d keys", len(e.Keys))
 		log.Infof("Passed keys: %v", passedKeys)
 		log.Infof("Filtered keys: %v", filteredKeys)
-		return false
+	case ex.Accepted && ex.Rule == ruleSplit:
+		f.splitEntry(e, keyResults)
+	case strings.HasPrefix(ex.Rule, ruleBigKeyPrefix):
+		f.bigKeyReport.write(e, ex.Rule, f.bigKeyAction)
+	}
+	// after a split, the keys kept go to the slow lane
+	if ex.BigKey != "" {
+		f.bigKeyReport.write(e, ex.BigKey, f.bigKeyAction)
+		e.SlowLane = true
 	}
+	return ex.Accepted
+}
 
-	// Check if the database matches any of the allowed databases
-	if len(config.Opt.Filter.AllowDB) > 0 {
-		if !slices.Contains(config.Opt.Filter.AllowDB, e.DbId) {
-			return false
-		}
+// Explain tells whether e would be accepted and by which rule, without counting hits
+// or changing e. An entry not parsed yet is parsed as a copy.
+func (f *Engine) Explain(e *entry.Entry) Explanation {
+	if e.CmdName == "" {
+		e = e.Clone()
 	}
-	// Check if the database matches any of the blocked databases
-	if len(config.Opt.Filter.BlockDB) > 0 {
-		if slices.Contains(config.Opt.Filter.BlockDB, e.DbId) {
-			return false
-		}
+	ex, _ := f.explain(e)
+	return ex
+}
+
+func (f *Engine) explain(e *entry.Entry) (Explanation, []bool) {
+	if e.CmdName == "" {
+		e.Parse()
 	}
+	ex := Explanation{Accepted: true, Rule: ruleDefault}
 
-	// Check if the command matches any of the allowed commands
-	if len(config.Opt.Filter.AllowCommand) > 0 {
-		if !slices.Contains(config.Opt.Filter.AllowCommand, e.CmdName) {
-			return false
+	keyResults := make([]bool, len(e.Keys))
+	if !f.allowKeys.empty || !f.blockKeys.empty || f.sampler != nil {
+		ex.KeyRules = make([]string, len(e.Keys))
+	}
+	passed := 0
+	for inx, key := range e.Keys {
+		var rule string
+		keyResults[inx], rule = f.matchKey(key)
+		if ex.KeyRules != nil {
+			ex.KeyRules[inx] = rule
 		}
+		if keyResults[inx] {
+			passed++
+		}
+	}
+	if passed == 0 && len(e.Keys) > 0 {
+		return Explanation{Rule: ex.KeyRules[0], KeyRules: ex.KeyRules}, keyResults
 	}
-	// Check if the command matches any of the blocked commands
-	if len(config.Opt.Filter.BlockCommand) > 0 {
-		if slices.Contains(config.Opt.Filter.BlockCommand, e.CmdName) {
-			return false
+	if passed < len(e.Keys) {
+		if !canSplit(e) {
+			return Explanation{Rule: ruleInconsistent, KeyRules: ex.KeyRules}, keyResults
 		}
+		ex.Rule = ruleSplit
 	}
 
-	// Check if the command group matches any of the allowed command groups
-	if len(config.Opt.Filter.AllowCommandGroup) > 0 {
-		if !slices.Contains(config.Opt.Filter.AllowCommandGroup, e.Group) {
-			return false
+	reject := func(rule string) (Explanation, []bool) {
+		return Explanation{Rule: rule, KeyRules: ex.KeyRules}, keyResults
+	}
+	if rule, ok := f.matchBigKey(e); ok {
+		if f.bigKeyAction == BigKeyActionSkip {
+			return reject(rule)
 		}
+		ex.BigKey = rule
 	}
-	// Check if the command group matches any of the blocked command groups
-	if len(config.Opt.Filter.BlockCommandGroup) > 0 {
-		if slices.Contains(config.Opt.Filter.BlockCommandGroup, e.Group) {
-			return false
+	if len(f.allowDB) > 0 {
+		if _, ok := f.allowDB[e.DbId]; !ok {
+			return reject("allow_db:no_match")
 		}
 	}
-
-	return true
-}
-
-// blockKeyFilter is block key? default false
-func blockKeyFilter(key string) bool {
-	if len(config.Opt.Filter.BlockKeyRegex) == 0 &&
-		len(config.Opt.Filter.BlockKeyPrefix) == 0 &&
-		len(config.Opt.Filter.BlockKeySuffix) == 0 &&
-		len(config.Opt.Filter.BlockKeys) == 0 {
-		return false
+	if _, ok := f.blockDB[e.DbId]; ok {
+		return reject("block_db:" + strconv.Itoa(e.DbId))
 	}
-	if slices.Contains(config.Opt.Filter.BlockKeys, key) {
-		return true
+	if len(f.allowCommand) > 0 {
+		if _, ok := f.allowCommand[e.CmdName]; !ok {
+			return reject("allow_command:no_match")
+		}
 	}
-	if blockKeyMatch(config.Opt.Filter.BlockKeyRegex, key) {
-		return true
+	if _, ok := f.blockCommand[e.CmdName]; ok {
+		return reject("block_command:" + e.CmdName)
 	}
-	for _, prefix := range config.Opt.Filter.BlockKeyPrefix {
-		if strings.HasPrefix(key, prefix) {
-			return true
+	if len(f.allowCommandGroup) > 0 {
+		if _, ok := f.allowCommandGroup[e.Group]; !ok {
+			return reject("allow_command_group:no_match")
 		}
 	}
-	for _, suffix := range config.Opt.Filter.BlockKeySuffix {
-		if strings.HasSuffix(key, suffix) {
-			return true
-		}
+	if _, ok := f.blockCommandGroup[e.Group]; ok {
+		return reject("block_command_group:" + e.Group)
 	}
-
-	return false
+	return ex, keyResults
 }
 
-// allowKeyFilter is allow key? default true
-func allowKeyFilter(key string) bool {
-	if len(config.Opt.Filter.AllowKeyRegex) == 0 &&
-		len(config.Opt.Filter.AllowKeyPrefix) == 0 &&
-		len(config.Opt.Filter.AllowKeySuffix) == 0 &&
-		len(config.Opt.Filter.AllowKeys) == 0 {
-		return true
+// matchKey checks block rules first, then allow rules, then the sample,
+// and returns the matched rule.
+func (f *Engine) matchKey(key string) (bool, string) {
+	if rule, ok := f.blockKeys.match(key); ok {
+		return false, rule
 	}
-
-	if slices.Contains(config.Opt.Filter.AllowKeys, key) {
-		return true
-	}
-	// If the RE matches, there is no need to iterate over the others
-	if allowKeyMatch(config.Opt.Filter.AllowKeyRegex, key) {
-		return true
-	}
-
-	for _, prefix := range config.Opt.Filter.AllowKeyPrefix {
-		if strings.HasPrefix(key, prefix) {
-			return true
+	rule := ""
+	if !f.allowKeys.empty {
+		var ok bool
+		if rule, ok = f.allowKeys.match(key); !ok {
+			return false, ruleAllowKeyMiss
 		}
 	}
-	for _, suffix := range config.Opt.Filter.AllowKeySuffix {
-		if strings.HasSuffix(key, suffix) {
-			return true
-		}
+	if f.sampler != nil && !f.sampler.keep(key) {
+		return false, f.sampler.rule
 	}
-	return false
+	return true, rule
 }
 
-var (
-	blockListOnce        sync.Once
-	blockListKeyPatterns *KeysPattern
-)
+func (f *Engine) hit(rule string) {
+	counter, ok := f.hits.Load(rule)
+	if !ok {
+		counter, _ = f.hits.LoadOrStore(rule, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(1)
+}
 
-// blockKeyMatch
-func blockKeyMatch(regList []string, key string) bool {
-	blockListOnce.Do(func() {
-		var err error
-		blockListKeyPatterns, err = NewKeysPattern(regList)
-		if err != nil {
-			log.Panicf("%s,conf.Options.BlockKeyRegex[%+v]", err, regList)
-		}
+// Hits returns how many times each rule accepted or rejected an entry or a key.
+func (f *Engine) Hits() map[string]int64 {
+	ret := make(map[string]int64)
+	f.hits.Range(func(rule, counter any) bool {
+		ret[rule.(string)] = counter.(*atomic.Int64).Load()
+		return true
 	})
+	return ret
+}
 
-	return blockListKeyPatterns.MatchKey(key)
+type engineStat struct {
+	Hits  map[string]int64        `json:"hits"`
+	Split map[string]splitCounter `json:"split"`
 }
 
-var (
-	allowOnce            sync.Once
-	allowListKeyPatterns *KeysPattern
-)
+func (f *Engine) Status() interface{} {
+	return engineStat{Hits: f.Hits(), Split: f.SplitStatus()}
+}
 
-// allowKeyMatch
-func allowKeyMatch(regList []string, key string) bool {
-	if len(regList) == 1 {
-		first := regList[0]
-		if first == "*" || first == ".*" || first == "^.*$" {
-			return true
-		}
-	}
-	allowOnce.Do(func() {
-		var err error
-		allowListKeyPatterns, err = NewKeysPattern(regList)
-		if err != nil {
-			log.Panicf("%s,conf.Options.AllowKeyRegex[%+v]", err, regList)
-		}
-	})
+func init() {
+	status.RegisterHandler("/filter", statusHandler)
+}
+
+// Filter runs the default engine, see Engine.Filter.
+func Filter(e *entry.Entry) bool {
+	return Default().Filter(e)
+}
 
-	return allowListKeyPatterns.MatchKey(key)
+func statusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	jsonBytes, _ := json.Marshal(Default().Status())
+	_, _ = w.Write(jsonBytes)
 }
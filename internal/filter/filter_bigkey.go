@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+)
+
+const (
+	BigKeyActionSkip     = "skip"
+	BigKeyActionSlowLane = "slow_lane"
+)
+
+var bigKeyTypes = []string{"*", "string", "list", "set", "zset", "hash", "stream", "module"}
+
+// bigKeyRule matches keys of the rdb phase whose elements or bytes reach a threshold.
+type bigKeyRule struct {
+	text      string
+	valueType string // "*" for any type
+	elements  bool   // compare ValueElements, else ValueBytes
+	threshold int64
+}
+
+// parseBigKeyRule parses "<type>:<elements|bytes>:<threshold>", for example "hash:elements:500000".
+func parseBigKeyRule(text string) (bigKeyRule, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 3 {
+		return bigKeyRule{}, fmt.Errorf("big_key_rules [%s] should be like \"hash:elements:500000\"", text)
+	}
+	rule := bigKeyRule{text: text, valueType: strings.ToLower(parts[0])}
+	if !slices.Contains(bigKeyTypes, rule.valueType) {
+		return bigKeyRule{}, fmt.Errorf("big_key_rules [%s] has unknown type, should be one of %v", text, bigKeyTypes)
+	}
+	switch strings.ToLower(parts[1]) {
+	case "elements":
+		rule.elements = true
+	case "bytes":
+	default:
+		return bigKeyRule{}, fmt.Errorf("big_key_rules [%s] should compare elements or bytes", text)
+	}
+	threshold, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || threshold <= 0 {
+		return bigKeyRule{}, fmt.Errorf("big_key_rules [%s] has invalid threshold", text)
+	}
+	rule.threshold = threshold
+	return rule, nil
+}
+
+func (r *bigKeyRule) match(e *entry.Entry) bool {
+	if r.valueType != "*" && r.valueType != e.ValueType {
+		return false
+	}
+	if r.elements {
+		return e.ValueElements >= r.threshold
+	}
+	return e.ValueBytes >= r.threshold
+}
+
+// bigKeyReport writes one line for every big key to a file.
+type bigKeyReport struct {
+	path string
+
+	lock    sync.Mutex
+	file    *os.File
+	closed  bool
+	lastDb  int
+	lastKey string
+}
+
+func (r *bigKeyReport) write(e *entry.Entry, rule string, action string) {
+	if r == nil || len(e.Keys) == 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// all entries of a key come one after another in the rdb phase
+	if r.lastKey == e.Keys[0] && r.lastDb == e.DbId {
+		return
+	}
+	r.lastDb, r.lastKey = e.DbId, e.Keys[0]
+	if r.file == nil {
+		var err error
+		r.file, err = os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Panicf("open big key report file failed. file=[%s], err=[%v]", r.path, err)
+		}
+	}
+	line := fmt.Sprintf("db=%d key=%q type=%s elements=%d bytes=%d rule=%s action=%s\n",
+		e.DbId, e.Keys[0], e.ValueType, e.ValueElements, e.ValueBytes, rule, action)
+	if _, err := r.file.WriteString(line); err != nil {
+		log.Warnf("write big key report failed. file=[%s], err=[%v]", r.path, err)
+	}
+	// an entry of the old rules may still write after a reload replaced them
+	if r.closed {
+		r.closeFile()
+	}
+}
+
+// close closes the file once the engine is replaced.
+func (r *bigKeyReport) close() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	r.closeFile()
+}
+
+func (r *bigKeyReport) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Warnf("close big key report failed. file=[%s], err=[%v]", r.path, err)
+	}
+	r.file = nil
+}
+
+// matchBigKey returns the big key rule matched by an entry of the rdb phase.
+func (f *Engine) matchBigKey(e *entry.Entry) (string, bool) {
+	if !e.FromRdb || e.ValueType == "" {
+		return "", false
+	}
+	for i := range f.bigKeyRules {
+		if f.bigKeyRules[i].match(e) {
+			return ruleBigKeyPrefix + f.bigKeyRules[i].text, true
+		}
+	}
+	return "", false
+}
+
+// BigKeyLimits returns how far the rdb loader measures a key of valueType, the largest
+// element and byte thresholds of the rules of the type and of "*". Every rule then
+// sees the measure it compares reach its threshold. 0 means no rule uses the measure.
+func (f *Engine) BigKeyLimits(valueType string) (maxElements int64, maxBytes int64) {
+	for _, rule := range f.bigKeyRules {
+		if rule.valueType != "*" && rule.valueType != valueType {
+			continue
+		}
+		if rule.elements {
+			maxElements = max(maxElements, rule.threshold)
+		} else {
+			maxBytes = max(maxBytes, rule.threshold)
+		}
+	}
+	return
+}
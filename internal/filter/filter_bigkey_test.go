@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+)
+
+func newRdbEntry(valueType string, elements int64, bytes int64, argv ...string) *entry.Entry {
+	e := newTestEntry(argv...)
+	e.FromRdb = true
+	e.ValueType = valueType
+	e.ValueElements = elements
+	e.ValueBytes = bytes
+	return e
+}
+
+func Test_parseBigKeyRule(t *testing.T) {
+	rule, err := parseBigKeyRule("hash:elements:500000")
+	assert.Nil(t, err)
+	assert.Equal(t, bigKeyRule{text: "hash:elements:500000", valueType: "hash", elements: true, threshold: 500000}, rule)
+	for _, text := range []string{"hash:500000", "map:elements:1", "hash:fields:1", "hash:elements:0", "hash:bytes:x"} {
+		_, err = parseBigKeyRule(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func Test_Engine_bigKey(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "big_keys.txt")
+	f := newTestEngine(t, config.FilterOptions{
+		BigKeyRules:      []string{"hash:elements:500000", "*:bytes:52428800"},
+		BigKeyReportFile: report,
+	})
+	maxElements, maxBytes := f.BigKeyLimits("hash")
+	assert.Equal(t, int64(500000), maxElements)
+	assert.Equal(t, int64(52428800), maxBytes)
+	maxElements, maxBytes = f.BigKeyLimits("list")
+	assert.Equal(t, int64(0), maxElements)
+	assert.Equal(t, int64(52428800), maxBytes)
+
+	assert.True(t, f.Filter(newRdbEntry("hash", 10, 100, "hset", "h", "f", "v")))
+	assert.True(t, f.Filter(newRdbEntry("set", 600000, 100, "sadd", "s", "m")))
+	assert.False(t, f.Filter(newRdbEntry("hash", 500000, 100, "del", "big")))
+	assert.False(t, f.Filter(newRdbEntry("hash", 500000, 100, "hset", "big", "f", "v")))
+	assert.False(t, f.Filter(newRdbEntry("string", 1, 60<<20, "set", "blob", "v")))
+	// the aof phase is not measured
+	assert.True(t, f.Filter(newTestEntry("hset", "big", "f", "v")))
+
+	content, err := os.ReadFile(report)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, []string{
+		`db=0 key="big" type=hash elements=500000 bytes=100 rule=big_key:hash:elements:500000 action=skip`,
+		`db=0 key="blob" type=string elements=1 bytes=62914560 rule=big_key:*:bytes:52428800 action=skip`,
+	}, lines)
+}
+
+func Test_Engine_bigKeySlowLane(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{
+		BigKeyRules:  []string{"list:elements:3"},
+		BigKeyAction: BigKeyActionSlowLane,
+		BlockDB:      []int{1},
+	})
+	e := newRdbEntry("list", 3, 10, "rpush", "l", "a", "b", "c")
+	assert.True(t, f.Filter(e))
+	assert.True(t, e.SlowLane)
+
+	e = newRdbEntry("list", 2, 10, "rpush", "l2", "a", "b")
+	assert.True(t, f.Filter(e))
+	assert.False(t, e.SlowLane)
+
+	e = newRdbEntry("list", 3, 10, "rpush", "l", "a", "b", "c")
+	e.DbId = 1
+	assert.False(t, f.Filter(e))
+	assert.Equal(t, int64(1), f.Hits()["big_key:list:elements:3"])
+
+	// a split entry keeps the split, the keys kept go to the slow lane
+	f = newTestEngine(t, config.FilterOptions{
+		BigKeyRules:    []string{"*:bytes:1"},
+		BigKeyAction:   BigKeyActionSlowLane,
+		BlockKeyPrefix: []string{"tmp:"},
+	})
+	e = newRdbEntry("string", 1, 10, "del", "a", "tmp:b", "c")
+	assert.Equal(t, Explanation{Accepted: true, Rule: ruleSplit, KeyRules: []string{"", "block_key_prefix:tmp:", ""}, BigKey: "big_key:*:bytes:1"}, f.Explain(e))
+	assert.True(t, f.Filter(e))
+	assert.Equal(t, []string{"del", "a", "c"}, e.Argv)
+	assert.True(t, e.SlowLane)
+
+	_, err := NewEngine(&config.FilterOptions{BigKeyAction: "divert"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,164 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// trie finds whether a key starts with any of the inserted prefixes.
+// Suffixes are inserted and matched reversed.
+type trie struct {
+	children map[byte]*trie
+	pattern  string // not empty when a prefix ends here
+}
+
+func newTrie() *trie {
+	return &trie{children: make(map[byte]*trie)}
+}
+
+func (t *trie) insert(word string, pattern string) {
+	node := t
+	for i := 0; i < len(word); i++ {
+		child, ok := node.children[word[i]]
+		if !ok {
+			child = newTrie()
+			node.children[word[i]] = child
+		}
+		node = child
+	}
+	node.pattern = pattern
+}
+
+// matchPrefix returns the shortest inserted prefix of key.
+func (t *trie) matchPrefix(key string) (string, bool) {
+	node := t
+	for i := 0; ; i++ {
+		if node.pattern != "" {
+			return node.pattern, true
+		}
+		if i == len(key) {
+			return "", false
+		}
+		child, ok := node.children[key[i]]
+		if !ok {
+			return "", false
+		}
+		node = child
+	}
+}
+
+// matchSuffix returns the shortest inserted suffix of key, suffixes are inserted reversed.
+func (t *trie) matchSuffix(key string) (string, bool) {
+	node := t
+	for i := len(key) - 1; ; i-- {
+		if node.pattern != "" {
+			return node.pattern, true
+		}
+		if i < 0 {
+			return "", false
+		}
+		child, ok := node.children[key[i]]
+		if !ok {
+			return "", false
+		}
+		node = child
+	}
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// keyMatcher is the compiled form of one side (allow or block) of the key rules.
+type keyMatcher struct {
+	side     string // "allow" or "block"
+	exact    map[string]struct{}
+	prefixes *trie
+	suffixes *trie
+	regexes  []*regexp.Regexp
+	globs    []*glob
+	matchAll bool // allow_key_regex is only "*" or ".*"
+
+	empty bool
+}
+
+func newKeyMatcher(side string, keys, prefixes, suffixes, regexes, globs []string) (*keyMatcher, error) {
+	m := &keyMatcher{
+		side:     side,
+		exact:    make(map[string]struct{}),
+		prefixes: newTrie(),
+		suffixes: newTrie(),
+	}
+	m.empty = len(keys) == 0 && len(prefixes) == 0 && len(suffixes) == 0 && len(regexes) == 0 && len(globs) == 0
+	for _, key := range keys {
+		m.exact[key] = struct{}{}
+	}
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			m.matchAll = true
+			continue
+		}
+		m.prefixes.insert(prefix, prefix)
+	}
+	for _, suffix := range suffixes {
+		if suffix == "" {
+			m.matchAll = true
+			continue
+		}
+		m.suffixes.insert(reverse(suffix), suffix)
+	}
+	if len(regexes) == 1 {
+		first := regexes[0]
+		if first == "*" || first == ".*" || first == "^.*$" {
+			m.matchAll = true
+			regexes = nil
+		}
+	}
+	for _, expr := range regexes {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s_key_regex [%s] compile failed: %v", side, expr, err)
+		}
+		m.regexes = append(m.regexes, reg)
+	}
+	for _, pattern := range globs {
+		m.globs = append(m.globs, compileGlob(pattern))
+	}
+	return m, nil
+}
+
+// match returns the rule that matches key, in the form "<side>_key_prefix:<prefix>".
+func (m *keyMatcher) match(key string) (string, bool) {
+	if m.matchAll {
+		return m.side + "_key:*", true
+	}
+	if _, ok := m.exact[key]; ok {
+		return m.side + "_keys", true
+	}
+	if prefix, ok := m.prefixes.matchPrefix(key); ok {
+		return m.side + "_key_prefix:" + prefix, true
+	}
+	if suffix, ok := m.suffixes.matchSuffix(key); ok {
+		return m.side + "_key_suffix:" + suffix, true
+	}
+	for _, reg := range m.regexes {
+		if reg.MatchString(key) {
+			return m.side + "_key_regex:" + reg.String(), true
+		}
+	}
+	for _, g := range m.globs {
+		if g.match(key) {
+			return m.side + "_key_glob:" + g.pattern, true
+		}
+	}
+	return "", false
+}
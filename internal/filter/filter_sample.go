@@ -0,0 +1,37 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+
+	"redisFlutter/internal/commands"
+	"redisFlutter/internal/utils"
+)
+
+// sampler keeps a stable fraction of the keyspace. A key is kept when the crc16 of
+// seed+hashtag is below the limit, the same key gives the same answer in every phase
+// and every process.
+type sampler struct {
+	limit uint32 // keep hash < limit, out of 65536
+	seed  string
+	rule  string
+}
+
+// newSampler returns nil when the ratio keeps all keys.
+func newSampler(ratio float64, seed string) (*sampler, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample_ratio [%v] should be between 0 and 1", ratio)
+	}
+	if ratio == 0 || ratio == 1 {
+		return nil, nil
+	}
+	return &sampler{
+		limit: uint32(ratio * 65536),
+		seed:  seed,
+		rule:  "sample:" + strconv.FormatFloat(ratio, 'f', -1, 64),
+	}, nil
+}
+
+func (s *sampler) keep(key string) bool {
+	return uint32(utils.Crc16(s.seed+commands.KeyHashTag(key))) < s.limit
+}
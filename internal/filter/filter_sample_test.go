@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func Test_sampler(t *testing.T) {
+	s, err := newSampler(0.1, "")
+	assert.Nil(t, err)
+	kept := 0
+	for i := 0; i < 100000; i++ {
+		if s.keep("key:" + strconv.Itoa(i)) {
+			kept++
+		}
+	}
+	assert.InDelta(t, 10000, kept, 1000)
+
+	// stable, and keys of one hashtag are kept together
+	for i := 0; i < 100; i++ {
+		key := "user:" + strconv.Itoa(i)
+		assert.Equal(t, s.keep(key), s.keep(key))
+		assert.Equal(t, s.keep("{"+key+"}:a"), s.keep("{"+key+"}:b"))
+	}
+
+	// another seed picks another sample
+	other, _ := newSampler(0.1, "canary2")
+	same := 0
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if s.keep(key) == other.keep(key) {
+			same++
+		}
+	}
+	assert.Less(t, same, 1000)
+
+	s, err = newSampler(1, "")
+	assert.Nil(t, s)
+	assert.Nil(t, err)
+	_, err = newSampler(1.5, "")
+	assert.NotNil(t, err)
+}
+
+func Test_Engine_sample(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{
+		AllowKeyPrefix: []string{"user:"},
+		SampleRatio:    0.5,
+	})
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		key := "user:" + strconv.Itoa(i)
+		if f.sampler.keep(key) {
+			in = key
+		} else {
+			out = key
+		}
+	}
+	assert.Equal(t, Explanation{Accepted: true, Rule: ruleDefault, KeyRules: []string{"allow_key_prefix:user:"}}, f.Explain(newTestEntry("SET", in, "v")))
+	assert.Equal(t, Explanation{Rule: "sample:0.5", KeyRules: []string{"sample:0.5"}}, f.Explain(newTestEntry("SET", out, "v")))
+	// the sample does not bring back keys the prefix filter rejects
+	assert.Equal(t, ruleAllowKeyMiss, f.Explain(newTestEntry("SET", "order:1", "v")).Rule)
+
+	e := newTestEntry("DEL", in, out)
+	assert.True(t, f.Filter(e))
+	assert.Equal(t, []string{"DEL", in}, e.Argv)
+}
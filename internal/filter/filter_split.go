@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"redisFlutter/internal/entry"
+)
+
+// splitKeyStep is the number of arguments each key owns in commands that can be
+// split by keys, MSET key value has 2. Every key with its arguments is independent,
+// so the allowed keys can be sent without the filtered ones.
+var splitKeyStep = map[string]int{
+	"MSET":   2,
+	"DEL":    1,
+	"UNLINK": 1,
+	"EXISTS": 1,
+	"TOUCH":  1,
+}
+
+type splitCounter struct {
+	Split       int64 `json:"split"`
+	DroppedKeys int64 `json:"dropped_keys"`
+	Rejected    int64 `json:"rejected"`
+}
+
+func canSplit(e *entry.Entry) bool {
+	_, ok := splitKeyStep[e.CmdName]
+	return ok
+}
+
+// splitEntry rewrites e to keep only the keys whose result is true, e must be splittable.
+func (f *Engine) splitEntry(e *entry.Entry, keyResults []bool) {
+	step := splitKeyStep[e.CmdName]
+	argv := []string{e.Argv[0]}
+	var dropped int64
+	for inx, keyIndex := range e.KeyIndexes {
+		if !keyResults[inx] {
+			dropped++
+			continue
+		}
+		argv = append(argv, e.Argv[keyIndex-1:keyIndex-1+step]...)
+	}
+	e.Argv = argv
+	e.Parse()
+	f.countSplit(e.CmdName, func(c *splitCounter) {
+		c.Split++
+		c.DroppedKeys += dropped
+	})
+}
+
+func (f *Engine) countSplit(cmdName string, update func(c *splitCounter)) {
+	f.splitLock.Lock()
+	defer f.splitLock.Unlock()
+	counter, ok := f.splitStats[cmdName]
+	if !ok {
+		counter = new(splitCounter)
+		f.splitStats[cmdName] = counter
+	}
+	update(counter)
+}
+
+// SplitStatus returns the split and reject counts of multi-key entries per command.
+func (f *Engine) SplitStatus() map[string]splitCounter {
+	f.splitLock.Lock()
+	defer f.splitLock.Unlock()
+	ret := make(map[string]splitCounter, len(f.splitStats))
+	for cmdName, counter := range f.splitStats {
+		ret[cmdName] = *counter
+	}
+	return ret
+}
@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+)
+
+func newTestEntry(argv ...string) *entry.Entry {
+	e := entry.NewEntry()
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
+
+func newTestEngine(t *testing.T, opts config.FilterOptions) *Engine {
+	f, err := NewEngine(&opts)
+	assert.Nil(t, err)
+	return f
+}
+
+func Test_Filter_split(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{BlockKeyPrefix: []string{"tmp:"}})
+
+	e := newTestEntry("MSET", "a", "1", "tmp:b", "2", "c", "3")
+	assert.True(t, f.Filter(e))
+	assert.Equal(t, []string{"MSET", "a", "1", "c", "3"}, e.Argv)
+	assert.Equal(t, []string{"a", "c"}, e.Keys)
+	assert.Len(t, e.Slots, 2)
+
+	e = newTestEntry("DEL", "tmp:a", "b")
+	assert.True(t, f.Filter(e))
+	assert.Equal(t, []string{"DEL", "b"}, e.Argv)
+
+	e = newTestEntry("UNLINK", "tmp:a", "tmp:b")
+	assert.False(t, f.Filter(e))
+
+	// not splittable, the whole entry is rejected
+	e = newTestEntry("MSETNX", "a", "1", "tmp:b", "2")
+	assert.False(t, f.Filter(e))
+	assert.Equal(t, []string{"MSETNX", "a", "1", "tmp:b", "2"}, e.Argv)
+
+	stat := f.SplitStatus()
+	assert.Equal(t, splitCounter{Split: 1, DroppedKeys: 1}, stat["MSET"])
+	assert.Equal(t, splitCounter{Split: 1, DroppedKeys: 1}, stat["DEL"])
+	assert.Equal(t, splitCounter{Rejected: 1}, stat["MSETNX"])
+}
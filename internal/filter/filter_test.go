@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+)
+
+func Test_Engine_keys(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{
+		AllowKeys:      []string{"exact"},
+		AllowKeyPrefix: []string{"user:", "u"},
+		AllowKeySuffix: []string{":session"},
+		AllowKeyRegex:  []string{"^order_[0-9]+$"},
+		AllowKeyGlob:   []string{"cache:[ab]?"},
+		BlockKeyPrefix: []string{"user:tmp:"},
+		BlockKeyGlob:   []string{"*:lock"},
+	})
+	cases := []struct {
+		key      string
+		accepted bool
+		rule     string
+	}{
+		{"exact", true, "allow_keys"},
+		{"user:1", true, "allow_key_prefix:u"},
+		{"x:session", true, "allow_key_suffix::session"},
+		{"order_12", true, "allow_key_regex:^order_[0-9]+$"},
+		{"cache:a1", true, "allow_key_glob:cache:[ab]?"},
+		{"user:tmp:1", false, "block_key_prefix:user:tmp:"},
+		{"user:1:lock", false, "block_key_glob:*:lock"},
+		{"other", false, ruleAllowKeyMiss},
+	}
+	for _, c := range cases {
+		ex := f.Explain(newTestEntry("SET", c.key, "v"))
+		assert.Equal(t, c.accepted, ex.Accepted, c.key)
+		assert.Equal(t, []string{c.rule}, ex.KeyRules, c.key)
+	}
+}
+
+func Test_Engine_commands(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{
+		BlockDB:           []int{2},
+		BlockCommand:      []string{"FLUSHALL"},
+		AllowCommandGroup: []string{"STRING", "SERVER"},
+	})
+
+	e := newTestEntry("SET", "k", "v")
+	assert.Equal(t, Explanation{Accepted: true, Rule: ruleDefault}, f.Explain(e))
+	e.DbId = 2
+	assert.Equal(t, Explanation{Rule: "block_db:2"}, f.Explain(e))
+	assert.Equal(t, Explanation{Rule: "block_command:FLUSHALL"}, f.Explain(newTestEntry("FLUSHALL")))
+	assert.Equal(t, Explanation{Rule: "allow_command_group:no_match"}, f.Explain(newTestEntry("HSET", "h", "f", "v")))
+}
+
+func Test_Engine_hits(t *testing.T) {
+	f := newTestEngine(t, config.FilterOptions{BlockKeySuffix: []string{":tmp"}})
+	assert.True(t, f.Filter(newTestEntry("SET", "a", "v")))
+	assert.False(t, f.Filter(newTestEntry("SET", "a:tmp", "v")))
+	assert.True(t, f.Filter(newTestEntry("MSET", "a", "1", "b:tmp", "2")))
+	assert.Equal(t, map[string]int64{
+		ruleDefault:             1,
+		"block_key_suffix::tmp": 2,
+		ruleSplit:               1,
+	}, f.Hits())
+
+	// Explain does not count nor parse
+	e := entry.NewEntry()
+	e.Argv = []string{"SET", "a", "v"}
+	f.Explain(e)
+	assert.Equal(t, "", e.CmdName)
+	assert.Empty(t, e.Keys)
+	assert.Equal(t, int64(1), f.Hits()[ruleDefault])
+}
+
+func Test_trie(t *testing.T) {
+	prefixes := newTrie()
+	prefixes.insert("ab", "ab")
+	prefixes.insert("abc", "abc")
+	prefix, ok := prefixes.matchPrefix("abcd")
+	assert.True(t, ok)
+	assert.Equal(t, "ab", prefix)
+	_, ok = prefixes.matchPrefix("a")
+	assert.False(t, ok)
+
+	suffixes := newTrie()
+	suffixes.insert(reverse(".json"), ".json")
+	suffix, ok := suffixes.matchSuffix("a.json")
+	assert.True(t, ok)
+	assert.Equal(t, ".json", suffix)
+	_, ok = suffixes.matchSuffix("json")
+	assert.False(t, ok)
+}
@@ -1,42 +1,200 @@
 package filter
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"redisFlutter/internal/config"
 	"redisFlutter/internal/entry"
 	"redisFlutter/internal/log"
+	"redisFlutter/internal/status"
 
 	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
 	"github.com/yuin/gopher-lua/parse"
 )
 
+const (
+	FunctionErrorDrop  = "drop"
+	FunctionErrorPass  = "pass"
+	FunctionErrorPanic = "panic"
+)
+
+// sandboxRemoved are the globals of the base library a function must not use:
+// file access, loading code at runtime and changing environments.
+var sandboxRemoved = []string{
+	"dofile", "loadfile", "load", "loadstring", "require", "module",
+	"getfenv", "setfenv", "newproxy", "_printregs",
+}
+
+// Runtime runs the lua function on entries. Two styles of code are supported:
+//
+//   - the whole chunk runs for every entry, with the entry in globals (DB, KEYS, ARGV...)
+//   - the chunk defines a global `function process()`, then the chunk runs once per VM,
+//     `init()` is called once per VM if it is defined, and only process() runs for
+//     every entry. Globals set by the chunk and init() live as long as the VM.
 type Runtime struct {
 	luaVMPool        *sync.Pool
 	compiledFunction *lua.FunctionProto
+	hasProcess       bool
+	timeout          time.Duration
+	errorPolicy      string
+
+	stat functionStat
+	kv   functionKV
+
+	metricsLock sync.Mutex
+	metrics     map[string]float64
+}
+
+// luaVM is one lua state with the entry it is running on.
+type luaVM struct {
+	state   *lua.LState
+	entries []*entry.Entry
+	source  *entry.Entry // the entry the function runs on, nil in init
+}
+
+type functionStat struct {
+	Calls    atomic.Int64
+	Errors   atomic.Int64
+	Timeouts atomic.Int64
+	Dropped  atomic.Int64
+	Passed   atomic.Int64
+}
+
+type functionStatus struct {
+	Calls    int64 `json:"calls"`
+	Errors   int64 `json:"errors"`
+	Timeouts int64 `json:"timeouts"`
+	Dropped  int64 `json:"dropped"`
+	Passed   int64 `json:"passed"`
+
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+var currentRuntime atomic.Pointer[Runtime]
+
+func init() {
+	status.RegisterHandler("/function", functionStatusHandler)
 }
 
 func NewFunctionFilter(luaCode string) *Runtime {
+	opts := &config.Opt.Filter
+	runtime, err := NewRuntime(luaCode, time.Duration(opts.FunctionTimeoutMs)*time.Millisecond, opts.FunctionErrorPolicy)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	if runtime != nil {
+		currentRuntime.Store(runtime)
+	}
+	return runtime
+}
+
+// NewRuntime compiles luaCode, it returns nil when there is no code.
+func NewRuntime(luaCode string, timeout time.Duration, errorPolicy string) (*Runtime, error) {
 	if len(luaCode) == 0 {
-		return nil
+		return nil, nil
+	}
+	switch errorPolicy {
+	case "":
+		errorPolicy = FunctionErrorPanic
+	case FunctionErrorDrop, FunctionErrorPass, FunctionErrorPanic:
+	default:
+		return nil, fmt.Errorf("function_error_policy [%s] should be %s, %s or %s", errorPolicy, FunctionErrorDrop, FunctionErrorPass, FunctionErrorPanic)
 	}
 	luaCode = strings.TrimSpace(luaCode)
 	chunk, err := parse.Parse(strings.NewReader(luaCode), "<string>")
 	if err != nil {
-		log.Panicf("parse lua code failed: %v", err)
+		return nil, fmt.Errorf("parse lua code failed: %v", err)
 	}
 	codeObject, err := lua.Compile(chunk, "<string>")
 	if err != nil {
-		log.Panicf("compile lua code failed: %v", err)
-	}
-	return &Runtime{
-		luaVMPool: &sync.Pool{
-			New: func() interface{} {
-				return lua.NewState()
-			},
-		},
+		return nil, fmt.Errorf("compile lua code failed: %v", err)
+	}
+	runtime := &Runtime{
+		luaVMPool:        new(sync.Pool),
 		compiledFunction: codeObject,
+		hasProcess:       definesFunction(chunk, "process"),
+		timeout:          timeout,
+		errorPolicy:      errorPolicy,
+		kv:               functionKV{values: make(map[string]lua.LValue)},
+		metrics:          make(map[string]float64),
+	}
+	// run the chunk and init() once, so errors there are found before the sync starts
+	vm, err := runtime.newVM()
+	if err != nil {
+		return nil, err
+	}
+	runtime.luaVMPool.Put(vm)
+	return runtime, nil
+}
+
+// definesFunction tells whether the chunk has a top level `function name()`.
+func definesFunction(chunk []ast.Stmt, name string) bool {
+	for _, stmt := range chunk {
+		def, ok := stmt.(*ast.FuncDefStmt)
+		if !ok || def.Name.Receiver != nil {
+			continue
+		}
+		if ident, ok := def.Name.Func.(*ast.IdentExpr); ok && ident.Value == name {
+			return true
+		}
 	}
+	return false
+}
+
+// newVM creates a sandboxed state with the shake api. When the code defines
+// process(), the chunk and init() run here.
+func (runtime *Runtime) newVM() (*luaVM, error) {
+	vm := &luaVM{state: newSandboxState()}
+	runtime.openShakeLib(vm)
+	if !runtime.hasProcess {
+		return vm, nil
+	}
+	luaState := vm.state
+	luaState.Push(luaState.NewFunctionFromProto(runtime.compiledFunction))
+	if err := luaState.PCall(0, 0, nil); err != nil {
+		luaState.Close()
+		return nil, fmt.Errorf("run lua code failed: %v", err)
+	}
+	if init := luaState.GetGlobal("init"); init.Type() == lua.LTFunction {
+		luaState.Push(init)
+		if err := luaState.PCall(0, 0, nil); err != nil {
+			luaState.Close()
+			return nil, fmt.Errorf("lua init() failed: %v", err)
+		}
+	}
+	return vm, nil
+}
+
+// newSandboxState opens only the base, table, string and math libraries,
+// without the functions in sandboxRemoved.
+func newSandboxState() *lua.LState {
+	luaState := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		luaState.Push(luaState.NewFunction(lib.open))
+		luaState.Push(lua.LString(lib.name))
+		luaState.Call(1, 0)
+	}
+	for _, name := range sandboxRemoved {
+		luaState.SetGlobal(name, lua.LNil)
+	}
+	return luaState
 }
 
 // DB
@@ -47,16 +205,23 @@ func NewFunctionFilter(luaCode string) *Runtime {
 // SLOTS
 // ARGV
 
-// shake.call(DB, ARGV)
-// shake.log()
+// shake api, see function_api.go
 
 func (runtime *Runtime) RunFunction(e *entry.Entry) []*entry.Entry {
 	if runtime == nil {
 		return []*entry.Entry{e}
 	}
-	entries := make([]*entry.Entry, 0)
-	luaState := runtime.luaVMPool.Get().(*lua.LState)
-	defer runtime.luaVMPool.Put(luaState)
+	runtime.stat.Calls.Add(1)
+	vm, _ := runtime.luaVMPool.Get().(*luaVM)
+	if vm == nil {
+		var err error
+		if vm, err = runtime.newVM(); err != nil {
+			return runtime.onError(e, err, false)
+		}
+	}
+	vm.entries = make([]*entry.Entry, 0)
+	vm.source = e
+	luaState := vm.state
 	luaState.SetGlobal("DB", lua.LNumber(e.DbId))
 	luaState.SetGlobal("GROUP", lua.LString(e.Group))
 	luaState.SetGlobal("CMD", lua.LString(e.CmdName))
@@ -80,30 +245,74 @@ func (runtime *Runtime) RunFunction(e *entry.Entry) []*entry.Entry {
 		argv.Append(lua.LString(arg))
 	}
 	luaState.SetGlobal("ARGV", argv)
-	shake := luaState.NewTypeMetatable("shake")
-	luaState.SetGlobal("shake", shake)
-
-	luaState.SetField(shake, "call", luaState.NewFunction(func(ls *lua.LState) int {
-		db := ls.ToInt(1)
-		argv := ls.ToTable(2)
-		var argvStrings []string
-		for i := 1; i <= argv.Len(); i++ {
-			argvStrings = append(argvStrings, argv.RawGetInt(i).String())
-		}
-		entries = append(entries, &entry.Entry{
-			DbId: db,
-			Argv: argvStrings,
-		})
-		return 0
-	}))
-	luaState.SetField(shake, "log", luaState.NewFunction(func(ls *lua.LState) int {
-		log.Infof("lua log: %v", ls.ToString(1))
-		return 0
-	}))
-	luaState.Push(luaState.NewFunctionFromProto(runtime.compiledFunction))
-	if err := luaState.PCall(0, lua.MultRet, nil); err != nil {
-		log.Panicf("load function script failed: %v", err)
+
+	if runtime.timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.timeout)
+		defer cancel()
+		luaState.SetContext(ctx)
+	}
+	if runtime.hasProcess {
+		luaState.Push(luaState.GetGlobal("process"))
+	} else {
+		luaState.Push(luaState.NewFunctionFromProto(runtime.compiledFunction))
+	}
+	err := luaState.PCall(0, lua.MultRet, nil)
+	timeout := false
+	if ctx := luaState.RemoveContext(); ctx != nil {
+		timeout = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}
+	entries := vm.entries
+	vm.entries = nil
+	vm.source = nil
+	if err == nil {
+		luaState.SetTop(0)
+		runtime.luaVMPool.Put(vm)
+		return entries
 	}
+	// a state stopped in the middle of the function is not reused
+	luaState.Close()
+	return runtime.onError(e, err, timeout)
+}
 
-	return entries
+func (runtime *Runtime) onError(e *entry.Entry, err error, timeout bool) []*entry.Entry {
+	if timeout {
+		runtime.stat.Timeouts.Add(1)
+		err = fmt.Errorf("function ran longer than %v", runtime.timeout)
+	} else {
+		runtime.stat.Errors.Add(1)
+	}
+	switch runtime.errorPolicy {
+	case FunctionErrorDrop:
+		runtime.stat.Dropped.Add(1)
+		log.Warnf("run function failed, entry dropped. cmd=[%s], err=[%v]", e.String(), err)
+		return nil
+	case FunctionErrorPass:
+		runtime.stat.Passed.Add(1)
+		log.Warnf("run function failed, entry passed unchanged. cmd=[%s], err=[%v]", e.String(), err)
+		return []*entry.Entry{e}
+	}
+	log.Panicf("run function failed. cmd=[%s], err=[%v]", e.String(), err)
+	return nil
+}
+
+func (runtime *Runtime) Status() interface{} {
+	return functionStatus{
+		Calls:    runtime.stat.Calls.Load(),
+		Errors:   runtime.stat.Errors.Load(),
+		Timeouts: runtime.stat.Timeouts.Load(),
+		Dropped:  runtime.stat.Dropped.Load(),
+		Passed:   runtime.stat.Passed.Load(),
+		Metrics:  runtime.Metrics(),
+	}
+}
+
+func functionStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	var jsonBytes []byte
+	if runtime := currentRuntime.Load(); runtime != nil {
+		jsonBytes, _ = json.Marshal(runtime.Status())
+	} else {
+		jsonBytes = []byte("{}")
+	}
+	_, _ = w.Write(jsonBytes)
 }
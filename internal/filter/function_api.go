@@ -0,0 +1,291 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"redisFlutter/internal/commands"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+	"redisFlutter/internal/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The shake table of a lua function:
+//
+//	shake.call(db, argv)            send argv to db of target, can be called many times
+//	shake.log(msg)                  log msg
+//	shake.rename_key(i, new_key)    rename the i-th key in KEYS and ARGV
+//	shake.kv.get(k) / set(k, v) / incr(k, delta) / del(k)
+//	                                state shared by all VMs of the runtime, values are
+//	                                strings, numbers or booleans
+//	shake.now()                     unix time in milliseconds
+//	shake.crc16(s) / shake.slot(key)
+//	shake.json.encode(v) / decode(s)
+//	shake.metric(name, delta)       add delta to a counter shown in status
+func (runtime *Runtime) openShakeLib(vm *luaVM) {
+	luaState := vm.state
+	shake := luaState.NewTable()
+	luaState.SetGlobal("shake", shake)
+
+	luaState.SetField(shake, "call", luaState.NewFunction(func(ls *lua.LState) int {
+		db := ls.CheckInt(1)
+		argv := ls.CheckTable(2)
+		var argvStrings []string
+		for i := 1; i <= argv.Len(); i++ {
+			argvStrings = append(argvStrings, argv.RawGetInt(i).String())
+		}
+		e := &entry.Entry{
+			DbId: db,
+			Argv: argvStrings,
+		}
+		// the rdb phase rate limit and the big key slow lane apply to what the entry became
+		if source := vm.source; source != nil {
+			e.FromRdb = source.FromRdb
+			e.ValueType = source.ValueType
+			e.ValueElements = source.ValueElements
+			e.ValueBytes = source.ValueBytes
+			e.SlowLane = source.SlowLane
+		}
+		vm.entries = append(vm.entries, e)
+		return 0
+	}))
+	luaState.SetField(shake, "log", luaState.NewFunction(func(ls *lua.LState) int {
+		log.Infof("lua log: %v", ls.ToString(1))
+		return 0
+	}))
+	luaState.SetField(shake, "rename_key", luaState.NewFunction(luaRenameKey))
+	luaState.SetField(shake, "now", luaState.NewFunction(func(ls *lua.LState) int {
+		ls.Push(lua.LNumber(time.Now().UnixMilli()))
+		return 1
+	}))
+	luaState.SetField(shake, "crc16", luaState.NewFunction(func(ls *lua.LState) int {
+		ls.Push(lua.LNumber(utils.Crc16(ls.CheckString(1))))
+		return 1
+	}))
+	luaState.SetField(shake, "slot", luaState.NewFunction(func(ls *lua.LState) int {
+		ls.Push(lua.LNumber(commands.CalcSlots([]string{ls.CheckString(1)})[0]))
+		return 1
+	}))
+	luaState.SetField(shake, "metric", luaState.NewFunction(func(ls *lua.LState) int {
+		runtime.addMetric(ls.CheckString(1), float64(ls.OptNumber(2, 1)))
+		return 0
+	}))
+
+	kv := luaState.NewTable()
+	luaState.SetField(shake, "kv", kv)
+	luaState.SetField(kv, "get", luaState.NewFunction(func(ls *lua.LState) int {
+		ls.Push(runtime.kv.get(ls.CheckString(1)))
+		return 1
+	}))
+	luaState.SetField(kv, "set", luaState.NewFunction(func(ls *lua.LState) int {
+		value := ls.Get(2)
+		switch value.Type() {
+		case lua.LTNil, lua.LTString, lua.LTNumber, lua.LTBool:
+		default:
+			ls.ArgError(2, "value should be a string, number or boolean")
+		}
+		runtime.kv.set(ls.CheckString(1), value)
+		return 0
+	}))
+	luaState.SetField(kv, "incr", luaState.NewFunction(func(ls *lua.LState) int {
+		value, err := runtime.kv.incr(ls.CheckString(1), ls.OptNumber(2, 1))
+		if err != nil {
+			ls.RaiseError("%v", err)
+		}
+		ls.Push(value)
+		return 1
+	}))
+	luaState.SetField(kv, "del", luaState.NewFunction(func(ls *lua.LState) int {
+		runtime.kv.set(ls.CheckString(1), lua.LNil)
+		return 0
+	}))
+
+	jsonTable := luaState.NewTable()
+	luaState.SetField(shake, "json", jsonTable)
+	luaState.SetField(jsonTable, "encode", luaState.NewFunction(func(ls *lua.LState) int {
+		value, err := luaToGo(ls.Get(1), 0)
+		if err != nil {
+			ls.RaiseError("json encode failed: %v", err)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			ls.RaiseError("json encode failed: %v", err)
+		}
+		ls.Push(lua.LString(data))
+		return 1
+	}))
+	luaState.SetField(jsonTable, "decode", luaState.NewFunction(func(ls *lua.LState) int {
+		var value interface{}
+		if err := json.Unmarshal([]byte(ls.CheckString(1)), &value); err != nil {
+			ls.RaiseError("json decode failed: %v", err)
+		}
+		ls.Push(goToLua(ls, value))
+		return 1
+	}))
+}
+
+// luaRenameKey is shake.rename_key(i, new_key), it changes KEYS[i] and the
+// argument of ARGV at KEY_INDEXES[i], so shake.call(DB, ARGV) sends the new key.
+func luaRenameKey(ls *lua.LState) int {
+	inx := ls.CheckInt(1)
+	newKey := ls.CheckString(2)
+	keys, ok1 := ls.GetGlobal("KEYS").(*lua.LTable)
+	keyIndexes, ok2 := ls.GetGlobal("KEY_INDEXES").(*lua.LTable)
+	argv, ok3 := ls.GetGlobal("ARGV").(*lua.LTable)
+	if !ok1 || !ok2 || !ok3 {
+		ls.RaiseError("KEYS, KEY_INDEXES or ARGV is not a table")
+	}
+	argvIndex, ok := keyIndexes.RawGetInt(inx).(lua.LNumber)
+	if !ok {
+		ls.ArgError(1, fmt.Sprintf("no key at index %d", inx))
+	}
+	keys.RawSetInt(inx, lua.LString(newKey))
+	argv.RawSetInt(int(argvIndex), lua.LString(newKey))
+	return 0
+}
+
+// functionKV is the state of shake.kv, shared by all VMs of a runtime.
+type functionKV struct {
+	lock   sync.Mutex
+	values map[string]lua.LValue // only LString, LNumber and LBool, they are immutable
+}
+
+func (kv *functionKV) get(key string) lua.LValue {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if value, ok := kv.values[key]; ok {
+		return value
+	}
+	return lua.LNil
+}
+
+func (kv *functionKV) set(key string, value lua.LValue) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if value == lua.LNil {
+		delete(kv.values, key)
+		return
+	}
+	kv.values[key] = value
+}
+
+func (kv *functionKV) incr(key string, delta lua.LNumber) (lua.LNumber, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	current := lua.LNumber(0)
+	if value, ok := kv.values[key]; ok {
+		number, ok := value.(lua.LNumber)
+		if !ok {
+			return 0, fmt.Errorf("shake.kv value of [%s] is not a number", key)
+		}
+		current = number
+	}
+	current += delta
+	kv.values[key] = current
+	return current, nil
+}
+
+func (runtime *Runtime) addMetric(name string, delta float64) {
+	runtime.metricsLock.Lock()
+	defer runtime.metricsLock.Unlock()
+	runtime.metrics[name] += delta
+}
+
+// Metrics returns the counters of shake.metric.
+func (runtime *Runtime) Metrics() map[string]float64 {
+	runtime.metricsLock.Lock()
+	defer runtime.metricsLock.Unlock()
+	ret := make(map[string]float64, len(runtime.metrics))
+	for name, value := range runtime.metrics {
+		ret[name] = value
+	}
+	return ret
+}
+
+const maxJsonDepth = 64
+
+// luaToGo converts a lua value for encoding/json. Tables with keys 1..n are arrays,
+// other tables are objects, an empty table is an empty array.
+func luaToGo(value lua.LValue, depth int) (interface{}, error) {
+	if depth > maxJsonDepth {
+		return nil, fmt.Errorf("nested too deep")
+	}
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		n := v.Len()
+		isArray := true
+		count := 0
+		v.ForEach(func(key lua.LValue, _ lua.LValue) {
+			count++
+			if number, ok := key.(lua.LNumber); !ok || int(number) < 1 || int(number) > n || float64(int(number)) != float64(number) {
+				isArray = false
+			}
+		})
+		if isArray && count == n {
+			array := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := luaToGo(v.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, item)
+			}
+			return array, nil
+		}
+		object := make(map[string]interface{}, count)
+		var err error
+		v.ForEach(func(key lua.LValue, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			object[key.String()], err = luaToGo(item, depth+1)
+		})
+		return object, err
+	}
+	return nil, fmt.Errorf("can not encode %s", value.Type())
+}
+
+func goToLua(ls *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := ls.CreateTable(len(v), 0)
+		// nulls keep their index, the items after them do not shift
+		for i, item := range v {
+			table.RawSetInt(i+1, goToLua(ls, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := ls.CreateTable(0, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			table.RawSetString(key, goToLua(ls, v[key]))
+		}
+		return table
+	}
+	return lua.LNil
+}
@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/commands"
+)
+
+func runArgv(t *testing.T, runtime *Runtime, argv ...string) [][]string {
+	ret := make([][]string, 0)
+	for _, e := range runtime.RunFunction(newTestEntry(argv...)) {
+		ret = append(ret, e.Argv)
+	}
+	return ret
+}
+
+func Test_Runtime_process(t *testing.T) {
+	runtime, err := NewRuntime(`
+		prefix = "tenantA:"
+		inits = 0
+		function init()
+			inits = inits + 1
+		end
+		function process()
+			for i = 1, #KEYS do
+				shake.rename_key(i, prefix .. KEYS[i])
+			end
+			shake.metric("renamed", #KEYS)
+			shake.call(DB, ARGV)
+		end`, time.Second, FunctionErrorPanic)
+	assert.Nil(t, err)
+	assert.True(t, runtime.hasProcess)
+	assert.Equal(t, [][]string{{"MSET", "tenantA:a", "1", "tenantA:b", "2"}}, runArgv(t, runtime, "MSET", "a", "1", "b", "2"))
+	assert.Equal(t, [][]string{{"SET", "tenantA:k", "v"}}, runArgv(t, runtime, "SET", "k", "v"))
+	assert.Equal(t, map[string]float64{"renamed": 3}, runtime.Metrics())
+
+	// entries of the rdb phase stay in it
+	rdbEntry := newRdbEntry("hash", 10, 100, "hset", "h", "f", "v")
+	rdbEntry.SlowLane = true
+	ret := runtime.RunFunction(rdbEntry)
+	assert.Equal(t, 1, len(ret))
+	assert.True(t, ret[0].FromRdb)
+	assert.True(t, ret[0].SlowLane)
+	assert.Equal(t, "hash", ret[0].ValueType)
+	assert.Equal(t, int64(10), ret[0].ValueElements)
+	assert.Equal(t, int64(100), ret[0].ValueBytes)
+
+	vm := runtime.luaVMPool.Get().(*luaVM)
+	assert.Equal(t, "1", vm.state.GetGlobal("inits").String())
+}
+
+func Test_Runtime_initError(t *testing.T) {
+	_, err := NewRuntime(`
+		function init() error("no config") end
+		function process() end`, time.Second, FunctionErrorDrop)
+	assert.ErrorContains(t, err, "no config")
+}
+
+func Test_Runtime_kv(t *testing.T) {
+	runtime, err := NewRuntime(`
+		function process()
+			local n = shake.kv.incr("seen")
+			if shake.kv.get("first") == nil then
+				shake.kv.set("first", KEYS[1])
+			end
+			shake.call(DB, {"SET", "n", tostring(n), shake.kv.get("first")})
+		end`, time.Second, FunctionErrorPanic)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"SET", "n", "1", "a"}}, runArgv(t, runtime, "SET", "a", "v"))
+	// another VM sees the same state
+	runtime.luaVMPool = new(sync.Pool)
+	assert.Equal(t, [][]string{{"SET", "n", "2", "a"}}, runArgv(t, runtime, "SET", "b", "v"))
+}
+
+func Test_Runtime_helpers(t *testing.T) {
+	runtime, err := NewRuntime(`
+		local doc = shake.json.decode('{"b":[1,2,{"c":true}],"a":"x"}')
+		local sparse = shake.json.decode('[1,null,3]')
+		shake.call(0, {
+			tostring(shake.slot("{user1}:a")),
+			tostring(shake.crc16("123456789")),
+			shake.json.encode(doc.b),
+			doc.a,
+			tostring(shake.now() > 0),
+			shake.json.encode({k = "v"}),
+			tostring(sparse[2]) .. " " .. tostring(sparse[3]),
+		})`, time.Second, FunctionErrorPanic)
+	assert.Nil(t, err)
+	assert.False(t, runtime.hasProcess)
+	assert.Equal(t, [][]string{{
+		"8106",
+		"12739",
+		`[1,2,{"c":true}]`,
+		"x",
+		"true",
+		`{"k":"v"}`,
+		"nil 3",
+	}}, runArgv(t, runtime, "SET", "k", "v"))
+	assert.Equal(t, commands.CalcSlots([]string{"user1"})[0], 8106)
+}
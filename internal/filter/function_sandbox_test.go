@@ -0,0 +1,54 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Runtime_sandbox(t *testing.T) {
+	for _, code := range []string{
+		`os.exit(1)`,
+		`io.open("/etc/passwd")`,
+		`load("return 1")()`,
+		`loadstring("return 1")()`,
+		`dofile("/etc/passwd")`,
+		`require("os")`,
+	} {
+		runtime, err := NewRuntime(code, time.Second, FunctionErrorDrop)
+		assert.Nil(t, err)
+		assert.Nil(t, runtime.RunFunction(newTestEntry("SET", "k", "v")), code)
+	}
+	runtime, err := NewRuntime(`shake.call(DB, {string.upper(ARGV[1]), KEYS[1], tostring(math.floor(1.5))})`, time.Second, FunctionErrorPanic)
+	assert.Nil(t, err)
+	entries := runtime.RunFunction(newTestEntry("set", "k", "v"))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, []string{"SET", "k", "1"}, entries[0].Argv)
+}
+
+func Test_Runtime_timeout(t *testing.T) {
+	runtime, err := NewRuntime(`while true do end`, 50*time.Millisecond, FunctionErrorPass)
+	assert.Nil(t, err)
+	e := newTestEntry("SET", "k", "v")
+	start := time.Now()
+	assert.Equal(t, e, runtime.RunFunction(e)[0])
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, functionStatus{Calls: 1, Timeouts: 1, Passed: 1, Metrics: map[string]float64{}}, runtime.Status())
+}
+
+func Test_Runtime_errorPolicy(t *testing.T) {
+	runtime, err := NewRuntime(`error("boom")`, 0, FunctionErrorDrop)
+	assert.Nil(t, err)
+	assert.Nil(t, runtime.RunFunction(newTestEntry("SET", "k", "v")))
+	assert.Nil(t, runtime.RunFunction(newTestEntry("SET", "k", "v")))
+	assert.Equal(t, functionStatus{Calls: 2, Errors: 2, Dropped: 2, Metrics: map[string]float64{}}, runtime.Status())
+
+	_, err = NewRuntime(`error("boom")`, 0, "ignore")
+	assert.NotNil(t, err)
+	_, err = NewRuntime(`if then`, 0, FunctionErrorDrop)
+	assert.NotNil(t, err)
+	runtime, err = NewRuntime("", 0, FunctionErrorDrop)
+	assert.Nil(t, runtime)
+	assert.Nil(t, err)
+}
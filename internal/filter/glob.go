@@ -0,0 +1,132 @@
+package filter
+
+// glob is a compiled redis glob pattern, matching is the same as stringmatchlen
+// in redis util.c (KEYS, SCAN MATCH): "*" is any string, "?" is any one byte,
+// "[abc]", "[^abc]" and "[a-z]" are one byte in or not in the set, and "\x" is x
+// itself, also inside brackets.
+type glob struct {
+	pattern string
+	tokens  []globToken
+}
+
+type globTokenType int
+
+const (
+	globLiteral globTokenType = iota
+	globAnyOne
+	globAnyString
+	globClass
+)
+
+type globToken struct {
+	typ     globTokenType
+	literal byte
+	class   *[256]bool // bytes matched by the class, negation already applied
+}
+
+func compileGlob(pattern string) *glob {
+	g := &glob{pattern: pattern}
+	p := pattern
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*':
+			// consecutive stars match the same as one
+			if n := len(g.tokens); n > 0 && g.tokens[n-1].typ == globAnyString {
+				continue
+			}
+			g.tokens = append(g.tokens, globToken{typ: globAnyString})
+		case '?':
+			g.tokens = append(g.tokens, globToken{typ: globAnyOne})
+		case '[':
+			var token globToken
+			token, i = compileGlobClass(p, i+1)
+			g.tokens = append(g.tokens, token)
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			g.tokens = append(g.tokens, globToken{typ: globLiteral, literal: p[i]})
+		default:
+			g.tokens = append(g.tokens, globToken{typ: globLiteral, literal: p[i]})
+		}
+	}
+	return g
+}
+
+// compileGlobClass parses the class that starts at p[i], right after '[', and returns
+// the index of its closing ']'. An unterminated class runs to the end of the pattern.
+func compileGlobClass(p string, i int) (globToken, int) {
+	set := new([256]bool)
+	not := i < len(p) && p[i] == '^'
+	if not {
+		i++
+	}
+	for ; i < len(p); i++ {
+		if p[i] == '\\' && len(p)-i >= 2 {
+			i++
+			set[p[i]] = true
+		} else if p[i] == ']' {
+			break
+		} else if len(p)-i >= 3 && p[i+1] == '-' {
+			start, end := p[i], p[i+2]
+			if start > end {
+				start, end = end, start
+			}
+			for c := int(start); c <= int(end); c++ {
+				set[c] = true
+			}
+			i += 2
+		} else {
+			set[p[i]] = true
+		}
+	}
+	if not {
+		for c := range set {
+			set[c] = !set[c]
+		}
+	}
+	if i >= len(p) {
+		i = len(p) - 1
+	}
+	return globToken{typ: globClass, class: set}, i
+}
+
+func (t *globToken) matchByte(c byte) bool {
+	switch t.typ {
+	case globAnyOne:
+		return true
+	case globClass:
+		return t.class[c]
+	default:
+		return t.literal == c
+	}
+}
+
+// match reports whether the whole key matches. A star remembers where it was,
+// on mismatch the last star takes one more byte, so matching is O(len(key)*len(tokens)).
+func (g *glob) match(key string) bool {
+	tokens := g.tokens
+	ti, ki := 0, 0
+	starTi, starKi := -1, 0
+	for ki < len(key) {
+		if ti < len(tokens) && tokens[ti].typ == globAnyString {
+			starTi, starKi = ti, ki
+			ti++
+			continue
+		}
+		if ti < len(tokens) && tokens[ti].matchByte(key[ki]) {
+			ti++
+			ki++
+			continue
+		}
+		if starTi < 0 {
+			return false
+		}
+		starKi++
+		ti, ki = starTi+1, starKi
+	}
+	for ti < len(tokens) && tokens[ti].typ == globAnyString {
+		ti++
+	}
+	return ti == len(tokens)
+}
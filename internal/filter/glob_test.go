@@ -0,0 +1,84 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_glob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		// KEYS documentation
+		{"h?llo", "hello", true},
+		{"h?llo", "hallo", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hallo", true},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		// reversed ranges are swapped
+		{"h[b-a]llo", "hallo", true},
+		// escapes
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[\\-]llo", "h-llo", true},
+		{"h[\\-]llo", "h\\llo", false},
+		{"a\\", "a\\", true},
+		// keyspace.tcl: KEYS with pattern
+		{"foo*", "foo_a", true},
+		{"foo*", "key_x", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		// keyspace.tcl: KEYS with hashtag
+		{"{a}*", "{a}x", true},
+		{"{a}*", "{b}x", false},
+		{"*{b}*", "{a}{b}x", true},
+		{"{a}h*llo", "{a}hello", true},
+		// unterminated class runs to the end of the pattern
+		{"a[bc", "ab", true},
+		{"a[bc", "ac", true},
+		{"a[bc", "abc", false},
+		{"a[^", "ax", true},
+		{"a[", "a", false},
+		// "a-]" is a range that ends with ']', so the class is unterminated and takes the x
+		{"[a-]x", "]", true},
+		{"[a-]x", "x", true},
+		{"[a-]x", "]x", false},
+		// stars
+		{"a**b", "ab", true},
+		{"*a*", "bab", true},
+		{"*?", "", false},
+		{"*?", "x", true},
+		{"a*b*c", "a__b__c", true},
+		{"a*b*c", "a__c__b", false},
+		{"user:*:session", "user:1:session", true},
+		{"user:*:session", "user:1:profile", false},
+		{"cache:[ab]?", "cache:a1", true},
+		{"cache:[ab]?", "cache:c1", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, compileGlob(c.pattern).match(c.key), "pattern=[%s] key=[%s]", c.pattern, c.key)
+	}
+}
+
+// keyspace.tcl: Regression for pattern matching long nested loops
+func Test_glob_longNestedLoops(t *testing.T) {
+	key := strings.Repeat("a", 50000)
+	assert.False(t, compileGlob(strings.Repeat("a*", 30)+"b").match(key))
+	assert.False(t, compileGlob(strings.Repeat("*?", 50000)+"b").match(key))
+	assert.True(t, compileGlob(strings.Repeat("*?", 50000)).match(key))
+}
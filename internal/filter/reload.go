@@ -0,0 +1,163 @@
+package filter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+	"redisFlutter/internal/status"
+)
+
+// Rules are the filter engine and the lua function built from one FilterOptions.
+// They are replaced together on reload, an entry sees either the old or the new rules.
+type Rules struct {
+	Engine   *Engine
+	Function *Runtime // nil when there is no function
+	Version  string
+}
+
+var (
+	currentRules atomic.Pointer[Rules]
+	defaultOnce  sync.Once
+	reloadLock   sync.Mutex
+	reloadCount  int
+)
+
+func init() {
+	status.RegisterHandler("/filter/reload", reloadHandler)
+}
+
+// Current returns the rules in use, built from config.Opt.Filter on first use.
+// Callers should load it once per entry so the engine and function match.
+func Current() *Rules {
+	defaultOnce.Do(func() {
+		if currentRules.Load() != nil {
+			return
+		}
+		if err := Reload(&config.Opt.Filter); err != nil {
+			log.Panicf("create filter failed: %v", err)
+		}
+	})
+	return currentRules.Load()
+}
+
+// Default returns the engine of the current rules.
+func Default() *Engine {
+	return Current().Engine
+}
+
+// Process runs the filter and then the function of the current rules on e.
+func Process(e *entry.Entry) []*entry.Entry {
+	rules := Current()
+	if !rules.Engine.Filter(e) {
+		return nil
+	}
+	return rules.Function.RunFunction(e)
+}
+
+// Reload builds new rules from opts and swaps them in. Nothing changes when the
+// options are invalid: a regex does not compile, the lua code does not parse or
+// its init() fails. big_key_action can not change, the writers are built for it.
+func Reload(opts *config.FilterOptions) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	engine, err := NewEngine(opts)
+	if err != nil {
+		return err
+	}
+	old := currentRules.Load()
+	if old != nil && old.Engine.bigKeyAction != engine.bigKeyAction {
+		return fmt.Errorf("big_key_action can not change from %s to %s on reload", old.Engine.bigKeyAction, engine.bigKeyAction)
+	}
+	function, err := NewRuntime(opts.Function, time.Duration(opts.FunctionTimeoutMs)*time.Millisecond, opts.FunctionErrorPolicy)
+	if err != nil {
+		return err
+	}
+
+	reloadCount++
+	rules := &Rules{Engine: engine, Function: function, Version: rulesVersion(reloadCount, opts)}
+	currentRules.Store(rules)
+	currentRuntime.Store(function)
+	status.SetFilterVersion(rules.Version)
+	if old != nil {
+		old.Engine.bigKeyReport.close()
+	}
+	return nil
+}
+
+// rulesVersion is "<n>-<hash of the options>", n counts the loads of this process.
+func rulesVersion(n int, opts *config.FilterOptions) string {
+	data, _ := json.Marshal(opts)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d-%s", n, hex.EncodeToString(sum[:4]))
+}
+
+// ReloadFromFile reloads the rules from the filter section of the config file.
+func ReloadFromFile() error {
+	opts, err := config.ReadFilterOptions()
+	if err != nil {
+		return err
+	}
+	if err := Reload(opts); err != nil {
+		return err
+	}
+	log.Infof("filter reloaded. version=[%s]", Current().Version)
+	return nil
+}
+
+// WatchReload reloads the rules from the config file on every SIGHUP until ctx is done.
+func WatchReload(ctx context.Context) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigC)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigC:
+				if err := ReloadFromFile(); err != nil {
+					log.Warnf("reload filter failed, the old rules are kept. err=[%v]", err)
+				}
+			}
+		}
+	}()
+}
+
+type reloadResult struct {
+	Version string `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// reloadHandler shows the version on GET and reloads from the config file on POST.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	var result reloadResult
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := ReloadFromFile(); err != nil {
+			log.Warnf("reload filter failed, the old rules are kept. err=[%v]", err)
+			result.Error = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	result.Version = Current().Version
+	jsonBytes, _ := json.Marshal(result)
+	_, _ = w.Write(jsonBytes)
+}
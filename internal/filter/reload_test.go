@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func Test_Reload(t *testing.T) {
+	assert.Nil(t, Reload(&config.FilterOptions{BlockKeyPrefix: []string{"tmp:"}}))
+	first := Current()
+	assert.Nil(t, first.Function)
+	assert.Nil(t, Process(newTestEntry("SET", "tmp:1", "v")))
+	assert.Len(t, Process(newTestEntry("SET", "a", "v")), 1)
+
+	// invalid rules keep the old ones
+	assert.NotNil(t, Reload(&config.FilterOptions{BlockKeyRegex: []string{"("}}))
+	assert.NotNil(t, Reload(&config.FilterOptions{Function: "shake.call(DB, ARGV"}))
+	assert.NotNil(t, Reload(&config.FilterOptions{Function: "function init() error('no') end function process() end"}))
+	assert.Same(t, first, Current())
+
+	assert.Nil(t, Reload(&config.FilterOptions{
+		BlockKeyPrefix:    []string{"a"},
+		Function:          "ARGV[2] = 'new_' .. ARGV[2] shake.call(DB, ARGV)",
+		FunctionTimeoutMs: 100,
+	}))
+	second := Current()
+	assert.NotEqual(t, first.Version, second.Version)
+	assert.Same(t, second.Function, currentRuntime.Load())
+	assert.Nil(t, Process(newTestEntry("SET", "a", "v")))
+	entries := Process(newTestEntry("SET", "tmp:1", "v"))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{"SET", "new_tmp:1", "v"}, entries[0].Argv)
+	}
+}
+
+func Test_rulesVersion(t *testing.T) {
+	a := rulesVersion(1, &config.FilterOptions{AllowDB: []int{0}})
+	assert.Equal(t, a, rulesVersion(1, &config.FilterOptions{AllowDB: []int{0}}))
+	assert.NotEqual(t, a, rulesVersion(1, &config.FilterOptions{AllowDB: []int{1}}))
+	assert.NotEqual(t, a, rulesVersion(2, &config.FilterOptions{AllowDB: []int{0}}))
+}
+
+func Test_Reload_bigKey(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "big_keys.txt")
+	opts := &config.FilterOptions{BigKeyRules: []string{"hash:elements:10"}, BigKeyReportFile: report}
+	assert.Nil(t, Reload(opts))
+	first := Current()
+	assert.False(t, first.Engine.Filter(newRdbEntry("hash", 10, 100, "hset", "a", "f", "v")))
+	assert.NotNil(t, first.Engine.bigKeyReport.file)
+
+	// the report of the replaced engine is closed, late writes do not keep it open
+	assert.Nil(t, Reload(opts))
+	assert.Nil(t, first.Engine.bigKeyReport.file)
+	assert.False(t, first.Engine.Filter(newRdbEntry("hash", 10, 100, "hset", "b", "f", "v")))
+	assert.Nil(t, first.Engine.bigKeyReport.file)
+	content, err := os.ReadFile(report)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), "\n"))
+
+	// the writers are built for the big key action
+	second := Current()
+	assert.NotNil(t, Reload(&config.FilterOptions{BigKeyRules: opts.BigKeyRules, BigKeyAction: BigKeyActionSlowLane}))
+	assert.Same(t, second, Current())
+}
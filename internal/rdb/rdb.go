@@ -16,6 +16,7 @@ import (
 	"redisFlutter/internal/rdb/structure"
 	"redisFlutter/internal/rdb/types"
 	"redisFlutter/internal/utils"
+	"redisFlutter/internal/utils/encrypt"
 )
 
 const (
@@ -64,6 +65,8 @@ type Loader struct {
 	rdbSize               *atomic.Int64
 	updateRdbFileSizeFunc func(int64)
 	entryCallback         func(*entry.Entry) //reuse single entry object memory
+
+	bigKeyLimits BigKeyLimitsFunc
 }
 
 func NewLoader(name string, filPath string) *Loader {
@@ -100,7 +103,12 @@ func (ld *Loader) ParseRDB(ctx context.Context) int {
 			log.Panicf("close file failed. file_path=[%s], error=[%s]", ld.filPath, err)
 		}
 	}()
-	rd := bufio.NewReader(ld.fp)
+	// the progress is the offset in the file, also when it is read decrypted
+	plain, err := encrypt.ConfigReader(ld.fp)
+	if err != nil {
+		log.Panicf("open rdb file failed. file_path=[%s], error=[%s]", ld.filPath, err)
+	}
+	rd := bufio.NewReader(plain)
 	// magic + version
 	buf := make([]byte, 9)
 	_, err = io.ReadFull(rd, buf)
@@ -157,6 +165,7 @@ func (ld *Loader) parseRDBEntry(ctx context.Context, rd *bufio.Reader) {
 
 			e.Reset()
 			e.Argv = append(e.Argv, "function", "load", function)
+			e.FromRdb = true
 			ld.entryCallback(e)
 		case kFlagModuleAux:
 			moduleId := structure.ReadLength(rd) // module id
@@ -198,6 +207,7 @@ func (ld *Loader) parseRDBEntry(ctx context.Context, rd *bufio.Reader) {
 				log.Debugf("[%s] LUA script: [%s]", ld.name, value)
 				e.Reset()
 				e.Argv = append(e.Argv, "script", "load", value)
+				e.FromRdb = true
 				ld.entryCallback(e)
 			} else {
 				log.Debugf("[%s] RDB AUX: key=[%s], value=[%s]", ld.name, key, value)
@@ -222,19 +232,22 @@ func (ld *Loader) parseRDBEntry(ctx context.Context, rd *bufio.Reader) {
 			return
 		default:
 			key := structure.ReadString(rd)
-			o := types.ParseObject(rd, typeByte, key)
+			valueRd := &countingReader{rd: rd}
+			o := types.ParseObject(valueRd, typeByte, key)
 			cmdC := o.Rewrite()
-			for cmd := range cmdC {
+			emit := func(cmd types.RedisCmd, info valueInfo) {
 				e.Reset()
 				e.DbId = ld.nowDBId
 				e.Argv = append(e.Argv, cmd...)
+				e.FromRdb = true
+				e.ValueType = info.valueType
+				e.ValueElements = info.elements
+				e.ValueBytes = info.bytes
 				ld.entryCallback(e)
 			}
+			info := ld.emitObject(valueInfo{valueType: types.TypeName(typeByte)}, cmdC, valueRd.n.Load, emit)
 			if ld.expireMs != 0 {
-				e.Reset()
-				e.DbId = ld.nowDBId
-				e.Argv = append(e.Argv, "PEXPIRE", key, strconv.FormatInt(ld.expireMs, 10))
-				ld.entryCallback(e)
+				emit(types.RedisCmd{"PEXPIRE", key, strconv.FormatInt(ld.expireMs, 10)}, info)
 			}
 			ld.expireMs = 0
 			ld.idle = 0
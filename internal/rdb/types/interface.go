@@ -21,6 +21,10 @@ const (
 	AuxType = "aux"
 	// DBSizeType is for _OPCODE_RESIZEDB
 	DBSizeType = "dbsize"
+	// StreamType is redis stream
+	StreamType = "stream"
+	// ModuleType is a value of a redis module
+	ModuleType = "module"
 )
 
 const (
@@ -108,6 +112,28 @@ func ParseObject(rd io.Reader, typeByte byte, key string) RedisObject {
 	return nil
 }
 
+// TypeName returns the redis type of an rdb value type byte, "" if it is unknown.
+func TypeName(typeByte byte) string {
+	switch typeByte {
+	case rdbTypeString:
+		return StringType
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return ListType
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return SetType
+	case rdbTypeZSet, rdbTypeZSet2, rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		return ZSetType
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack,
+		rdbTypeHashMetadataPreGa, rdbTypeHashListpackExPre, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+		return HashType
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return StreamType
+	case rdbTypeModule, rdbTypeModule2:
+		return ModuleType
+	}
+	return ""
+}
+
 func ModuleTypeNameByID(moduleId uint64) string {
 	nameList := make([]byte, 9)
 	moduleId >>= 10
@@ -0,0 +1,93 @@
+package rdb
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"redisFlutter/internal/rdb/types"
+)
+
+// countingReader counts the bytes of a value read from the rdb file. The value is
+// read by the Rewrite goroutine of the object while the loader reads the count.
+type countingReader struct {
+	rd io.Reader
+	n  atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// valueInfo is the type and size of a key, attached to all entries of the key.
+type valueInfo struct {
+	valueType string
+	elements  int64
+	bytes     int64
+}
+
+// elementsOf returns how many elements of the value a rewritten command carries.
+func elementsOf(cmd types.RedisCmd) int64 {
+	switch strings.ToLower(cmd[0]) {
+	case "del", "pexpire", "hpexpireat", "xsetid", "xgroup":
+		return 0
+	case "hset", "zadd":
+		return int64(len(cmd)-2) / 2
+	case "rpush", "sadd":
+		return int64(len(cmd) - 2)
+	}
+	return 1
+}
+
+// BigKeyLimitsFunc returns how many elements and bytes of a value of valueType are
+// measured at most, 0 when the measure is not needed.
+type BigKeyLimitsFunc func(valueType string) (maxElements int64, maxBytes int64)
+
+// SetBigKeyLimits makes the loader measure the element count and size of every key.
+// The commands of a key are held back until the key is read completely or both
+// limits of its type are reached, so all entries of a key carry the same value info.
+// limits is asked for every key, a change of the rules applies from the next key.
+func (ld *Loader) SetBigKeyLimits(limits BigKeyLimitsFunc) {
+	ld.bigKeyLimits = limits
+}
+
+// emitObject sends the commands of one key to emit with the value info attached.
+func (ld *Loader) emitObject(info valueInfo, cmdC <-chan types.RedisCmd, readBytes func() int64, emit func(types.RedisCmd, valueInfo)) valueInfo {
+	var maxElements, maxBytes int64
+	if ld.bigKeyLimits != nil {
+		maxElements, maxBytes = ld.bigKeyLimits(info.valueType)
+	}
+	if maxElements <= 0 && maxBytes <= 0 {
+		for cmd := range cmdC {
+			emit(cmd, info)
+		}
+		return info
+	}
+	var held []types.RedisCmd
+	reached := false
+	for cmd := range cmdC {
+		if reached {
+			emit(cmd, info)
+			continue
+		}
+		info.elements += elementsOf(cmd)
+		info.bytes = readBytes()
+		held = append(held, cmd)
+		if (maxElements <= 0 || info.elements >= maxElements) && (maxBytes <= 0 || info.bytes >= maxBytes) {
+			reached = true
+			for _, c := range held {
+				emit(c, info)
+			}
+			held = nil
+		}
+	}
+	if !reached {
+		info.bytes = readBytes()
+		for _, c := range held {
+			emit(c, info)
+		}
+	}
+	return info
+}
@@ -0,0 +1,88 @@
+package rdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/rdb/types"
+)
+
+func emitTest(ld *Loader, cmds []types.RedisCmd, bytes []int64) ([]valueInfo, valueInfo) {
+	cmdC := make(chan types.RedisCmd)
+	read := 0
+	go func() {
+		for _, cmd := range cmds {
+			cmdC <- cmd
+		}
+		close(cmdC)
+	}()
+	var emitted []valueInfo
+	info := ld.emitObject(valueInfo{valueType: types.HashType}, cmdC, func() int64 {
+		if read < len(bytes) {
+			read++
+		}
+		return bytes[read-1]
+	}, func(_ types.RedisCmd, info valueInfo) {
+		emitted = append(emitted, info)
+	})
+	return emitted, info
+}
+
+func Test_Loader_emitObject(t *testing.T) {
+	cmds := []types.RedisCmd{
+		{"del", "h"},
+		{"hset", "h", "f1", "v1"},
+		{"hset", "h", "f2", "v2", "f3", "v3"},
+		{"hset", "h", "f4", "v4"},
+	}
+	bytes := []int64{10, 20, 30, 40, 40}
+
+	// no limits, nothing is measured
+	ld := NewLoader("test", "")
+	emitted, info := emitTest(ld, cmds, bytes)
+	assert.Len(t, emitted, 4)
+	assert.Equal(t, valueInfo{valueType: types.HashType}, info)
+
+	// limit not reached, every entry has the final size
+	ld.SetBigKeyLimits(testLimits(100, 0))
+	emitted, info = emitTest(ld, cmds, bytes)
+	assert.Equal(t, valueInfo{valueType: types.HashType, elements: 4, bytes: 40}, info)
+	for _, got := range emitted {
+		assert.Equal(t, info, got)
+	}
+
+	// limit reached at the third command, every entry has the size at that point
+	ld.SetBigKeyLimits(testLimits(3, 0))
+	emitted, info = emitTest(ld, cmds, bytes)
+	assert.Len(t, emitted, 4)
+	assert.Equal(t, valueInfo{valueType: types.HashType, elements: 3, bytes: 30}, info)
+	for _, got := range emitted {
+		assert.Equal(t, info, got)
+	}
+
+	ld.SetBigKeyLimits(testLimits(0, 20))
+	_, info = emitTest(ld, cmds, bytes)
+	assert.Equal(t, valueInfo{valueType: types.HashType, elements: 1, bytes: 20}, info)
+
+	// both limits must be reached, the element limit does not stop measuring bytes
+	ld.SetBigKeyLimits(testLimits(1, 30))
+	_, info = emitTest(ld, cmds, bytes)
+	assert.Equal(t, valueInfo{valueType: types.HashType, elements: 3, bytes: 30}, info)
+
+	// the limits are of the type of the key
+	ld.SetBigKeyLimits(func(valueType string) (int64, int64) {
+		if valueType == types.HashType {
+			return 0, 0
+		}
+		return 1, 0
+	})
+	_, info = emitTest(ld, cmds, bytes)
+	assert.Equal(t, valueInfo{valueType: types.HashType}, info)
+}
+
+func testLimits(maxElements int64, maxBytes int64) BigKeyLimitsFunc {
+	return func(string) (int64, int64) {
+		return maxElements, maxBytes
+	}
+}
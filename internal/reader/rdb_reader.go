@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"redisFlutter/internal/entry"
+	"redisFlutter/internal/filter"
 	"redisFlutter/internal/log"
 	"redisFlutter/internal/rdb"
 	"redisFlutter/internal/utils"
@@ -52,6 +53,10 @@ func (r *rdbReader) StartRead(ctx context.Context) []chan *entry.Entry {
 	}
 	rdbLoader := rdb.NewLoader(r.stat.Name, r.stat.Filepath)
 	rdbLoader.SetParseSizeUpdateFunc(updateFunc)
+	// asked for every key, so the rules of a reload are measured too
+	rdbLoader.SetBigKeyLimits(func(valueType string) (int64, int64) {
+		return filter.Default().BigKeyLimits(valueType)
+	})
 	rdbLoader.SetEntryCallback(func(e *entry.Entry) {
 		r.ch <- e
 	})
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/dustin/go-humanize"
 	"io"
 	"os"
 	"path/filepath"
+	"redisFlutter/internal/aofStorage"
 	"redisFlutter/internal/client"
 	"redisFlutter/internal/config"
 	"redisFlutter/internal/log"
 	"redisFlutter/internal/utils"
+	"redisFlutter/internal/utils/encrypt"
 	rotate "redisFlutter/internal/utils/file_rotate"
 	"runtime"
 	"strconv"
@@ -66,6 +69,7 @@ type syncStandaloneReaderStat struct {
 	// aof info
 	AofReceivedOffset int64  `json:"aof_received_offset"` // offset of AOF received from master
 	AofSentOffset     int64  `json:"aof_sent_offset"`     // offset of AOF sent to chan
+	AofSyncedOffset   int64  `json:"aof_synced_offset"`   // offset of AOF fsynced to file
 	AofReceivedBytes  uint64 `json:"aof_received_bytes"`  // bytes of AOF received from master
 	AofReceivedHuman  string `json:"aof_received_human"`
 }
@@ -104,6 +108,13 @@ type StandaloneReader struct {
 
 func NewStandaloneReader(ctx context.Context, opts *SyncReaderOptions) (*StandaloneReader, error) {
 	var err error
+	// nothing in the reader consumes the aof storage, only the retention deletes batches,
+	// without a size retention appends could wait on aof_storage_max_bytes forever
+	advanced := config.Opt.Advanced
+	if advanced.AofStorage == aofStorage.StorageBadger && advanced.AofStorageMaxBytes > 0 &&
+		(advanced.AofRetentionMaxBytes <= 0 || advanced.AofRetentionMaxBytes >= advanced.AofStorageMaxBytes) {
+		return nil, errors.New("aof_storage_max_bytes needs a smaller aof_retention_max_bytes in the reader")
+	}
 	c := new(StandaloneReader)
 	c.opts = opts
 	//c.aofStorage = aofStorage
@@ -332,14 +343,18 @@ func (r *StandaloneReader) receiveRDB() string {
 	if err != nil {
 		log.Panicf(err.Error())
 	}
+	rdbWriter, err := encrypt.ConfigWriter(rdbFileHandle)
+	if err != nil {
+		log.Panicf(err.Error())
+	}
 
 	// receive rdb
 	r.stat.Status = kReceiveRdb
 	if strings.HasPrefix(marker, "EOF") {
 		log.Infof("[%s] source db supoort diskless sync capability.", r.stat.Name)
-		r.receiveRDBWithDiskless(marker, rdbFileHandle)
+		r.receiveRDBWithDiskless(marker, rdbWriter)
 	} else {
-		r.receiveRDBWithoutDiskless(marker, rdbFileHandle)
+		r.receiveRDBWithoutDiskless(marker, rdbWriter)
 	}
 	err = rdbFileHandle.Close()
 	if err != nil {
@@ -427,8 +442,20 @@ func (r *StandaloneReader) receiveRDBWithoutDiskless(marker string, wt io.Writer
 
 func (r *StandaloneReader) receiveAOF() {
 	log.Debugf("[%s] start receiving aof data, and save to file", r.stat.Name)
-	aofWriter := rotate.NewAOFWriter(r.stat.Name, r.stat.Dir, r.stat.AofReceivedOffset)
-	defer aofWriter.Close()
+	storage, err := aofStorage.NewStorage(r.stat.Name, r.stat.Dir, rotate.MaxFileSize)
+	if err != nil {
+		log.Panicf("[%s] open aof storage failed. error=[%v]", r.stat.Name, err)
+	}
+	defer storage.Close()
+	// the aof goes on from the rdb just received, what is stored is from an older sync
+	if err = storage.TruncateBefore(storage.NextSeq()); err != nil {
+		log.Panicf("[%s] truncate aof storage failed. error=[%v]", r.stat.Name, err)
+	}
+	// every reconnect receives the aof again, the retention runs while it does
+	stopRetention := aofStorage.RunRetention(r.ctx, r.stat.Name, storage, rotate.ConfigRetentionPolicy())
+	defer stopRetention()
+	aofWriter := aofStorage.NewStorageWriter(storage)
+	baseOffset := r.stat.AofReceivedOffset
 
 	//once := new(sync.Once)
 	buf := make([]byte, 16*1024) // 16KB is enough for writing file
@@ -443,8 +470,11 @@ func (r *StandaloneReader) receiveAOF() {
 			}
 			r.stat.AofReceivedBytes += uint64(n)
 			//log.Debugf("[%s] receiving aof data len = %d", r.stat.Name, n)
-			aofWriter.Write(buf[:n])
+			if _, err = aofWriter.Write(buf[:n]); err != nil {
+				log.Panicf("[%s] write aof storage failed. error=[%v]", r.stat.Name, err)
+			}
 			r.stat.AofReceivedOffset += int64(n)
+			r.stat.AofSyncedOffset = baseOffset + storage.Synced()
 		}
 	}
 }
@@ -458,8 +488,13 @@ func (r *StandaloneReader) sendReplconfAck() {
 		case <-r.ctx.Done():
 			return
 		case <-ticker.C:
-			if r.stat.AofReceivedOffset != 0 {
-				r.client.Send("replconf", "ack", strconv.FormatInt(r.stat.AofReceivedOffset, 10))
+			offset := r.stat.AofReceivedOffset
+			if config.Opt.Advanced.AofFsync == rotate.FsyncAlways {
+				// only acknowledge what survives a power loss
+				offset = r.stat.AofSyncedOffset
+			}
+			if offset != 0 {
+				r.client.Send("replconf", "ack", strconv.FormatInt(offset, 10))
 			}
 		}
 	}
@@ -38,11 +38,23 @@ func Handler(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+var extraHandlers = make(map[string]http.HandlerFunc)
+
+// RegisterHandler adds a handler to the status http server, it must be called before Init.
+func RegisterHandler(pattern string, handler http.HandlerFunc) {
+	extraHandlers[pattern] = handler
+}
+
 func setStatusPort() {
 	if config.Opt.Advanced.StatusPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", Handler)
+		for pattern, handler := range extraHandlers {
+			mux.HandleFunc(pattern, handler)
+		}
 		go func() {
 			addr := fmt.Sprintf(":%d", config.Opt.Advanced.StatusPort)
-			if err := http.ListenAndServe(addr, http.HandlerFunc(Handler)); err != nil {
+			if err := http.ListenAndServe(addr, mux); err != nil {
 				log.Panicf(err.Error())
 			}
 		}()
@@ -13,6 +13,8 @@ type Statusable interface {
 type Stat struct {
 	Time       string `json:"start_time"`
 	Consistent bool   `json:"consistent"`
+	// version of the filter and function rules in use, changes on reload
+	FilterVersion string `json:"filter_version,omitempty"`
 	// function
 	TotalEntriesCount  EntryCount            `json:"total_entries_count"`
 	PerCmdEntriesCount map[string]EntryCount `json:"per_cmd_entries_count"`
@@ -53,6 +55,12 @@ func AddWriteCount(cmd string) {
 	}
 }
 
+func SetFilterVersion(version string) {
+	ch <- func() {
+		stat.FilterVersion = version
+	}
+}
+
 func Init(r Statusable, w Statusable) {
 	theReader = r
 	theWriter = w
@@ -0,0 +1,201 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+)
+
+// DbMapper moves entries from their source db to a target db. With flatten, every
+// db goes to target db0 and the keys get the prefix "db<n>:" so dbs do not collide.
+// The owner of the entry stream calls Map on each entry, before the filters, slot
+// calculation and the lua function when those should see the remapped db and keys.
+type DbMapper struct {
+	dbMap   map[int]int
+	flatten bool
+}
+
+// NewDbMapper returns nil when nothing is remapped, a nil *DbMapper passes entries through.
+func NewDbMapper(opts *config.TransformOptions) *DbMapper {
+	if len(opts.DbMap) == 0 && !opts.FlattenDb {
+		return nil
+	}
+	m := &DbMapper{
+		dbMap:   make(map[int]int),
+		flatten: opts.FlattenDb,
+	}
+	for _, item := range opts.DbMap {
+		src, dst, ok := strings.Cut(item, ":")
+		srcDb, err1 := strconv.Atoi(strings.TrimSpace(src))
+		dstDb, err2 := strconv.Atoi(strings.TrimSpace(dst))
+		if !ok || err1 != nil || err2 != nil || srcDb < 0 || dstDb < 0 {
+			log.Panicf("invalid db_map item: [%s], should be like \"1:0\"", item)
+		}
+		if _, exist := m.dbMap[srcDb]; exist {
+			log.Panicf("db %d is mapped more than once in db_map", srcDb)
+		}
+		m.dbMap[srcDb] = dstDb
+	}
+	log.Infof("db mapper enabled. db_map=%v, flatten_db=%v", m.dbMap, m.flatten)
+	return m
+}
+
+func (m *DbMapper) mapDb(db int) int {
+	if dst, ok := m.dbMap[db]; ok {
+		return dst
+	}
+	return db
+}
+
+func (m *DbMapper) targetDb(db int) int {
+	if m.flatten {
+		return 0
+	}
+	return m.mapDb(db)
+}
+
+func keyPrefix(db int) string {
+	return fmt.Sprintf("db%d:", db)
+}
+
+// Map returns the entries to send in place of e, nil if e can not be expressed on the target.
+func (m *DbMapper) Map(e *entry.Entry) []*entry.Entry {
+	if m == nil {
+		return []*entry.Entry{e}
+	}
+	if e.CmdName == "" {
+		e.Parse()
+	}
+	db := m.mapDb(e.DbId)
+	switch e.CmdName {
+	case "SELECT":
+		e.DbId = m.targetDb(e.DbId)
+		if len(e.Argv) == 2 {
+			if selected, err := strconv.Atoi(e.Argv[1]); err == nil {
+				e.Argv[1] = strconv.Itoa(m.targetDb(selected))
+			}
+		}
+		return []*entry.Entry{e}
+	case "MOVE":
+		return m.mapMove(e, db)
+	case "COPY":
+		return m.mapCopy(e, db)
+	case "SWAPDB":
+		return m.mapSwapDb(e)
+	case "FLUSHDB":
+		if m.flatten {
+			log.Warnf("FLUSHDB can not be replayed when flatten_db is on, it would flush all dbs of target. cmd=[%s]", e.String())
+			return nil
+		}
+	}
+	e.DbId = m.targetDb(e.DbId)
+	if m.flatten {
+		prefix := keyPrefix(db)
+		e.RewriteKeys(func(key string) string {
+			return prefix + key
+		})
+	}
+	return []*entry.Entry{e}
+}
+
+// MOVE key db => MOVE key mapped_db, or RENAMENX db<a>:key db<b>:key when flatten. The
+// prefixed keys are in one slot only when key has a hashtag, else the RENAMENX would
+// fail with CROSSSLOT on a cluster target and MOVE is dropped.
+func (m *DbMapper) mapMove(e *entry.Entry, db int) []*entry.Entry {
+	if len(e.Argv) != 3 {
+		return []*entry.Entry{e}
+	}
+	dstDb, err := strconv.Atoi(e.Argv[2])
+	if err != nil {
+		log.Warnf("MOVE with invalid db, dropped. cmd=[%s]", e.String())
+		return nil
+	}
+	if !m.flatten {
+		e.DbId = db
+		e.Argv[2] = strconv.Itoa(m.mapDb(dstDb))
+		return []*entry.Entry{e}
+	}
+	key := e.Argv[1]
+	argv := []string{"RENAMENX", keyPrefix(db) + key, keyPrefix(m.mapDb(dstDb)) + key}
+	return dropCrossSlot(e, newEntry(e, 0, argv))
+}
+
+// COPY src dst [DB n] [REPLACE] => DB n is mapped, or dropped when flatten and the
+// destination key gets the prefix of db n. Like MOVE, a COPY whose prefixed keys are
+// in different slots is dropped.
+func (m *DbMapper) mapCopy(e *entry.Entry, db int) []*entry.Entry {
+	if len(e.Argv) < 3 {
+		return []*entry.Entry{e}
+	}
+	dstDb := db
+	dbIndex := -1
+	for inx := 3; inx+1 < len(e.Argv); inx++ {
+		if strings.ToUpper(e.Argv[inx]) == "DB" {
+			selected, err := strconv.Atoi(e.Argv[inx+1])
+			if err != nil {
+				log.Warnf("COPY with invalid db, dropped. cmd=[%s]", e.String())
+				return nil
+			}
+			dstDb = m.mapDb(selected)
+			dbIndex = inx
+			break
+		}
+	}
+	if !m.flatten {
+		e.DbId = db
+		if dbIndex >= 0 {
+			e.Argv[dbIndex+1] = strconv.Itoa(dstDb)
+		}
+		return []*entry.Entry{e}
+	}
+	argv := []string{e.Argv[0], keyPrefix(db) + e.Argv[1], keyPrefix(dstDb) + e.Argv[2]}
+	for inx := 3; inx < len(e.Argv); inx++ {
+		if inx == dbIndex {
+			inx++
+			continue
+		}
+		argv = append(argv, e.Argv[inx])
+	}
+	return dropCrossSlot(e, newEntry(e, 0, argv))
+}
+
+// dropCrossSlot returns mapped, or nil when its keys are in different slots. Flatten
+// is meant for cluster targets, which reject such commands.
+func dropCrossSlot(from *entry.Entry, mapped *entry.Entry) []*entry.Entry {
+	for _, slot := range mapped.Slots {
+		if slot != mapped.Slots[0] {
+			log.Warnf("%s can not be replayed when flatten_db is on, the prefixed keys are in different slots, dropped. "+
+				"use a hashtag in the key to keep it. cmd=[%s]", from.CmdName, from.String())
+			return nil
+		}
+	}
+	return []*entry.Entry{mapped}
+}
+
+// SWAPDB a b => SWAPDB mapped_a mapped_b, dropped when flatten
+func (m *DbMapper) mapSwapDb(e *entry.Entry) []*entry.Entry {
+	if m.flatten {
+		log.Warnf("SWAPDB can not be replayed when flatten_db is on, dropped. cmd=[%s]", e.String())
+		return nil
+	}
+	e.DbId = m.mapDb(e.DbId)
+	for inx := 1; inx < len(e.Argv) && inx <= 2; inx++ {
+		if selected, err := strconv.Atoi(e.Argv[inx]); err == nil {
+			e.Argv[inx] = strconv.Itoa(m.mapDb(selected))
+		}
+	}
+	return []*entry.Entry{e}
+}
+
+func newEntry(from *entry.Entry, db int, argv []string) *entry.Entry {
+	e := entry.NewEntry()
+	e.DbId = db
+	e.FromRdb = from.FromRdb
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
@@ -0,0 +1,82 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/commands"
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+)
+
+func newTestEntry(db int, argv ...string) *entry.Entry {
+	e := entry.NewEntry()
+	e.DbId = db
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
+
+func Test_DbMapper_off(t *testing.T) {
+	m := NewDbMapper(&config.TransformOptions{})
+	assert.Nil(t, m)
+	ret := m.Map(newTestEntry(3, "SET", "k", "v"))
+	assert.Equal(t, 3, ret[0].DbId)
+	assert.Equal(t, []string{"SET", "k", "v"}, ret[0].Argv)
+}
+
+func Test_DbMapper_map(t *testing.T) {
+	m := NewDbMapper(&config.TransformOptions{DbMap: []string{"1:0", "2:5"}})
+
+	ret := m.Map(newTestEntry(1, "SET", "k", "v"))
+	assert.Equal(t, 0, ret[0].DbId)
+	assert.Equal(t, []string{"SET", "k", "v"}, ret[0].Argv)
+
+	ret = m.Map(newTestEntry(3, "SET", "k", "v"))
+	assert.Equal(t, 3, ret[0].DbId)
+
+	ret = m.Map(newTestEntry(2, "SELECT", "2"))
+	assert.Equal(t, 5, ret[0].DbId)
+	assert.Equal(t, []string{"SELECT", "5"}, ret[0].Argv)
+
+	ret = m.Map(newTestEntry(1, "MOVE", "k", "2"))
+	assert.Equal(t, 0, ret[0].DbId)
+	assert.Equal(t, []string{"MOVE", "k", "5"}, ret[0].Argv)
+
+	ret = m.Map(newTestEntry(0, "COPY", "a", "b", "DB", "1", "REPLACE"))
+	assert.Equal(t, []string{"COPY", "a", "b", "DB", "0", "REPLACE"}, ret[0].Argv)
+
+	ret = m.Map(newTestEntry(0, "SWAPDB", "1", "2"))
+	assert.Equal(t, []string{"SWAPDB", "0", "5"}, ret[0].Argv)
+}
+
+func Test_DbMapper_flatten(t *testing.T) {
+	m := NewDbMapper(&config.TransformOptions{DbMap: []string{"2:5"}, FlattenDb: true})
+
+	ret := m.Map(newTestEntry(2, "MSET", "a", "1", "b", "2"))
+	assert.Equal(t, 0, ret[0].DbId)
+	assert.Equal(t, []string{"MSET", "db5:a", "1", "db5:b", "2"}, ret[0].Argv)
+	assert.Equal(t, []string{"db5:a", "db5:b"}, ret[0].Keys)
+	assert.Equal(t, commands.CalcSlots([]string{"db5:a", "db5:b"}), ret[0].Slots)
+
+	ret = m.Map(newTestEntry(0, "EVAL", "return 1", "1", "k", "arg"))
+	assert.Equal(t, []string{"EVAL", "return 1", "1", "db0:k", "arg"}, ret[0].Argv)
+
+	ret = m.Map(newTestEntry(3, "SELECT", "3"))
+	assert.Equal(t, 0, ret[0].DbId)
+	assert.Equal(t, []string{"SELECT", "0"}, ret[0].Argv)
+
+	// MOVE and COPY keep their keys in one slot only with a hashtag
+	ret = m.Map(newTestEntry(1, "MOVE", "{k}", "2"))
+	assert.Equal(t, []string{"RENAMENX", "db1:{k}", "db5:{k}"}, ret[0].Argv)
+	assert.Equal(t, []string{"db1:{k}", "db5:{k}"}, ret[0].Keys)
+	assert.Nil(t, m.Map(newTestEntry(1, "MOVE", "k", "2")))
+
+	ret = m.Map(newTestEntry(1, "COPY", "{t}a", "{t}b", "DB", "2", "REPLACE"))
+	assert.Equal(t, []string{"COPY", "db1:{t}a", "db5:{t}b", "REPLACE"}, ret[0].Argv)
+	assert.Nil(t, m.Map(newTestEntry(1, "COPY", "a", "b", "DB", "2", "REPLACE")))
+
+	assert.Nil(t, m.Map(newTestEntry(1, "SWAPDB", "1", "2")))
+	assert.Nil(t, m.Map(newTestEntry(1, "FLUSHDB")))
+}
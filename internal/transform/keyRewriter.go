@@ -0,0 +1,58 @@
+package transform
+
+import (
+	"strings"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+)
+
+type prefixRule struct {
+	from string
+	to   string
+}
+
+// KeyRewriter renames the keys of entries by declarative prefix rules. Keys are
+// found by entry.KeyIndexes, so keys behind keywords or numkeys (XREAD STREAMS,
+// ZUNIONSTORE, EVAL) are rewritten too, and Slots are recomputed.
+type KeyRewriter struct {
+	replace   []prefixRule
+	addPrefix string
+}
+
+// NewKeyRewriter returns nil when there are no rules, a nil *KeyRewriter passes entries through.
+func NewKeyRewriter(opts *config.TransformOptions) *KeyRewriter {
+	if len(opts.KeyReplacePrefix) == 0 && opts.KeyAddPrefix == "" {
+		return nil
+	}
+	r := &KeyRewriter{addPrefix: opts.KeyAddPrefix}
+	for _, item := range opts.KeyReplacePrefix {
+		from, to, ok := strings.Cut(item, "=>")
+		if !ok || from == "" {
+			log.Panicf("invalid key_replace_prefix item: [%s], should be like \"old:=>new:\"", item)
+		}
+		r.replace = append(r.replace, prefixRule{from: from, to: to})
+	}
+	log.Infof("key rewriter enabled. key_replace_prefix=%v, key_add_prefix=[%s]", opts.KeyReplacePrefix, opts.KeyAddPrefix)
+	return r
+}
+
+// RewriteKey returns the new name of key.
+func (r *KeyRewriter) RewriteKey(key string) string {
+	for _, rule := range r.replace {
+		if strings.HasPrefix(key, rule.from) {
+			key = rule.to + key[len(rule.from):]
+			break
+		}
+	}
+	return r.addPrefix + key
+}
+
+func (r *KeyRewriter) Rewrite(e *entry.Entry) *entry.Entry {
+	if r == nil {
+		return e
+	}
+	e.RewriteKeys(r.RewriteKey)
+	return e
+}
@@ -0,0 +1,49 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/commands"
+	"redisFlutter/internal/config"
+)
+
+func Test_KeyRewriter(t *testing.T) {
+	r := NewKeyRewriter(&config.TransformOptions{
+		KeyReplacePrefix: []string{"old:=>new:", "o=>x"},
+		KeyAddPrefix:     "tenantA:",
+	})
+	assert.Equal(t, "tenantA:new:1", r.RewriteKey("old:1"))
+	assert.Equal(t, "tenantA:xld", r.RewriteKey("old"))
+	assert.Equal(t, "tenantA:k", r.RewriteKey("k"))
+
+	cases := []struct {
+		argv     []string
+		expected []string
+	}{
+		{[]string{"SET", "old:a", "old:v"}, []string{"SET", "tenantA:new:a", "old:v"}},
+		{[]string{"MSET", "a", "1", "b", "2"}, []string{"MSET", "tenantA:a", "1", "tenantA:b", "2"}},
+		{[]string{"XREAD", "COUNT", "2", "STREAMS", "s1", "s2", "0", "0"},
+			[]string{"XREAD", "COUNT", "2", "STREAMS", "tenantA:s1", "tenantA:s2", "0", "0"}},
+		{[]string{"ZUNIONSTORE", "dst", "2", "z1", "z2", "WEIGHTS", "1", "2"},
+			[]string{"ZUNIONSTORE", "tenantA:dst", "2", "tenantA:z1", "tenantA:z2", "WEIGHTS", "1", "2"}},
+		{[]string{"EVAL", "return 1", "2", "k1", "k2", "arg"},
+			[]string{"EVAL", "return 1", "2", "tenantA:k1", "tenantA:k2", "arg"}},
+	}
+	for _, c := range cases {
+		e := r.Rewrite(newTestEntry(0, c.argv...))
+		assert.Equal(t, c.expected, e.Argv)
+		assert.Equal(t, commands.CalcSlots(e.Keys), e.Slots)
+		for _, key := range e.Keys {
+			assert.Contains(t, key, "tenantA:")
+		}
+	}
+}
+
+func Test_KeyRewriter_off(t *testing.T) {
+	r := NewKeyRewriter(&config.TransformOptions{})
+	assert.Nil(t, r)
+	e := r.Rewrite(newTestEntry(0, "SET", "k", "v"))
+	assert.Equal(t, []string{"SET", "k", "v"}, e.Argv)
+}
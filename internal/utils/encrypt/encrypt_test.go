@@ -0,0 +1,280 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func testKey(t *testing.T) string {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func testRing(t *testing.T, keys ...string) *KeyRing {
+	text := ""
+	for _, key := range keys {
+		text += key + "\n"
+	}
+	ring, err := ParseKeyRing(text)
+	assert.Nil(t, err)
+	return ring
+}
+
+func testPlain(size int) []byte {
+	p := make([]byte, size)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return p
+}
+
+// writeTestFile writes plain to a new encrypted file in pieces of step bytes.
+func writeTestFile(t *testing.T, path string, ring *KeyRing, plain []byte, step int) {
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	w, err := NewWriter(file, ring)
+	assert.Nil(t, err)
+	for i := 0; i < len(plain); i += step {
+		n, err := w.Write(plain[i:min(i+step, len(plain))])
+		assert.Nil(t, err)
+		assert.Equal(t, min(step, len(plain)-i), n)
+	}
+}
+
+func readTestFile(t *testing.T, path string, ring *KeyRing) []byte {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	r, err := NewReader(file, ring)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return data
+}
+
+func Test_ParseKeyRing(t *testing.T) {
+	key := make([]byte, KeySize)
+	ring, err := ParseKeyRing("# keys\n\n" + hex.EncodeToString(key) + " , " + testKey(t))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ring.Keys()))
+	assert.Equal(t, key, ring.Current())
+
+	for _, text := range []string{"", "# none", "abc", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		_, err = ParseKeyRing(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func Test_ConfigKeyRing(t *testing.T) {
+	ring, err := ConfigKeyRing()
+	assert.Nil(t, err)
+	assert.Nil(t, ring)
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	assert.Nil(t, os.WriteFile(keyFile, []byte(testKey(t)+"\n"), 0600))
+	t.Setenv("TEST_ENCRYPTION_KEY", testKey(t))
+	config.Opt.Advanced.EncryptionKeyFile = keyFile
+	config.Opt.Advanced.EncryptionKeyEnv = "TEST_ENCRYPTION_KEY"
+	defer func() {
+		config.Opt.Advanced.EncryptionKeyFile = ""
+		config.Opt.Advanced.EncryptionKeyEnv = ""
+	}()
+	ring, err = ConfigKeyRing()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ring.Keys()))
+
+	config.Opt.Advanced.EncryptionKeyEnv = "TEST_ENCRYPTION_KEY_NOT_SET"
+	_, err = ConfigKeyRing()
+	assert.NotNil(t, err)
+}
+
+func Test_ReadWrite(t *testing.T) {
+	ring := testRing(t, testKey(t))
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, 100, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		for _, step := range []int{7, 4096, ChunkSize * 2} {
+			path := filepath.Join(dir, "test")
+			plain := testPlain(size)
+			writeTestFile(t, path, ring, plain, step)
+			assert.True(t, IsEncryptedFile(path))
+			assert.Equal(t, plain[:size], readTestFile(t, path, ring)[:size])
+			plainSize, err := PlainSize(path)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(size), plainSize)
+		}
+	}
+
+	// another key can not decrypt, a changed byte is detected
+	path := filepath.Join(dir, "test")
+	writeTestFile(t, path, ring, testPlain(1000), 100)
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	_, err = NewReader(file, testRing(t, testKey(t)))
+	assert.NotNil(t, err)
+	_, err = NewReader(file, nil)
+	assert.ErrorIs(t, err, ErrNoKey)
+	file.Close()
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[HeaderSize+ChunkOverhead+50] ^= 1
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+	file, err = os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	r, err := NewReader(file, ring)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func Test_Reader_follow(t *testing.T) {
+	ring := testRing(t, testKey(t))
+	path := filepath.Join(t.TempDir(), "test")
+	writer, err := os.Create(path)
+	assert.Nil(t, err)
+	defer writer.Close()
+	w, err := NewWriter(writer, ring)
+	assert.Nil(t, err)
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	r, err := NewReader(file, ring)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 100)
+	_, err = r.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	n, err := r.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	// a chunk written in two parts is read once it is complete
+	sealed, err := w.sealer.seal([]byte("world"), w.sealer.chunks)
+	assert.Nil(t, err)
+	_, err = writer.Write(sealed[:10])
+	assert.Nil(t, err)
+	info, _ := writer.Stat()
+	assert.False(t, r.Complete(info.Size()))
+	_, err = r.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = writer.Write(sealed[10:])
+	assert.Nil(t, err)
+	info, _ = writer.Stat()
+	assert.True(t, r.Complete(info.Size()))
+	n, err = r.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	assert.Equal(t, info.Size(), r.RawOffset())
+}
+
+func Test_Reader_seek(t *testing.T) {
+	ring := testRing(t, testKey(t))
+	path := filepath.Join(t.TempDir(), "test")
+	plain := testPlain(3*ChunkSize + 100)
+	writeTestFile(t, path, ring, plain, 1000)
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	r, err := NewReader(file, ring)
+	assert.Nil(t, err)
+
+	for _, offset := range []int64{5000, 0, ChunkSize, 999, 1000, int64(len(plain)) - 1, int64(len(plain))} {
+		pos, err := r.Seek(offset, io.SeekStart)
+		assert.Nil(t, err)
+		assert.Equal(t, offset, pos)
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, plain[offset:], data)
+	}
+	_, err = r.Seek(int64(len(plain))+1, io.SeekStart)
+	assert.NotNil(t, err)
+}
+
+func Test_Truncate(t *testing.T) {
+	ring := testRing(t, testKey(t))
+	path := filepath.Join(t.TempDir(), "test")
+	plain := testPlain(5000)
+	for _, size := range []int64{5000, 4999, 3000, 2500, 1, 0} {
+		writeTestFile(t, path, ring, plain, 1000)
+		assert.Nil(t, Truncate(path, size, ring))
+		assert.Equal(t, plain[:size], readTestFile(t, path, ring)[:size])
+		plainSize, err := PlainSize(path)
+		assert.Nil(t, err)
+		assert.Equal(t, size, plainSize)
+
+		// appends go on after the cut
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		assert.Nil(t, err)
+		w, err := OpenAppend(file, ring)
+		assert.Nil(t, err)
+		_, err = w.Write(plain[size:])
+		assert.Nil(t, err)
+		file.Close()
+		assert.Equal(t, plain, readTestFile(t, path, ring))
+	}
+
+	// a torn chunk is cut
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("torn"))
+	assert.Nil(t, err)
+	file.Close()
+	assert.Nil(t, Truncate(path, 5000, ring))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.HasSuffix(data, []byte("torn")))
+	assert.Equal(t, plain, readTestFile(t, path, ring))
+}
+
+func Test_Rewrap(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	dir := t.TempDir()
+	plain := testPlain(10000)
+	writeTestFile(t, filepath.Join(dir, "a"), testRing(t, oldKey), plain, 3000)
+	writeTestFile(t, filepath.Join(dir, "b"), testRing(t, newKey), plain, 3000)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "plain"), plain, 0644))
+
+	rotated := testRing(t, newKey, oldKey)
+	count, err := RewrapDir(dir, rotated)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, err = RewrapDir(dir, rotated)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// the old key is no longer needed
+	ring := testRing(t, newKey)
+	assert.Equal(t, plain, readTestFile(t, filepath.Join(dir, "a"), ring))
+	assert.Equal(t, plain, readTestFile(t, filepath.Join(dir, "b"), ring))
+
+	// files of an unknown key are left alone, failed files do not stop the others
+	writeTestFile(t, filepath.Join(dir, "c"), testRing(t, testKey(t)), plain, 3000)
+	writeTestFile(t, filepath.Join(dir, "d"), testRing(t, oldKey), plain, 3000)
+	writeTestFile(t, filepath.Join(dir, "e"), testRing(t, oldKey), plain, 3000)
+	file, err := os.OpenFile(filepath.Join(dir, "d"), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte{0xff, 0xff}, HeaderSize-2)
+	assert.Nil(t, err)
+	file.Close()
+	count, err = RewrapDir(dir, rotated)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.NotErrorIs(t, err, ErrUnknownKey)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, plain, readTestFile(t, filepath.Join(dir, "e"), ring))
+}
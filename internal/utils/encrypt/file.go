@@ -0,0 +1,574 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// An encrypted file is a header and chunks:
+//
+//	header: magic[8] keyID[8] nonce[12] wrappedDataKey[48]
+//	chunk:  length[4] nonce[12] ciphertext[length+16]
+//
+// The data key of the file is random and wrapped by a master key with AES-256-GCM, a
+// rotation of the master key only rewrites the header. Chunks are sealed with the data
+// key, a random nonce and the chunk index as additional data, length is the plaintext
+// length. Chunks are found by their lengths, so a reader seeks without decrypting and
+// follows a file that is appended to.
+
+// ChunkSize is the largest plaintext of a chunk.
+const ChunkSize = 64 << 10
+
+const (
+	nonceSize     = 12
+	tagSize       = 16
+	HeaderSize    = 8 + 8 + nonceSize + KeySize + tagSize
+	chunkHeadSize = 4 + nonceSize
+	// ChunkOverhead is what a chunk adds to its plaintext.
+	ChunkOverhead = chunkHeadSize + tagSize
+)
+
+var magic = []byte("RFENC001")
+
+var (
+	ErrNoKey      = errors.New("file is encrypted and no encryption key is configured")
+	ErrCorrupt    = errors.New("encrypted file is corrupt")
+	ErrUnknownKey = errors.New("master key of the file is not in the key ring")
+)
+
+// IsEncrypted tells whether r starts with the header of an encrypted file.
+func IsEncrypted(r io.ReaderAt) bool {
+	buf := make([]byte, len(magic))
+	n, _ := r.ReadAt(buf, 0)
+	return n == len(magic) && bytes.Equal(buf, magic)
+}
+
+// IsEncryptedFile tells whether the file at path is encrypted.
+func IsEncryptedFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return IsEncrypted(file)
+}
+
+func (r *KeyRing) wrap(dataKey []byte) ([]byte, error) {
+	key := r.keys[0]
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, key.id[:]...)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return key.aead.Seal(header, nonce, dataKey, header[:len(magic)+8]), nil
+}
+
+func (r *KeyRing) unwrap(header []byte) ([]byte, *masterKey, error) {
+	if len(header) != HeaderSize || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, nil, fmt.Errorf("%w: invalid header", ErrCorrupt)
+	}
+	if r == nil {
+		return nil, nil, ErrNoKey
+	}
+	id := header[len(magic) : len(magic)+8]
+	key := r.find(id)
+	if key == nil {
+		return nil, nil, fmt.Errorf("%w: %x", ErrUnknownKey, id)
+	}
+	nonce := header[len(magic)+8 : len(magic)+8+nonceSize]
+	dataKey, err := key.aead.Open(nil, nonce, header[len(magic)+8+nonceSize:], header[:len(magic)+8])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: unwrap data key: %v", ErrCorrupt, err)
+	}
+	return dataKey, key, nil
+}
+
+func chunkAAD(index uint64) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, index)
+	return aad
+}
+
+// Writer encrypts what is written to it, every Write is sealed right away in chunks
+// of at most ChunkSize, nothing is buffered.
+type Writer struct {
+	w      io.Writer
+	sealer *chunkSealer
+}
+
+type chunkSealer struct {
+	aead   cipher.AEAD
+	chunks uint64 // index of the next chunk
+	buf    []byte
+}
+
+func newChunkSealer(dataKey []byte, chunks uint64) (*chunkSealer, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkSealer{aead: aead, chunks: chunks}, nil
+}
+
+// seal returns chunk index sealing plaintext p, valid until the next seal.
+func (s *chunkSealer) seal(p []byte, index uint64) ([]byte, error) {
+	s.buf = append(s.buf[:0], make([]byte, chunkHeadSize)...)
+	binary.BigEndian.PutUint32(s.buf, uint32(len(p)))
+	nonce := s.buf[4:chunkHeadSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.buf = s.aead.Seal(s.buf, nonce, p, chunkAAD(index))
+	return s.buf, nil
+}
+
+// NewWriter writes the header of a new encrypted file to w, with a new data key
+// wrapped by the current key of ring.
+func NewWriter(w io.Writer, ring *KeyRing) (*Writer, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := ring.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newChunkSealer(dataKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, sealer: sealer}, nil
+}
+
+// Write returns the plaintext bytes written, a chunk is written whole or not at all
+// by the underlying writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), ChunkSize)]
+		sealed, err := w.sealer.seal(chunk, w.sealer.chunks)
+		if err != nil {
+			return written, err
+		}
+		if _, err = w.w.Write(sealed); err != nil {
+			return written, err
+		}
+		w.sealer.chunks++
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// chunkInfo is where a complete chunk is.
+type chunkInfo struct {
+	raw   int64 // offset of the chunk in the file
+	plain int64 // offset of its plaintext
+	size  int64 // plaintext length
+	head  []byte
+}
+
+// scanChunks calls fn for the complete chunks of the encrypted file f of size bytes
+// until fn returns false, and returns where the complete chunks end.
+func scanChunks(f io.ReaderAt, size int64, fn func(c chunkInfo) bool) (raw int64, plain int64, chunks uint64, err error) {
+	raw = HeaderSize
+	for raw+chunkHeadSize <= size {
+		head := make([]byte, chunkHeadSize)
+		if _, err = f.ReadAt(head, raw); err != nil {
+			return raw, plain, chunks, err
+		}
+		length := int64(binary.BigEndian.Uint32(head))
+		if length > ChunkSize {
+			return raw, plain, chunks, fmt.Errorf("%w: chunk %d of %d bytes", ErrCorrupt, chunks, length)
+		}
+		if raw+ChunkOverhead+length > size {
+			break
+		}
+		if fn != nil && !fn(chunkInfo{raw: raw, plain: plain, size: length, head: head}) {
+			return raw, plain, chunks, nil
+		}
+		raw += ChunkOverhead + length
+		plain += length
+		chunks++
+	}
+	return raw, plain, chunks, nil
+}
+
+func readHeader(f io.ReaderAt, ring *KeyRing) ([]byte, *masterKey, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, nil, fmt.Errorf("%w: read header: %v", ErrCorrupt, err)
+	}
+	return ring.unwrap(header)
+}
+
+// OpenAppend returns a writer that appends chunks to the encrypted file f. A torn
+// chunk at the end, which no reader could decrypt, is cut first.
+func OpenAppend(f *os.File, ring *KeyRing) (*Writer, error) {
+	dataKey, _, err := readHeader(f, ring)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	raw, _, chunks, err := scanChunks(f, info.Size(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if raw < info.Size() {
+		slog.Warn("cut torn encrypted chunk", slog.String("filepath", f.Name()), slog.Int64("from", info.Size()), slog.Int64("to", raw))
+		if err = f.Truncate(raw); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = f.Seek(raw, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sealer, err := newChunkSealer(dataKey, chunks)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: f, sealer: sealer}, nil
+}
+
+// Reader decrypts an encrypted file. At the end of the complete chunks Read returns
+// io.EOF, and goes on when more chunks are appended.
+type Reader struct {
+	r      io.ReadSeeker
+	sealer *chunkSealer
+	raw    int64 // offset of the next chunk
+	pos    int64 // plaintext offset of what Read returns next
+	plain  []byte
+	resync bool // the position of r is not raw, after a torn chunk
+}
+
+// NewReader reads the header of the encrypted file r and unwraps its data key with ring.
+func NewReader(r io.ReadSeeker, ring *KeyRing) (*Reader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: read header: %v", ErrCorrupt, err)
+	}
+	dataKey, _, err := ring.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newChunkSealer(dataKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, sealer: sealer, raw: HeaderSize}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.plain) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+// next decrypts the chunk at raw.
+func (r *Reader) next() error {
+	if r.resync {
+		if _, err := r.r.Seek(r.raw, io.SeekStart); err != nil {
+			return err
+		}
+		r.resync = false
+	}
+	head := make([]byte, chunkHeadSize)
+	if _, err := io.ReadFull(r.r, head); err != nil {
+		return r.torn(err)
+	}
+	length := int(binary.BigEndian.Uint32(head))
+	if length > ChunkSize {
+		return fmt.Errorf("%w: chunk %d of %d bytes", ErrCorrupt, r.sealer.chunks, length)
+	}
+	if cap(r.sealer.buf) < length+tagSize {
+		r.sealer.buf = make([]byte, length+tagSize)
+	}
+	body := r.sealer.buf[:length+tagSize]
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return r.torn(err)
+	}
+	plain, err := r.sealer.aead.Open(body[:0], head[4:], body, chunkAAD(r.sealer.chunks))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, r.sealer.chunks, err)
+	}
+	r.raw += int64(ChunkOverhead + length)
+	r.sealer.chunks++
+	r.plain = plain
+	return nil
+}
+
+// torn handles the end of the file in the middle of a chunk, it may still be written.
+func (r *Reader) torn(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		r.resync = true
+		return io.EOF
+	}
+	return err
+}
+
+// RawOffset returns where the chunks read end in the file.
+func (r *Reader) RawOffset() int64 {
+	return r.raw
+}
+
+// Complete tells whether the file of size bytes has a complete chunk after those read.
+func (r *Reader) Complete(size int64) bool {
+	if size < r.raw+chunkHeadSize {
+		return false
+	}
+	ra, ok := r.r.(io.ReaderAt)
+	if !ok {
+		return size > r.raw
+	}
+	head := make([]byte, 4)
+	if _, err := ra.ReadAt(head, r.raw); err != nil {
+		return false
+	}
+	return r.raw+ChunkOverhead+int64(binary.BigEndian.Uint32(head)) <= size
+}
+
+// Seek sets the plaintext offset of the next Read, only io.SeekStart and io.SeekCurrent
+// are supported. Chunks before the offset are skipped by their lengths, the file must
+// be an io.ReaderAt to seek forward without reading them.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	default:
+		return r.pos, fmt.Errorf("seek whence %d is not supported", whence)
+	}
+	ra, ok := r.r.(io.ReaderAt)
+	if !ok {
+		return r.pos, fmt.Errorf("seek on a reader that is not an io.ReaderAt")
+	}
+	size, err := r.r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return r.pos, err
+	}
+	var found *chunkInfo
+	raw, plain, chunks, err := scanChunks(ra, size, func(c chunkInfo) bool {
+		if c.plain+c.size > offset {
+			found = &c
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return r.pos, err
+	}
+	r.plain = nil
+	if found == nil {
+		if offset != plain {
+			return r.pos, fmt.Errorf("seek to %d beyond the end %d", offset, plain)
+		}
+		r.raw, r.pos, r.sealer.chunks, r.resync = raw, plain, chunks, true
+		return r.pos, nil
+	}
+	r.raw, r.pos, r.sealer.chunks, r.resync = raw, found.plain, chunks, true
+	if err = r.next(); err != nil {
+		return r.pos, err
+	}
+	skip := offset - found.plain
+	r.plain = r.plain[skip:]
+	r.pos = offset
+	return r.pos, nil
+}
+
+// PlainSize returns the plaintext size of the complete chunks of the encrypted file at path.
+func PlainSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	_, plain, _, err := scanChunks(file, info.Size(), nil)
+	return plain, err
+}
+
+// Truncate cuts the encrypted file at path to size bytes of plaintext. A chunk cut in
+// the middle is sealed again with a new nonce, a torn chunk at the end is cut too.
+func Truncate(path string, size int64, ring *KeyRing) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dataKey, _, err := readHeader(file, ring)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var found *chunkInfo
+	raw, _, index, err := scanChunks(file, info.Size(), func(c chunkInfo) bool {
+		if c.plain+c.size > size {
+			found = &c
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		if raw < info.Size() {
+			return file.Truncate(raw)
+		}
+		return nil
+	}
+	sealer, err := newChunkSealer(dataKey, index)
+	if err != nil {
+		return err
+	}
+	keep := size - found.plain
+	var rest []byte
+	if keep > 0 {
+		body := make([]byte, found.size+tagSize)
+		if _, err = file.ReadAt(body, found.raw+chunkHeadSize); err != nil {
+			return err
+		}
+		plain, err := sealer.aead.Open(nil, found.head[4:], body, chunkAAD(index))
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, index, err)
+		}
+		if rest, err = sealer.seal(plain[:keep], index); err != nil {
+			return err
+		}
+	}
+	if err = file.Truncate(found.raw); err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		if _, err = file.WriteAt(rest, found.raw); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// Rewrap wraps the data key of the encrypted file at path with the current key of
+// ring, when it is wrapped by another key. It tells whether the file was rewritten.
+func Rewrap(path string, ring *KeyRing) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	dataKey, key, err := readHeader(file, ring)
+	if err != nil {
+		return false, err
+	}
+	if key == ring.keys[0] {
+		return false, nil
+	}
+	header, err := ring.wrap(dataKey)
+	if err != nil {
+		return false, err
+	}
+	// the header fits in a sector, it is written whole
+	if _, err = file.WriteAt(header, 0); err != nil {
+		return false, err
+	}
+	return true, file.Sync()
+}
+
+// RewrapDir rewraps the encrypted files of dir, see Rewrap, and returns how many were
+// rewritten. Files of a key that is not in ring are left alone. A file that fails does
+// not stop the others, the errors of all of them are returned joined.
+func RewrapDir(dir string, ring *KeyRing) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	var errs []error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if !IsEncryptedFile(path) {
+			continue
+		}
+		rewrapped, err := Rewrap(path, ring)
+		if errors.Is(err, ErrUnknownKey) {
+			slog.Warn("rewrap file skipped", slog.String("filepath", path), slog.String("error", err.Error()))
+			continue
+		}
+		if err != nil {
+			slog.Warn("rewrap file error", slog.String("filepath", path), slog.String("error", err.Error()))
+			errs = append(errs, fmt.Errorf("rewrap %s: %w", path, err))
+			continue
+		}
+		if rewrapped {
+			count++
+		}
+	}
+	if count > 0 {
+		slog.Info("rewrap files success", slog.String("dir", dir), slog.Int("files", count))
+	}
+	return count, errors.Join(errs...)
+}
+
+// ConfigWriter returns a writer encrypting to w with the configured key ring, w itself
+// when encryption is not configured.
+func ConfigWriter(w io.Writer) (io.Writer, error) {
+	ring, err := ConfigKeyRing()
+	if err != nil || ring == nil {
+		return w, err
+	}
+	return NewWriter(w, ring)
+}
+
+// ConfigReader returns a reader decrypting the file r when it is encrypted, r itself
+// from its start when it is not.
+func ConfigReader(r interface {
+	io.ReadSeeker
+	io.ReaderAt
+}) (io.ReadSeeker, error) {
+	if !IsEncrypted(r) {
+		_, err := r.Seek(0, io.SeekStart)
+		return r, err
+	}
+	ring, err := ConfigKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(r, ring)
+}
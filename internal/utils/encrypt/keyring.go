@@ -0,0 +1,172 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"redisFlutter/internal/config"
+)
+
+// KeySize is the size of master and data keys, AES-256.
+const KeySize = 32
+
+type masterKey struct {
+	id   [8]byte // first bytes of the sha256 of the key, stored in the file header
+	raw  []byte
+	aead cipher.AEAD
+}
+
+// KeyRing holds the master keys. The first one wraps the data keys of new files, the
+// others only unwrap the data keys of files written before a rotation.
+type KeyRing struct {
+	keys []*masterKey
+}
+
+// ParseKeyRing parses keys separated by new lines or commas, each the base64 or hex of
+// KeySize bytes. Empty lines and lines starting with # are skipped.
+func ParseKeyRing(text string) (*KeyRing, error) {
+	ring := new(KeyRing)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			raw, err := decodeKey(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %d: %v", len(ring.keys)+1, err)
+			}
+			key, err := newMasterKey(raw)
+			if err != nil {
+				return nil, err
+			}
+			ring.keys = append(ring.keys, key)
+		}
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("no key")
+	}
+	return ring, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if raw, err := hex.DecodeString(s); err == nil && len(raw) == KeySize {
+		return raw, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("neither hex nor base64")
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("%d bytes, expect %d", len(raw), KeySize)
+	}
+	return raw, nil
+}
+
+func newMasterKey(raw []byte) (*masterKey, error) {
+	aead, err := newGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	key := &masterKey{raw: raw, aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(key.id[:], sum[:])
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Current returns the master key new data is encrypted with.
+func (r *KeyRing) Current() []byte {
+	return r.keys[0].raw
+}
+
+// Keys returns every master key, the current one first.
+func (r *KeyRing) Keys() [][]byte {
+	keys := make([][]byte, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key.raw)
+	}
+	return keys
+}
+
+func (r *KeyRing) find(id []byte) *masterKey {
+	for _, key := range r.keys {
+		if string(key.id[:]) == string(id) {
+			return key
+		}
+	}
+	return nil
+}
+
+// LoadKeyRing reads the keys of file and of the environment variable env, the keys of
+// the file come first. It returns nil when both are empty.
+func LoadKeyRing(file string, env string) (*KeyRing, error) {
+	var text []string
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read key file [%s]: %v", file, err)
+		}
+		text = append(text, string(data))
+	}
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("key environment variable [%s] is not set", env)
+		}
+		text = append(text, value)
+	}
+	if len(text) == 0 {
+		return nil, nil
+	}
+	ring, err := ParseKeyRing(strings.Join(text, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("load key ring: %v", err)
+	}
+	return ring, nil
+}
+
+type keyRingSource struct {
+	file string
+	env  string
+}
+
+var (
+	keyRingsLock sync.Mutex
+	keyRings     = make(map[keyRingSource]*KeyRing)
+)
+
+// ConfigKeyRing returns the key ring of encryption_key_file and encryption_key_env,
+// nil when encryption is not configured. Keys are read once.
+func ConfigKeyRing() (*KeyRing, error) {
+	source := keyRingSource{file: config.Opt.Advanced.EncryptionKeyFile, env: config.Opt.Advanced.EncryptionKeyEnv}
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	if ring, ok := keyRings[source]; ok {
+		return ring, nil
+	}
+	ring, err := LoadKeyRing(source.file, source.env)
+	if err != nil {
+		return nil, err
+	}
+	keyRings[source] = ring
+	return ring, nil
+}
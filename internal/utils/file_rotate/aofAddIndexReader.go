@@ -10,7 +10,6 @@ import (
 	"os"
 	"path"
 	"redisFlutter/constDefine"
-	"redisFlutter/internal/utils"
 	"time"
 )
 
@@ -20,12 +19,18 @@ type AofAddIndexReader struct {
 	dir  string
 
 	file         *os.File
+	segment      *segmentFile // file, or the decoder of a compressed segment
 	filepath     string
 	fileIndex    int64
 	nextFilePath string
 
 	fileReadSize  int64
 	totalReadSize *atomic.Int64
+
+	position         *atomic.Int64 // fileIndex for the cursor, read by retention
+	unregisterCursor func()
+	tracker          *cursorTracker // of a reader with a durable cursor
+	notifier         *dirNotifier   // wakes up the reader waiting for the writer
 }
 
 func NewAofAddIndexReader(ctx context.Context, name string, dir string, startFileIndex int64) *AofAddIndexReader {
@@ -37,9 +42,63 @@ func NewAofAddIndexReader(ctx context.Context, name string, dir string, startFil
 	r.fileIndex = startFileIndex
 	r.fileReadSize = 0
 	r.totalReadSize = atomic.NewInt64(0)
+	r.position = atomic.NewInt64(startFileIndex)
+	r.unregisterCursor = RegisterCursor(dir, name, r.position.Load)
+	r.notifier = watchDir(dir)
 	return r
 }
 
+// NewAofAddIndexCursorReader returns a reader that resumes where the durable cursor
+// name of dir was committed, or at the first segment for a new cursor. Readers with
+// different names consume the same directory independently.
+func NewAofAddIndexCursorReader(ctx context.Context, name string, dir string) (*AofAddIndexReader, error) {
+	cursor, err := LoadCursor(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == nil {
+		cursor = &Cursor{Name: name}
+		if segments := listSegments(dir); len(segments) > 0 {
+			cursor.FileIndex = segments[0].number
+		}
+	}
+	r := NewAofAddIndexReader(ctx, name, dir, cursor.FileIndex)
+	r.tracker = newCursorTracker(dir, *cursor)
+	if cursor.Offset > 0 {
+		if err = r.seek(cursor.FileIndex, cursor.Offset); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	slog.Info("resume cursor success", slog.String("name", name), slog.String("dir", dir),
+		slog.Int64("fileIndex", cursor.FileIndex), slog.Int64("offset", cursor.Offset), slog.Int64("entries", cursor.Entries))
+	return r, nil
+}
+
+// Commit saves the cursor after the first entries commands the reader returned, entries
+// counts from the cursor was created like Cursor.Entries. It is called once the consumer
+// is done with them, a restarted reader resumes after them.
+func (c *AofAddIndexReader) Commit(entries int64) error {
+	if c.tracker == nil {
+		return fmt.Errorf("reader [%s] has no cursor", c.name)
+	}
+	cursor, err := c.tracker.commit(entries)
+	if err != nil {
+		slog.Error("commit cursor error", slog.String("name", c.name), slog.Int64("entries", entries), slog.String("error", err.Error()))
+		return err
+	}
+	c.position.Store(cursor.FileIndex)
+	return nil
+}
+
+// Committed returns the cursor last committed.
+func (c *AofAddIndexReader) Committed() Cursor {
+	if c.tracker == nil {
+		return Cursor{Name: c.name}
+	}
+	return c.tracker.cursor()
+}
+
 func (c *AofAddIndexReader) getIndexFilePath(index int64) string {
 	filepath := path.Join(c.dir, fmt.Sprintf("%d%s", index, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX))
 	return filepath
@@ -54,31 +113,106 @@ func (c *AofAddIndexReader) openFile(index int64) error {
 	c.nextFilePath = c.getIndexFilePath(index + 1)
 
 	var err error
-	c.file, err = os.OpenFile(c.filepath, os.O_RDONLY, 0644)
+	c.segment, err = openSegmentFile(c.dir, index)
 	if err != nil {
 		slog.Error("open file for read error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return err
 	}
+	c.file = c.segment.file
+	c.filepath = c.segment.path
+	markOpen(c.filepath)
+	if c.tracker == nil {
+		c.position.Store(index)
+	} else {
+		// retention goes by the committed cursor
+		c.tracker.opened(index)
+	}
 	c.fileReadSize = 0
 	slog.Info("open file for read success", slog.String("name", c.name), slog.String("filepath", c.filepath))
 	return nil
 }
 
 func (c *AofAddIndexReader) justRead(buf []byte) (int, error) {
-	n, err := c.file.Read(buf)
-	if err == nil {
-		c.totalReadSize.Add(int64(n))
-		c.fileReadSize += int64(n)
-		//slog.Debug("read file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int("len", n))
-		return n, nil
+	// a decoder may return data with io.EOF
+	n, err := c.segment.rd.Read(buf)
+	c.totalReadSize.Add(int64(n))
+	c.fileReadSize += int64(n)
+	//slog.Debug("read file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int("len", n))
+	return n, err
+}
+
+// SeekOffset makes the reader start at offset of the stream stored in the directory,
+// see SegmentIndex. It is called before the first Read.
+func (c *AofAddIndexReader) SeekOffset(offset int64) error {
+	indexes, err := LoadIndex(c.dir)
+	if err != nil {
+		return err
 	}
+	idx, err := findSegmentByOffset(indexes, offset)
+	if err != nil {
+		return err
+	}
+	return c.seek(idx.Number, offset-idx.StartOffset)
+}
 
-	return n, err
+// SeekEntry makes the reader start at the n-th command stored in the directory,
+// counted from 0, and returns its offset. It is called before the first Read.
+func (c *AofAddIndexReader) SeekEntry(n int64) (int64, error) {
+	indexes, err := LoadIndex(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	idx, position, err := findEntry(c.dir, indexes, n)
+	if err != nil {
+		return 0, err
+	}
+	return idx.StartOffset + position, c.seek(idx.Number, position)
+}
+
+func (c *AofAddIndexReader) seek(index int64, position int64) error {
+	if c.file != nil || c.totalReadSize.Load() != 0 {
+		return fmt.Errorf("seek after read")
+	}
+	c.fileIndex = index
+	if c.tracker != nil {
+		c.tracker = newCursorTracker(c.dir, Cursor{
+			Name:      c.name,
+			FileIndex: index,
+			Offset:    position,
+			Entries:   c.tracker.cursor().Entries,
+		})
+	}
+	if err := c.openFile(index); err != nil {
+		return err
+	}
+	if c.segment.codec != "" {
+		if _, err := io.CopyN(io.Discard, c.segment.rd, position); err != nil {
+			return err
+		}
+	} else if c.segment.enc != nil {
+		// chunks are skipped without decrypting them
+		if _, err := c.segment.enc.Seek(position, io.SeekStart); err != nil {
+			return err
+		}
+	} else if _, err := c.file.Seek(position, io.SeekStart); err != nil {
+		return err
+	}
+	c.fileReadSize = position
+	slog.Info("seek file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("position", position))
+	return nil
 }
 
 func (c *AofAddIndexReader) Read(buf []byte) (int, error) {
-	if c.totalReadSize.Load() == 0 {
-		var exist = c.waitFileExist(c.getIndexFilePath(c.fileIndex))
+	n, err := c.read(buf)
+	if c.tracker != nil && n > 0 {
+		c.tracker.read(buf[:n])
+	}
+	return n, err
+}
+
+func (c *AofAddIndexReader) read(buf []byte) (int, error) {
+	if c.totalReadSize.Load() == 0 && c.file == nil {
+		var exist = c.waitFileExist(c.fileIndex)
 		if !exist {
 			return 0, fmt.Errorf("read file not exist after wait time")
 		}
@@ -100,6 +234,14 @@ func (c *AofAddIndexReader) Read(buf []byte) (int, error) {
 		slog.Error("read file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return 0, err
 	}
+	if n > 0 {
+		return n, nil
+	}
+	if c.segment.codec != "" {
+		// a compressed segment is rotated, the next one exists
+		_ = c.closeCurrentFile()
+		return c.readNextFile(buf)
+	}
 
 	ret, err := c.waitFileExpandOrNextFileExist()
 	if err != nil {
@@ -131,6 +273,13 @@ func (c *AofAddIndexReader) readNextFile(buf []byte) (int, error) {
 		slog.Error("read file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return 0, err
 	}
+	if n > 0 {
+		return n, nil
+	}
+	if c.segment.codec != "" {
+		_ = c.closeCurrentFile()
+		return c.readNextFile(buf)
+	}
 
 	err = c.waitFileExpand()
 	if err != nil {
@@ -140,125 +289,124 @@ func (c *AofAddIndexReader) readNextFile(buf []byte) (int, error) {
 }
 
 func (c *AofAddIndexReader) waitFileExpandOrNextFileExist() (int, error) {
-	//file.Seek(0, io.SeekEnd)
-	checkInterval := time.Millisecond * 100
-	ticker := time.NewTicker(checkInterval)
-	ticker.Reset(time.Nanosecond)
+	ticker := time.NewTicker(c.notifier.interval())
+	defer ticker.Stop()
 
 	startAt := time.Now()
 	slog.Info("start wait file expand or next file exist", slog.String("name", c.name), slog.String("filepath", c.filepath))
 
 	for {
+		// taken before the check, a write after it closes the channel
+		changed := c.notifier.changed()
+		//must detect exist first
+		nextExist := segmentExists(c.dir, c.fileIndex+1)
+		if nextExist {
+			slog.Info("detect next file exist", slog.String("name", c.name), slog.String("nextFilePath", c.nextFilePath))
+		}
+		//then check file expand
+		currentFileSize, err := c.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			slog.Error("file seek end error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
+			return 0, err
+		}
+		rawRead := c.segment.rawRead(c.fileReadSize)
+		if currentFileSize < rawRead {
+			slog.Error("seek file size less than file read size", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", rawRead))
+			return 0, fmt.Errorf("seek file size less than file read size")
+		}
+		//reset file seek for read
+		_, err = c.file.Seek(rawRead, io.SeekStart)
+		if err != nil {
+			slog.Error("file seek read error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
+			return 0, err
+		}
+		if c.segment.expanded(currentFileSize, c.fileReadSize) {
+			slog.Debug("detect file expand", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
+			if nextExist {
+				return 3, nil
+			}
+			return 1, nil
+		}
+		if nextExist {
+			return 2, nil
+		}
 		select {
 		case <-c.ctx.Done():
 			slog.Warn("receive context done flag, wait file expand or next file exist end", slog.String("name", c.name), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.String("filepath", c.filepath))
 			return 0, nil
+		case <-changed:
 		case <-ticker.C:
-			ticker.Reset(checkInterval)
-			//must detect exist first
-			nextExist := utils.IsExist(c.nextFilePath)
-			if nextExist {
-				slog.Info("detect next file exist", slog.String("name", c.name), slog.String("nextFilePath", c.nextFilePath))
-			}
-			//then check file expand
-			currentFileSize, err := c.file.Seek(0, io.SeekEnd)
-			if err != nil {
-				slog.Error("file seek end error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
-				return 0, err
-			}
-			if currentFileSize < c.fileReadSize {
-				slog.Error("seek file size less than file read size", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
-				return 0, fmt.Errorf("seek file size less than file read size")
-			}
-			//reset file seek for read
-			_, err = c.file.Seek(c.fileReadSize, io.SeekStart)
-			if err != nil {
-				slog.Error("file seek read error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
-				return 0, err
-			}
-			if currentFileSize == c.fileReadSize && !nextExist { // no change
-				continue
-			}
-			if currentFileSize > c.fileReadSize {
-				slog.Debug("detect file expand", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
-				if nextExist {
-					return 3, nil
-				}
-				return 1, nil
-			}
-			if nextExist {
-				return 2, nil
-			}
 		}
 	}
 }
 
 func (c *AofAddIndexReader) waitFileExpand() error {
-	checkInterval := time.Millisecond * 100
-	ticker := time.NewTicker(checkInterval)
-	ticker.Reset(time.Nanosecond)
+	ticker := time.NewTicker(c.notifier.interval())
+	defer ticker.Stop()
 
 	startAt := time.Now()
 	slog.Info("start wait file expand", slog.String("name", c.name), slog.String("filepath", c.filepath))
 
 	for {
+		changed := c.notifier.changed()
+		//check file expand
+		currentFileSize, err := c.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			slog.Error("file seek end error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
+			return err
+		}
+		rawRead := c.segment.rawRead(c.fileReadSize)
+		if currentFileSize < rawRead {
+			slog.Error("seek file size less than file read size", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", rawRead))
+			return fmt.Errorf("seek file size less than file read size")
+		}
+		//reset file seek for read
+		_, err = c.file.Seek(rawRead, io.SeekStart)
+		if err != nil {
+			slog.Error("file seek read error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
+			return err
+		}
+		if c.segment.expanded(currentFileSize, c.fileReadSize) {
+			slog.Debug("detect file expand", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
+			return nil
+		}
 		select {
 		case <-c.ctx.Done():
 			slog.Warn("receive context done flag, wait file expand end", slog.String("name", c.name), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.String("filepath", c.filepath))
 			return fmt.Errorf("receive context done flag")
+		case <-changed:
 		case <-ticker.C:
-			ticker.Reset(checkInterval)
-			//check file expand
-			currentFileSize, err := c.file.Seek(0, io.SeekEnd)
-			if err != nil {
-				slog.Error("file seek end error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
-				return err
-			}
-			if currentFileSize < c.fileReadSize {
-				slog.Error("seek file size less than file read size", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
-				return fmt.Errorf("seek file size less than file read size")
-			}
-			//reset file seek for read
-			_, err = c.file.Seek(c.fileReadSize, io.SeekStart)
-			if err != nil {
-				slog.Error("file seek read error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()))
-				return err
-			}
-			if currentFileSize == c.fileReadSize { // no change
-				continue
-			}
-			slog.Debug("detect file expand", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.Int64("seekSize", currentFileSize), slog.Int64("fileReadSize", c.fileReadSize))
-			return nil
 		}
 	}
 }
 
-func (c *AofAddIndexReader) waitFileExist(filePath string) bool {
-	exist := utils.IsExist(filePath)
+func (c *AofAddIndexReader) waitFileExist(index int64) bool {
+	filePath := c.getIndexFilePath(index)
+	exist := segmentExists(c.dir, index)
 	if exist {
 		slog.Info("detect file exist success, wait file exist end", slog.String("name", c.name), slog.String("filepath", filePath))
 		return true
 	}
 
-	checkInterval := time.Millisecond * 100
-	ticker := time.NewTicker(checkInterval)
-	ticker.Reset(checkInterval)
+	ticker := time.NewTicker(c.notifier.interval())
+	defer ticker.Stop()
 
 	startAt := time.Now()
 	slog.Info("start wait file exist", slog.String("name", c.name), slog.String("filepath", filePath))
 
 	for {
+		changed := c.notifier.changed()
+		exist := segmentExists(c.dir, index)
+		if exist {
+			slog.Info("detect file exist success, wait file exist end", slog.String("name", c.name), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.String("filepath", filePath))
+			return true
+		}
 		select {
 		case <-c.ctx.Done():
 			slog.Warn("receive context done flag, wait file exist end", slog.String("name", c.name), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.String("filepath", filePath))
 			return false
+		case <-changed:
 		case <-ticker.C:
-			ticker.Reset(checkInterval)
-			exist := utils.IsExist(filePath)
-			if exist {
-				slog.Info("detect file exist success, wait file exist end", slog.String("name", c.name), slog.Int64("elapsedMs", time.Since(startAt).Milliseconds()), slog.String("filepath", filePath))
-				return true
-			}
 		}
 	}
 }
@@ -267,14 +415,27 @@ func (c *AofAddIndexReader) closeCurrentFile() error {
 	if c.file == nil {
 		return nil
 	}
-	err := c.file.Close()
+	err := c.segment.Close()
 	if err != nil {
 		slog.Error("close file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return err
 	}
+	markClosed(c.filepath)
 	slog.Info("close file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("fileReadSize", c.fileReadSize), slog.Int64("totalReadSize", c.totalReadSize.Load()))
 
 	c.file = nil
+	c.segment = nil
 	c.fileReadSize = 0
 	return nil
 }
+
+// Close closes the current file and removes the cursor of the reader, so retention
+// no longer waits for it.
+func (c *AofAddIndexReader) Close() error {
+	c.unregisterCursor()
+	if c.notifier != nil {
+		c.notifier.unwatch()
+		c.notifier = nil
+	}
+	return c.closeCurrentFile()
+}
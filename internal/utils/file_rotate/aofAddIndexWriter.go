@@ -8,7 +8,10 @@ import (
 	"path"
 	"path/filepath"
 	"redisFlutter/constDefine"
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/utils/encrypt"
 	"strings"
+	"time"
 )
 
 //const MaxFileSize = 8 * 1024 * 1024 // 8M
@@ -19,10 +22,17 @@ type AofAddIndexWriter struct {
 
 	singleFileMaxSize int64
 	file              *os.File
+	out               io.Writer // file, or the encrypting writer of it
 	filepath          string
 	fileIndex         int64
 
-	filesize int64
+	filesize   int64
+	offset     int64         // bytes written since the writer was created
+	index      *indexBuilder // index of the current segment, saved when it is closed
+	compressor *segmentCompressor
+	syncer     *fileSyncer
+	notifier   *dirNotifier // wakes up the readers of dir in this process
+	ring       *encrypt.KeyRing
 }
 
 func NewAofAddIndexWriter(name string, dir string, singleFileMaxSize int64) (*AofAddIndexWriter, error) {
@@ -30,25 +40,57 @@ func NewAofAddIndexWriter(name string, dir string, singleFileMaxSize int64) (*Ao
 	w.name = name
 	w.dir = dir
 	w.singleFileMaxSize = singleFileMaxSize
+	w.compressor = newSegmentCompressor(name)
+	w.syncer = newFileSyncer(name, 0)
+	w.notifier = dirNotifierOf(dir)
 	os.MkdirAll(dir, 0755)
 
-	indexArr := ScanAddIndexSuffixFiles(dir, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX)
-	if len(indexArr) == 0 {
+	var err error
+	if w.ring, err = encrypt.ConfigKeyRing(); err != nil {
+		slog.Error("load encryption keys error", slog.String("name", w.name), slog.String("error", err.Error()))
+		return w, err
+	}
+	if w.ring != nil {
+		// data keys of an old master key are wrapped by the current one
+		if _, err = encrypt.RewrapDir(dir, w.ring); err != nil {
+			slog.Error("rewrap dir error", slog.String("name", w.name), slog.String("dir", dir), slog.String("error", err.Error()))
+			return w, err
+		}
+	}
+
+	if mode := config.Opt.Advanced.AofVerify; mode == VerifyTail || mode == VerifyFull {
+		report, err := VerifyDir(dir, mode == VerifyFull, config.Opt.Advanced.AofRepair)
+		if err != nil {
+			slog.Error("verify dir error", slog.String("name", w.name), slog.String("dir", dir), slog.String("error", err.Error()))
+			return w, err
+		}
+		if !report.OK() {
+			slog.Warn("verify dir found problems", slog.String("name", w.name), slog.String("dir", dir), slog.Int("problems", len(report.Problems)))
+		}
+	}
+
+	segments := listSegments(dir)
+	if len(segments) != 0 {
+		var err error
+		if _, w.index, err = loadIndex(dir); err != nil {
+			slog.Error("load index error", slog.String("name", w.name), slog.String("dir", dir), slog.String("error", err.Error()))
+			return w, err
+		}
+		defer w.compressor.compressSealed(dir)
+	}
+	if len(segments) == 0 {
 		w.fileIndex = 0
 		w.file = nil
 		w.filesize = 0
 		err := w.openNewFile(w.fileIndex)
 		return w, err
 	} else {
-		maxIndex := indexArr[len(indexArr)-1]
+		last := segments[len(segments)-1]
+		maxIndex := last.number
 		cfpath := path.Join(dir, fmt.Sprintf("%d%s", maxIndex, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX))
-		finfo, err := os.Stat(cfpath)
-		if err != nil {
-			return w, err
-		}
 
-		fsize := finfo.Size()
-		if fsize >= w.singleFileMaxSize {
+		// a compressed segment is sealed, and so is one encrypted or not unlike new writes
+		if last.codec != "" || last.size >= w.singleFileMaxSize || (w.ring != nil) != encrypt.IsEncryptedFile(last.path) {
 			w.fileIndex = maxIndex + 1
 			w.file = nil
 			w.filesize = 0
@@ -64,9 +106,11 @@ func NewAofAddIndexWriter(name string, dir string, singleFileMaxSize int64) (*Ao
 }
 
 func (c *AofAddIndexWriter) Reinit() error {
-	c.Close()
+	c.closeFile()
+	c.compressor.wait()
 	c.RemoveAll()
 
+	c.index = nil
 	c.file = nil
 	c.filesize = 0
 	c.fileIndex = 0
@@ -79,13 +123,27 @@ func (c *AofAddIndexWriter) Reinit() error {
 func (c *AofAddIndexWriter) openExistFile(fp string) error {
 	c.filepath = fp
 	var err error
-	c.file, err = os.OpenFile(fp, os.O_WRONLY, 0644) //os.O_TRUNC,os.O_APPEND
+	c.file, err = os.OpenFile(fp, os.O_RDWR, 0644) //os.O_TRUNC,os.O_APPEND
 	if err != nil {
 		slog.Error("open exist file for write error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return err
 	}
+	c.out = c.file
+	if c.ring != nil {
+		if c.out, err = encrypt.OpenAppend(c.file, c.ring); err != nil {
+			slog.Error("open encrypted file for write error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
+			c.file.Close()
+			c.file = nil
+			return err
+		}
+	}
+	markOpen(c.filepath)
+	c.syncer.open(c.file)
+	// write after the existing content
 	c.filesize, _ = c.file.Seek(0, io.SeekEnd)
-	c.file.Seek(0, io.SeekStart)
+	if c.ring != nil {
+		c.filesize, _ = encrypt.PlainSize(fp)
+	}
 	slog.Info("open exist file for write success", slog.String("name", c.name), slog.String("filepath", c.filepath))
 	return nil
 }
@@ -93,43 +151,91 @@ func (c *AofAddIndexWriter) openExistFile(fp string) error {
 func (c *AofAddIndexWriter) openNewFile(index int64) error {
 	c.filepath = path.Join(c.dir, fmt.Sprintf("%d%s", index, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX))
 	var err error
-	c.file, err = os.OpenFile(c.filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644) //os.O_TRUNC,os.O_APPEND
+	if c.ring != nil {
+		err = c.createEncryptedFile()
+	} else {
+		c.file, err = os.OpenFile(c.filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644) //os.O_TRUNC,os.O_APPEND
+		c.out = c.file
+	}
 	if err != nil {
 		slog.Error("open new file for write error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return err
 	}
+	markOpen(c.filepath)
+	c.syncer.open(c.file)
 	c.filesize = 0
+	c.index = c.index.next(index)
+	c.notifier.signal()
 	slog.Info("open new file for write success", slog.String("name", c.name), slog.String("filepath", c.filepath))
 	return nil
 }
 
+// createEncryptedFile creates the segment with the header of an encrypted file, which
+// readers only see complete.
+func (c *AofAddIndexWriter) createEncryptedFile() error {
+	tmp := c.filepath + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	out, err := encrypt.NewWriter(file, c.ring)
+	if err == nil {
+		err = os.Rename(tmp, c.filepath)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	c.file, c.out = file, out
+	return nil
+}
+
 func (c *AofAddIndexWriter) Write(buf []byte) (int, error) {
-	n, err := c.file.Write(buf)
+	n, err := c.out.Write(buf)
 	if err != nil {
 		slog.Error("write file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return 0, err
 	}
 
 	c.filesize += int64(n)
+	c.offset += int64(n)
+	c.index.write(buf[:n], time.Now())
+	if err = c.syncer.wrote(c.offset); err != nil {
+		slog.Error("sync file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
+		return n, err
+	}
 	//slog.Debug("write file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int("len", n))
 	if c.filesize >= c.singleFileMaxSize {
-		c.Close()
+		c.closeFile()
+		sealed := c.filepath
 		c.fileIndex++
 		err = c.openNewFile(c.fileIndex)
 		if err != nil {
 			return 0, err
 		}
+		c.compressor.compress(sealed)
 	}
+	c.notifier.signal()
 	return n, nil
 }
 
+// Close closes the segment being written, the writer is not used any more.
 func (c *AofAddIndexWriter) Close() error {
+	c.syncer.unregister()
+	return c.closeFile()
+}
+
+// closeFile syncs and closes the segment being written.
+func (c *AofAddIndexWriter) closeFile() error {
 	if c.file == nil {
 		return nil
 	}
+	c.syncer.close()
 	err := c.file.Sync()
 	if err != nil {
 		slog.Error("sync file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
+		c.syncer.open(c.file)
 		return err
 	}
 	err = c.file.Close()
@@ -137,11 +243,31 @@ func (c *AofAddIndexWriter) Close() error {
 		slog.Error("close file error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
 		return err
 	}
+	markClosed(c.filepath)
+	c.syncer.closed()
 	c.file = nil
+	if err = c.index.save(c.filepath); err != nil {
+		// the index can be rebuilt from the segment
+		slog.Warn("save index error", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.String("error", err.Error()))
+	}
 	slog.Info("close file success", slog.String("name", c.name), slog.String("filepath", c.filepath), slog.Int64("filesize", c.filesize))
 	return nil
 }
 
+// Offset returns the offset of the stream stored in the directory the next write goes
+// to, see SegmentIndex.
+func (c *AofAddIndexWriter) Offset() int64 {
+	if c.index == nil {
+		return 0
+	}
+	return c.index.index.EndOffset
+}
+
+// Synced returns how many of the bytes written since the writer was created are durable.
+func (c *AofAddIndexWriter) Synced() int64 {
+	return c.syncer.Synced()
+}
+
 func (c *AofAddIndexWriter) RemoveAll() error {
 	entries, err := os.ReadDir(c.dir)
 	if err != nil {
@@ -149,7 +275,10 @@ func (c *AofAddIndexWriter) RemoveAll() error {
 		return err
 	}
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), constDefine.REDIS_APPEND_CMD_FILE_SUFFIX) {
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), constDefine.REDIS_APPEND_CMD_FILE_SUFFIX) ||
+			strings.HasSuffix(entry.Name(), constDefine.REDIS_APPEND_CMD_FILE_SUFFIX+IndexSuffix) ||
+			strings.HasSuffix(entry.Name(), CursorSuffix) ||
+			strings.HasSuffix(rawSegmentPath(entry.Name()), constDefine.REDIS_APPEND_CMD_FILE_SUFFIX)) {
 			fname := entry.Name()
 			fullPath := filepath.Join(c.dir, fname)
 			err = os.RemoveAll(fullPath)
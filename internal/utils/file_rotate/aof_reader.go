@@ -7,7 +7,6 @@ import (
 	"os"
 	"redisFlutter/constDefine"
 	"redisFlutter/internal/log"
-	"redisFlutter/internal/utils"
 	"time"
 )
 
@@ -16,6 +15,7 @@ type AOFReader struct {
 	name     string
 	dir      string
 	file     *os.File
+	segment  *segmentFile // file, or the decoder of a compressed segment
 	offset   int64
 	pos      int64
 	filepath string
@@ -30,7 +30,7 @@ func NewAOFReader(ctx context.Context, name string, dir string, offset int64) *A
 	filepath := fmt.Sprintf("%s/%d%s", r.dir, r.offset, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX)
 
 	startWaitTimeStart := time.Now()
-	for !utils.IsExist(filepath) {
+	for !segmentExists(r.dir, r.offset) {
 		time.Sleep(100 * time.Millisecond)
 		if time.Since(startWaitTimeStart) > 3*time.Second {
 			log.Panicf("[%s] file not exist. filename=[%s]", r.name, filepath)
@@ -42,12 +42,14 @@ func NewAOFReader(ctx context.Context, name string, dir string, offset int64) *A
 }
 
 func (r *AOFReader) openFile(offset int64) {
-	r.filepath = fmt.Sprintf("%s/%d%s", r.dir, r.offset, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX)
 	var err error
-	r.file, err = os.OpenFile(r.filepath, os.O_RDONLY, 0644)
+	r.segment, err = openSegmentFile(r.dir, r.offset)
 	if err != nil {
 		log.Panicf(err.Error())
 	}
+	r.file = r.segment.file
+	r.filepath = r.segment.path
+	markOpen(r.filepath)
 	r.offset = offset
 	r.pos = 0
 	log.Debugf("[%s] open file for read. filename=[%s]", r.name, r.filepath)
@@ -55,10 +57,10 @@ func (r *AOFReader) openFile(offset int64) {
 
 func (r *AOFReader) readNextFile(offset int64) bool {
 	filepath := fmt.Sprintf("%s/%d%s", r.dir, r.offset, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX)
-	if r.filepath == filepath {
+	if rawSegmentPath(r.filepath) == filepath {
 		return false
 	}
-	if !utils.IsExist(filepath) {
+	if !segmentExists(r.dir, r.offset) {
 		return false
 	}
 	r.Close()
@@ -72,8 +74,8 @@ func (r *AOFReader) readNextFile(offset int64) bool {
 }
 
 func (r *AOFReader) Read(buf []byte) (n int, err error) {
-	n, err = r.file.Read(buf)
-	for err == io.EOF {
+	n, err = r.segment.rd.Read(buf)
+	for err == io.EOF && n == 0 {
 		// sleep or context
 		timer := time.NewTimer(1 * time.Millisecond)
 		select {
@@ -86,9 +88,9 @@ func (r *AOFReader) Read(buf []byte) (n int, err error) {
 		if err != nil {
 			log.Panicf(err.Error())
 		}
-		n, err = r.file.Read(buf)
+		n, err = r.segment.rd.Read(buf)
 
-		if err == nil {
+		if err == nil || n > 0 {
 			break
 		} else if err == io.EOF {
 			continue
@@ -96,7 +98,7 @@ func (r *AOFReader) Read(buf []byte) (n int, err error) {
 			log.Panicf("[%s] read file failed. filename=[%s], err=[%v]", r.name, r.filepath, err)
 		}
 	}
-	if err != nil {
+	if err != nil && err != io.EOF {
 		log.Panicf(err.Error())
 	}
 	r.offset += int64(n)
@@ -112,10 +114,12 @@ func (r *AOFReader) Close() {
 	if r.file == nil {
 		return
 	}
-	err := r.file.Close()
+	err := r.segment.Close()
 	if err != nil {
 		log.Panicf(err.Error())
 	}
+	markClosed(r.filepath)
 	r.file = nil
+	r.segment = nil
 	log.Debugf("[%s] close file. filename=[%s]", r.name, r.filepath)
 }
@@ -18,12 +18,17 @@ type AOFWriter struct {
 	offset   int64
 	filepath string
 	filesize int64
+
+	compressor *segmentCompressor
+	syncer     *fileSyncer
 }
 
 func NewAOFWriter(name string, dir string, offset int64) *AOFWriter {
 	w := new(AOFWriter)
 	w.name = name
 	w.dir = dir
+	w.compressor = newSegmentCompressor(name)
+	w.syncer = newFileSyncer(name, offset)
 	w.openFile(offset)
 	return w
 }
@@ -35,6 +40,8 @@ func (w *AOFWriter) openFile(offset int64) {
 	if err != nil {
 		log.Panicf(err.Error())
 	}
+	markOpen(w.filepath)
+	w.syncer.open(w.file)
 	w.offset = offset
 	w.filesize = 0
 	log.Debugf("[%s] open file for write. filename=[%s], offset=%d", w.name, w.filepath, w.offset)
@@ -47,16 +54,28 @@ func (w *AOFWriter) Write(buf []byte) {
 	}
 	w.offset += int64(len(buf))
 	w.filesize += int64(len(buf))
+	if err = w.syncer.wrote(w.offset); err != nil {
+		log.Panicf(err.Error())
+	}
 	if w.filesize > MaxFileSize {
-		w.Close()
+		w.closeFile()
+		sealed := w.filepath
 		w.openFile(w.offset)
+		w.compressor.compress(sealed)
 	}
 }
 
+// Close closes the file being written, the writer is not used any more.
 func (w *AOFWriter) Close() {
+	w.syncer.unregister()
+	w.closeFile()
+}
+
+func (w *AOFWriter) closeFile() {
 	if w.file == nil {
 		return
 	}
+	w.syncer.close()
 	err := w.file.Sync()
 	if err != nil {
 		log.Panicf(err.Error())
@@ -65,5 +84,12 @@ func (w *AOFWriter) Close() {
 	if err != nil {
 		log.Panicf(err.Error())
 	}
+	markClosed(w.filepath)
+	w.syncer.closed()
 	log.Infof("[%s] close file. filename=[%s], filesize=[%d] offset=[%d]", w.name, w.filepath, w.filesize, w.offset)
 }
+
+// SyncedOffset returns the offset before which the stream is durable.
+func (w *AOFWriter) SyncedOffset() int64 {
+	return w.syncer.Synced()
+}
@@ -0,0 +1,368 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/atomic"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/status"
+	"redisFlutter/internal/utils/encrypt"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// compressedSuffixes are added to the name of a compressed segment, "12.aof.zst".
+var compressedSuffixes = []struct {
+	codec  string
+	suffix string
+}{
+	{CompressionZstd, ".zst"},
+	{CompressionGzip, ".gz"},
+}
+
+func compressedSuffix(codec string) string {
+	for _, s := range compressedSuffixes {
+		if s.codec == codec {
+			return s.suffix
+		}
+	}
+	return ""
+}
+
+// segmentFile is a segment opened for read, raw or compressed, and maybe encrypted.
+type segmentFile struct {
+	file  *os.File
+	rd    io.Reader       // reads the raw content
+	enc   *encrypt.Reader // decrypts file, nil when it is not encrypted
+	codec string          // "" for a raw segment
+	path  string
+	close func()
+}
+
+// openSegmentFile opens segment number of dir. The raw file is preferred, a
+// segment being compressed has both for a while.
+func openSegmentFile(dir string, number int64) (*segmentFile, error) {
+	fp := segmentPath(dir, number)
+	file, err := os.Open(fp)
+	if err == nil {
+		f := &segmentFile{file: file, rd: file, path: fp, close: func() {}}
+		if err = f.decrypt(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, s := range compressedSuffixes {
+		file, err = os.Open(fp + s.suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := &segmentFile{file: file, rd: file, codec: s.codec, path: fp + s.suffix}
+		if err = f.decrypt(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		switch s.codec {
+		case CompressionZstd:
+			decoder, err := zstd.NewReader(f.rd)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			f.rd, f.close = decoder, decoder.Close
+		case CompressionGzip:
+			decoder, err := gzip.NewReader(f.rd)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			f.rd, f.close = decoder, func() { _ = decoder.Close() }
+		}
+		return f, nil
+	}
+	return nil, err
+}
+
+// decrypt reads the file through a decrypting reader when it is encrypted.
+func (f *segmentFile) decrypt() error {
+	if !encrypt.IsEncrypted(f.file) {
+		return nil
+	}
+	ring, err := encrypt.ConfigKeyRing()
+	if err != nil {
+		return err
+	}
+	if f.enc, err = encrypt.NewReader(f.file, ring); err != nil {
+		return fmt.Errorf("open encrypted file [%s]: %w", f.path, err)
+	}
+	f.rd = f.enc
+	return nil
+}
+
+// rawRead returns where the content read so far ends in the file, read is what the
+// reader got of the content of a raw segment.
+func (f *segmentFile) rawRead(read int64) int64 {
+	if f.enc != nil {
+		return f.enc.RawOffset()
+	}
+	return read
+}
+
+// expanded tells whether the raw segment of size bytes on disk has more to read after
+// read bytes of content.
+func (f *segmentFile) expanded(size int64, read int64) bool {
+	if f.enc != nil {
+		return f.enc.Complete(size)
+	}
+	return size > read
+}
+
+// contentSize returns the size of the content of a raw segment, the plaintext of an
+// encrypted one.
+func contentSize(s segment) int64 {
+	if s.codec != "" || !encrypt.IsEncryptedFile(s.path) {
+		return s.size
+	}
+	size, err := encrypt.PlainSize(s.path)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (f *segmentFile) Close() error {
+	f.close()
+	return f.file.Close()
+}
+
+// segmentExists tells whether segment number of dir exists, raw or compressed.
+func segmentExists(dir string, number int64) bool {
+	fp := segmentPath(dir, number)
+	if _, err := os.Stat(fp); err == nil {
+		return true
+	}
+	for _, s := range compressedSuffixes {
+		if _, err := os.Stat(fp + s.suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentCompressor compresses segments after they are rotated, one at a time in
+// the background. The raw segment is removed once the compressed one is complete,
+// a reader that has it open goes on reading it.
+type segmentCompressor struct {
+	name  string
+	codec string
+
+	lock sync.Mutex // one segment at a time
+	wg   sync.WaitGroup
+
+	segments        *atomic.Int64
+	rawBytes        *atomic.Int64
+	compressedBytes *atomic.Int64
+}
+
+type compressionStatus struct {
+	Name            string  `json:"name"`
+	Codec           string  `json:"codec"`
+	Segments        int64   `json:"segments"`
+	RawBytes        int64   `json:"raw_bytes"`
+	CompressedBytes int64   `json:"compressed_bytes"`
+	Ratio           float64 `json:"ratio"`
+}
+
+var (
+	compressorsLock sync.Mutex
+	compressors     []*segmentCompressor
+)
+
+func init() {
+	status.RegisterHandler("/compression", compressionStatusHandler)
+}
+
+// newSegmentCompressor returns the compressor of aof_compression, nil when segments
+// stay raw. zstd falls back to gzip when its encoder can not be created.
+func newSegmentCompressor(name string) *segmentCompressor {
+	codec := config.Opt.Advanced.AofCompression
+	switch codec {
+	case "", CompressionNone:
+		return nil
+	case CompressionZstd:
+		if encoder, err := zstd.NewWriter(nil); err == nil {
+			_ = encoder.Close()
+		} else {
+			slog.Warn("zstd is not available, fall back to gzip", slog.String("name", name), slog.String("error", err.Error()))
+			codec = CompressionGzip
+		}
+	case CompressionGzip:
+	default:
+		slog.Warn("unknown aof_compression, segments are not compressed", slog.String("name", name), slog.String("aof_compression", codec))
+		return nil
+	}
+	c := &segmentCompressor{
+		name:            name,
+		codec:           codec,
+		segments:        atomic.NewInt64(0),
+		rawBytes:        atomic.NewInt64(0),
+		compressedBytes: atomic.NewInt64(0),
+	}
+	compressorsLock.Lock()
+	compressors = append(compressors, c)
+	compressorsLock.Unlock()
+	return c
+}
+
+// compress compresses the sealed segment fp in the background.
+func (c *segmentCompressor) compress(fp string) {
+	if c == nil {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if err := c.compressFile(fp); err != nil {
+			slog.Error("compress file error", slog.String("name", c.name), slog.String("filepath", fp), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// wait waits until the segments handed to compress are done.
+func (c *segmentCompressor) wait() {
+	if c == nil {
+		return
+	}
+	c.wg.Wait()
+}
+
+func (c *segmentCompressor) compressFile(fp string) error {
+	src, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// the compressed segment is encrypted when the raw one is
+	segment := &segmentFile{file: src, rd: src, path: fp}
+	if err = segment.decrypt(); err != nil {
+		return err
+	}
+	target := fp + compressedSuffix(c.codec)
+	tmp := target + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+	var out io.Writer = dst
+	if segment.enc != nil {
+		ring, err := encrypt.ConfigKeyRing()
+		if err != nil {
+			return err
+		}
+		if out, err = encrypt.NewWriter(dst, ring); err != nil {
+			return err
+		}
+	}
+
+	var encoder io.WriteCloser
+	if c.codec == CompressionZstd {
+		encoder, err = zstd.NewWriter(out)
+		if err != nil {
+			return err
+		}
+	} else {
+		encoder = gzip.NewWriter(out)
+	}
+	rawSize, err := io.Copy(encoder, segment.rd)
+	if err != nil {
+		_ = encoder.Close()
+		return err
+	}
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		return err
+	}
+	if err = os.Remove(fp); err != nil {
+		return err
+	}
+	c.segments.Inc()
+	c.rawBytes.Add(rawSize)
+	c.compressedBytes.Add(info.Size())
+	slog.Info("compress file success", slog.String("name", c.name), slog.String("filepath", target),
+		slog.Int64("rawSize", rawSize), slog.Int64("compressedSize", info.Size()))
+	return nil
+}
+
+// compressSealed compresses the raw segments of dir except the last, left raw by a
+// restart, and removes what a compression stopped in the middle left behind.
+func (c *segmentCompressor) compressSealed(dir string) {
+	if c == nil {
+		return
+	}
+	segments := listSegments(dir)
+	for i, s := range segments {
+		tmp := segmentPath(dir, s.number) + compressedSuffix(c.codec) + ".tmp"
+		_ = os.Remove(tmp)
+		if s.codec == "" && i < len(segments)-1 {
+			c.compress(s.path)
+		}
+	}
+}
+
+func (c *segmentCompressor) Status() interface{} {
+	ret := compressionStatus{
+		Name:            c.name,
+		Codec:           c.codec,
+		Segments:        c.segments.Load(),
+		RawBytes:        c.rawBytes.Load(),
+		CompressedBytes: c.compressedBytes.Load(),
+	}
+	if ret.CompressedBytes > 0 {
+		ret.Ratio = float64(ret.RawBytes) / float64(ret.CompressedBytes)
+	}
+	return ret
+}
+
+func compressionStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	compressorsLock.Lock()
+	ret := make([]interface{}, 0, len(compressors))
+	for _, c := range compressors {
+		ret = append(ret, c.Status())
+	}
+	compressorsLock.Unlock()
+	jsonBytes, _ := json.Marshal(ret)
+	_, _ = w.Write(jsonBytes)
+}
@@ -0,0 +1,101 @@
+package rotate
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func setTestCompression(t *testing.T, codec string) {
+	old := config.Opt.Advanced.AofCompression
+	config.Opt.Advanced.AofCompression = codec
+	t.Cleanup(func() { config.Opt.Advanced.AofCompression = old })
+}
+
+func testStream(count int) string {
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		b.WriteString(testCommand(i))
+	}
+	return b.String()
+}
+
+func Test_compression(t *testing.T) {
+	for _, codec := range []string{CompressionZstd, CompressionGzip} {
+		setTestCompression(t, codec)
+		dir := t.TempDir()
+		count := 2000
+		offsets := writeTestCommands(t, dir, count)
+
+		segments := listSegments(dir)
+		assert.True(t, len(segments) > 3)
+		for i, s := range segments {
+			if i < len(segments)-1 {
+				assert.Equal(t, codec, s.codec, s.path)
+			} else {
+				assert.Equal(t, "", s.codec, "the last segment is not rotated")
+			}
+		}
+
+		stream := testStream(count)
+		reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+		buf := make([]byte, len(stream))
+		_, err := io.ReadFull(reader, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, stream, string(buf))
+		_ = reader.Close()
+
+		// the index is rebuilt from compressed segments
+		for _, s := range segments {
+			_ = os.Remove(indexPath(segmentPath(dir, s.number)))
+		}
+		indexes, err := LoadIndex(dir)
+		assert.Nil(t, err)
+		checkTestIndex(t, indexes, count)
+		reader = NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+		offset, err := reader.SeekEntry(1500)
+		assert.Nil(t, err)
+		assert.Equal(t, offsets[1500], offset)
+		readTestCommand(t, reader, testCommand(1500))
+		_ = reader.Close()
+	}
+}
+
+func Test_compression_restart(t *testing.T) {
+	dir := t.TempDir()
+	setTestCompression(t, CompressionNone)
+	writeTestCommands(t, dir, 500)
+	segments := listSegments(dir)
+	assert.True(t, len(segments) > 1)
+	assert.Equal(t, "", segments[0].codec)
+
+	// a compression stopped in the middle
+	tmp := segmentPath(dir, 0) + ".zst.tmp"
+	assert.Nil(t, os.WriteFile(tmp, []byte("partial"), 0644))
+
+	setTestCompression(t, CompressionZstd)
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	writer.compressor.wait()
+	status := writer.compressor.Status().(compressionStatus)
+	assert.Equal(t, int64(len(segments)-1), status.Segments)
+	assert.True(t, status.Ratio > 1)
+	assert.Nil(t, writer.Close())
+
+	after := listSegments(dir)
+	assert.Equal(t, len(segments), len(after))
+	for i := range after[:len(after)-1] {
+		assert.Equal(t, CompressionZstd, after[i].codec)
+	}
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, 500)
+}
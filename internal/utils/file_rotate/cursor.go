@@ -0,0 +1,218 @@
+package rotate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CursorSuffix is the suffix of the file a durable cursor is saved in, "<name>.cursor"
+// next to the segments.
+const CursorSuffix = ".cursor"
+
+// Cursor is how far a named consumer of a directory got. The position is always
+// between two commands, so a consumer resuming there reads whole commands.
+type Cursor struct {
+	Name      string    `json:"name"`
+	FileIndex int64     `json:"file_index"`
+	Offset    int64     `json:"offset"`  // in the raw content of the segment
+	Entries   int64     `json:"entries"` // commands committed since the cursor was created
+	Time      time.Time `json:"time"`
+}
+
+func cursorPath(dir string, name string) string {
+	return filepath.Join(dir, name+CursorSuffix)
+}
+
+func checkCursorName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid cursor name [%s]", name)
+	}
+	return nil
+}
+
+// LoadCursor returns the cursor saved in dir, nil when there is none.
+func LoadCursor(dir string, name string) (*Cursor, error) {
+	if err := checkCursorName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(cursorPath(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cursor := new(Cursor)
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor file [%s]: %v", cursorPath(dir, name), err)
+	}
+	return cursor, nil
+}
+
+// saveCursor replaces the cursor file atomically and durably: a crash leaves the old
+// or the new cursor, never a mix.
+func saveCursor(dir string, cursor *Cursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	fp := cursorPath(dir, cursor.Name)
+	tmp := fp + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fp); err != nil {
+		return err
+	}
+	// the rename is durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}
+
+// RemoveCursor removes the cursor saved in dir, a consumer that is gone for good no
+// longer holds back retention.
+func RemoveCursor(dir string, name string) error {
+	if err := checkCursorName(name); err != nil {
+		return err
+	}
+	err := os.Remove(cursorPath(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// savedCursorPositions returns the file index of every cursor saved in dir.
+func savedCursorPositions(dir string) []int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var positions []int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), CursorSuffix) {
+			continue
+		}
+		cursor, err := LoadCursor(dir, strings.TrimSuffix(entry.Name(), CursorSuffix))
+		if err != nil || cursor == nil {
+			continue
+		}
+		positions = append(positions, cursor.FileIndex)
+	}
+	return positions
+}
+
+// cursorTracker follows the commands a reader returned, so the number of commands a
+// consumer acknowledged can be turned into a position. Positions are counted in bytes
+// returned by the reader since the committed cursor. Commit may be called while the
+// reader reads.
+type cursorTracker struct {
+	lock      sync.Mutex
+	dir       string
+	committed Cursor
+	scanner   *respScanner
+	starts    []int64      // of the commands read and not committed
+	files     []cursorFile // segments read since the committed cursor
+}
+
+type cursorFile struct {
+	index int64
+	start int64 // position of byte 0 of the segment
+}
+
+func newCursorTracker(dir string, committed Cursor) *cursorTracker {
+	return &cursorTracker{
+		dir:       dir,
+		committed: committed,
+		scanner:   &respScanner{},
+		files:     []cursorFile{{index: committed.FileIndex, start: -committed.Offset}},
+	}
+}
+
+// opened records that the bytes read from now on come from segment index.
+func (t *cursorTracker) opened(index int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	last := t.files[len(t.files)-1]
+	if last.index == index {
+		return
+	}
+	t.files = append(t.files, cursorFile{index: index, start: t.scanner.pos})
+}
+
+func (t *cursorTracker) read(p []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.scanner.scan(p, func(pos int64) {
+		t.starts = append(t.starts, pos)
+	})
+}
+
+// commit saves the cursor after the first entries commands counted by Cursor.Entries.
+func (t *cursorTracker) commit(entries int64) (Cursor, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := entries - t.committed.Entries
+	var pos int64
+	switch {
+	case n < 0:
+		return t.committed, fmt.Errorf("commit %d entries before the committed %d", entries, t.committed.Entries)
+	case n == 0:
+		return t.committed, nil
+	case n < int64(len(t.starts)):
+		pos = t.starts[n]
+	case n == int64(len(t.starts)) && t.scanner.atBoundary() && t.scanner.err == nil:
+		pos = t.scanner.lastEnd
+	default:
+		read := int64(len(t.starts))
+		if !t.scanner.atBoundary() {
+			read--
+		}
+		return t.committed, fmt.Errorf("commit %d entries, only %d are read", entries, t.committed.Entries+read)
+	}
+	i := len(t.files) - 1
+	for i > 0 && t.files[i].start > pos {
+		i--
+	}
+	cursor := Cursor{
+		Name:      t.committed.Name,
+		FileIndex: t.files[i].index,
+		Offset:    pos - t.files[i].start,
+		Entries:   entries,
+		Time:      time.Now(),
+	}
+	if err := saveCursor(t.dir, &cursor); err != nil {
+		return t.committed, err
+	}
+	t.committed = cursor
+	t.starts = t.starts[n:]
+	t.files = t.files[i:]
+	return cursor, nil
+}
+
+func (t *cursorTracker) cursor() Cursor {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.committed
+}
@@ -0,0 +1,113 @@
+package rotate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readTestCursor reads commands from..to with a reader of cursor name and commits every
+// commitEvery commands, it returns the last committed cursor.
+func readTestCursor(t *testing.T, dir string, name string, from int, to int, commitEvery int) Cursor {
+	reader, err := NewAofAddIndexCursorReader(context.Background(), name, dir)
+	assert.Nil(t, err)
+	defer reader.Close()
+	assert.Equal(t, int64(from), reader.Committed().Entries)
+	for i := from; i < to; i++ {
+		readTestCommand(t, reader, testCommand(i))
+		if (i+1)%commitEvery == 0 {
+			assert.Nil(t, reader.Commit(int64(i+1)))
+		}
+	}
+	return reader.Committed()
+}
+
+func checkTestCursor(t *testing.T, dir string, cursor Cursor, offsets []int64) {
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	idx, err := findSegmentByOffset(indexes, offsets[cursor.Entries])
+	assert.Nil(t, err)
+	if idx.Number != cursor.FileIndex {
+		// a command starting a segment may be at the end of the segment before it
+		assert.Equal(t, idx.Number-1, cursor.FileIndex)
+		idx = &indexes[cursor.FileIndex-indexes[0].Number]
+	}
+	assert.Equal(t, offsets[cursor.Entries], idx.StartOffset+cursor.Offset)
+}
+
+func Test_Cursor_resume(t *testing.T) {
+	for _, codec := range []string{CompressionNone, CompressionZstd} {
+		setTestCompression(t, codec)
+		dir := t.TempDir()
+		count := 1000
+		offsets := writeTestCommands(t, dir, count)
+
+		// two consumers of one dir go their own way
+		a := readTestCursor(t, dir, "consumerA", 0, 310, 100)
+		b := readTestCursor(t, dir, "consumerB", 0, 700, 13)
+		assert.Equal(t, int64(300), a.Entries)
+		assert.Equal(t, int64(689), b.Entries)
+		checkTestCursor(t, dir, a, offsets)
+		checkTestCursor(t, dir, b, offsets)
+
+		a = readTestCursor(t, dir, "consumerA", 300, 1000, 1)
+		b = readTestCursor(t, dir, "consumerB", 689, 1000, 1)
+		assert.Equal(t, int64(count), a.Entries)
+		assert.Equal(t, int64(count), b.Entries)
+
+		// every committed position is in the index
+		reader, err := NewAofAddIndexCursorReader(context.Background(), "consumerC", dir)
+		assert.Nil(t, err)
+		for i := 0; i < count-1; i++ {
+			readTestCommand(t, reader, testCommand(i))
+			if i%7 == 0 {
+				assert.Nil(t, reader.Commit(int64(i+1)))
+				checkTestCursor(t, dir, reader.Committed(), offsets)
+			}
+		}
+		assert.Nil(t, reader.Close())
+		assert.Nil(t, RemoveCursor(dir, "consumerC"))
+		saved, err := LoadCursor(dir, "consumerC")
+		assert.Nil(t, err)
+		assert.Nil(t, saved)
+	}
+}
+
+func Test_Cursor_commit(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCommands(t, dir, 100)
+	reader, err := NewAofAddIndexCursorReader(context.Background(), "consumer", dir)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	readTestCommand(t, reader, testCommand(0))
+	command := testCommand(1)
+	buf := make([]byte, len(command)-1)
+	_, err = reader.Read(buf)
+	assert.Nil(t, err)
+
+	// the second command is not read whole
+	assert.NotNil(t, reader.Commit(2))
+	assert.Nil(t, reader.Commit(1))
+	assert.Nil(t, reader.Commit(1))
+	assert.NotNil(t, reader.Commit(0))
+	assert.Equal(t, int64(1), reader.Committed().Entries)
+
+	_, err = NewAofAddIndexCursorReader(context.Background(), "../consumer", dir)
+	assert.NotNil(t, err)
+	plain := NewAofAddIndexReader(context.Background(), "plain", dir, 0)
+	defer plain.Close()
+	assert.NotNil(t, plain.Commit(1))
+}
+
+func Test_Retention_saved_cursor(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 5, 100)
+	assert.Nil(t, saveCursor(dir, &Cursor{Name: "consumer", FileIndex: 2}))
+
+	r := NewRetention("test", dir, RetentionPolicy{DeleteConsumed: true})
+	files, _ := r.Check()
+	assert.Equal(t, 2, files)
+	assert.Equal(t, []int64{2, 3, 4}, segmentNumbers(dir))
+}
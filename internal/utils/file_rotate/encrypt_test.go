@@ -0,0 +1,147 @@
+package rotate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/utils/encrypt"
+)
+
+func testEncryptionKey(t *testing.T) string {
+	key := make([]byte, encrypt.KeySize)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// setTestEncryption configures a key file with keys, the first one current. No keys
+// turns encryption off.
+func setTestEncryption(t *testing.T, keys ...string) {
+	old := config.Opt.Advanced.EncryptionKeyFile
+	config.Opt.Advanced.EncryptionKeyFile = ""
+	if len(keys) > 0 {
+		keyFile := filepath.Join(t.TempDir(), "keys")
+		assert.Nil(t, os.WriteFile(keyFile, []byte(strings.Join(keys, "\n")), 0600))
+		config.Opt.Advanced.EncryptionKeyFile = keyFile
+	}
+	t.Cleanup(func() { config.Opt.Advanced.EncryptionKeyFile = old })
+}
+
+func readTestStream(t *testing.T, dir string, expected string) {
+	reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+	defer reader.Close()
+	readTestCommand(t, reader, expected)
+}
+
+func Test_encryption(t *testing.T) {
+	setTestEncryption(t, testEncryptionKey(t))
+	for _, codec := range []string{"", CompressionZstd} {
+		setTestCompression(t, codec)
+		dir := t.TempDir()
+		count := 2000
+		offsets := writeTestCommands(t, dir, count)
+
+		segments := listSegments(dir)
+		assert.True(t, len(segments) > 3)
+		for _, s := range segments {
+			data, err := os.ReadFile(s.path)
+			assert.Nil(t, err)
+			assert.False(t, bytes.Contains(data, []byte("SET")), s.path)
+			if s.codec == "" {
+				assert.True(t, encrypt.IsEncryptedFile(s.path), s.path)
+			}
+		}
+		stream := testStream(count)
+		readTestStream(t, dir, stream)
+
+		// the index is rebuilt from encrypted segments
+		for _, s := range segments {
+			_ = os.Remove(indexPath(segmentPath(dir, s.number)))
+		}
+		indexes, err := LoadIndex(dir)
+		assert.Nil(t, err)
+		checkTestIndex(t, indexes, count)
+
+		reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+		assert.Nil(t, reader.SeekOffset(offsets[1234]))
+		readTestCommand(t, reader, stream[offsets[1234]:])
+		_ = reader.Close()
+	}
+
+	// without the key the segments can not be read
+	setTestCompression(t, "")
+	dir := t.TempDir()
+	writeTestCommands(t, dir, 100)
+	setTestEncryption(t, testEncryptionKey(t))
+	_, err := openSegmentFile(dir, 0)
+	assert.NotNil(t, err)
+}
+
+func Test_encryption_verify(t *testing.T) {
+	setTestEncryption(t, testEncryptionKey(t))
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+	last := lastTestSegment(t, dir)
+	ring, err := encrypt.ConfigKeyRing()
+	assert.Nil(t, err)
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	w, err := encrypt.OpenAppend(file, ring)
+	assert.Nil(t, err)
+	partial := testCommand(count)[:20]
+	_, err = w.Write([]byte(partial))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	report, err := VerifyDir(dir, false, true)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(len(partial)), report.Truncated)
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, count)
+
+	// writes go on after the cut
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte(testCommand(count)))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	readTestStream(t, dir, testStream(count+1))
+}
+
+func Test_encryption_keys(t *testing.T) {
+	dir := t.TempDir()
+	count := 500
+	writeTestCommands(t, dir, count)
+
+	// segments written before encryption stay readable, new ones are encrypted
+	oldKey, newKey := testEncryptionKey(t), testEncryptionKey(t)
+	setTestEncryption(t, oldKey)
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte(testCommand(count)))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	last := lastTestSegment(t, dir)
+	assert.True(t, encrypt.IsEncryptedFile(last.path))
+	readTestStream(t, dir, testStream(count+1))
+
+	// after a rotation the data keys are wrapped by the new key, the old one can go
+	setTestEncryption(t, newKey, oldKey)
+	writer, err = NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	setTestEncryption(t, newKey)
+	readTestStream(t, dir, testStream(count+1))
+}
@@ -0,0 +1,208 @@
+package rotate
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/status"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+// fileSyncer fsyncs the file a writer appends to by the aof_fsync policy, like the
+// appendfsync of redis. Offsets count the bytes the writer wrote. An fsync makes
+// everything written before it durable, so with always the writes waiting while an
+// fsync runs are committed together by the next one.
+type fileSyncer struct {
+	name   string
+	policy string
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	file    *os.File // nil between segments
+	written int64
+	syncing bool
+	pending bool // an everysec fsync is scheduled
+
+	synced *atomic.Int64
+	syncs  *atomic.Int64
+}
+
+type fsyncStatus struct {
+	Name    string `json:"name"`
+	Policy  string `json:"policy"`
+	Written int64  `json:"written"`
+	Synced  int64  `json:"synced"`
+	Syncs   int64  `json:"syncs"`
+}
+
+var (
+	syncersLock sync.Mutex
+	syncers     []*fileSyncer
+)
+
+func init() {
+	status.RegisterHandler("/fsync", fsyncStatusHandler)
+}
+
+// newFileSyncer returns the syncer of aof_fsync for a writer at offset. An unknown
+// policy is everysec, the default of redis.
+func newFileSyncer(name string, offset int64) *fileSyncer {
+	policy := config.Opt.Advanced.AofFsync
+	switch policy {
+	case FsyncAlways, FsyncEverysec, FsyncNo:
+	case "":
+		policy = FsyncEverysec
+	default:
+		slog.Warn("unknown aof_fsync, use everysec", slog.String("name", name), slog.String("aof_fsync", policy))
+		policy = FsyncEverysec
+	}
+	s := &fileSyncer{
+		name:    name,
+		policy:  policy,
+		written: offset,
+		synced:  atomic.NewInt64(offset),
+		syncs:   atomic.NewInt64(0),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	syncersLock.Lock()
+	syncers = append(syncers, s)
+	syncersLock.Unlock()
+	return s
+}
+
+// unregister removes the syncer from the status once its writer is closed for good.
+func (s *fileSyncer) unregister() {
+	syncersLock.Lock()
+	defer syncersLock.Unlock()
+	for i, registered := range syncers {
+		if registered == s {
+			syncers = append(syncers[:i], syncers[i+1:]...)
+			return
+		}
+	}
+}
+
+// flush is the scheduled fsync of everysec.
+func (s *fileSyncer) flush() {
+	s.lock.Lock()
+	s.pending = false
+	offset := s.written
+	s.lock.Unlock()
+	if err := s.wait(offset); err != nil {
+		slog.Error("fsync file error", slog.String("name", s.name), slog.String("error", err.Error()))
+	}
+}
+
+// open sets the file the next writes go to.
+func (s *fileSyncer) open(file *os.File) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.file = file
+}
+
+// wrote records the writer is at offset. With always it waits until offset is durable,
+// with everysec an fsync is scheduled within a second.
+func (s *fileSyncer) wrote(offset int64) error {
+	s.lock.Lock()
+	s.written = max(s.written, offset)
+	if s.policy == FsyncEverysec && !s.pending {
+		s.pending = true
+		time.AfterFunc(time.Second, s.flush)
+	}
+	s.lock.Unlock()
+	if s.policy != FsyncAlways {
+		return nil
+	}
+	return s.wait(offset)
+}
+
+// wait returns when offset is durable. It runs an fsync when none is running, or
+// waits for the running one and then runs one more if it was not enough.
+func (s *fileSyncer) wait(offset int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.synced.Load() < offset {
+		if s.syncing || s.file == nil {
+			// a file being closed is synced by the writer
+			s.cond.Wait()
+			continue
+		}
+		file, target := s.file, s.written
+		s.syncing = true
+		s.lock.Unlock()
+		err := file.Sync()
+		s.lock.Lock()
+		s.syncing = false
+		if err == nil {
+			s.syncs.Inc()
+			s.synced.Store(max(s.synced.Load(), target))
+		}
+		s.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close is called before the writer syncs and closes the file, it waits for a running
+// fsync to finish. The writer reports the file closed with closed, or open again
+// with open when it fails.
+func (s *fileSyncer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.syncing {
+		s.cond.Wait()
+	}
+	s.file = nil
+}
+
+// closed records that everything written is durable, the file was synced and closed.
+func (s *fileSyncer) closed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced.Store(s.written)
+	s.cond.Broadcast()
+}
+
+// Synced returns the offset before which everything is durable.
+func (s *fileSyncer) Synced() int64 {
+	return s.synced.Load()
+}
+
+func (s *fileSyncer) Status() interface{} {
+	s.lock.Lock()
+	written := s.written
+	s.lock.Unlock()
+	return fsyncStatus{
+		Name:    s.name,
+		Policy:  s.policy,
+		Written: written,
+		Synced:  s.synced.Load(),
+		Syncs:   s.syncs.Load(),
+	}
+}
+
+func fsyncStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	syncersLock.Lock()
+	ret := make([]interface{}, 0, len(syncers))
+	for _, s := range syncers {
+		ret = append(ret, s.Status())
+	}
+	syncersLock.Unlock()
+	jsonBytes, _ := json.Marshal(ret)
+	_, _ = w.Write(jsonBytes)
+}
@@ -0,0 +1,114 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func setTestFsync(t *testing.T, policy string) {
+	old := config.Opt.Advanced.AofFsync
+	config.Opt.Advanced.AofFsync = policy
+	t.Cleanup(func() { config.Opt.Advanced.AofFsync = old })
+}
+
+func Test_fsync_always(t *testing.T) {
+	setTestFsync(t, FsyncAlways)
+	writer, err := NewAofAddIndexWriter("testWriter", t.TempDir(), 4*1024)
+	assert.Nil(t, err)
+	var offset int64
+	for i := 0; i < 200; i++ {
+		n, err := writer.Write([]byte(testCommand(i)))
+		assert.Nil(t, err)
+		offset += int64(n)
+		assert.Equal(t, offset, writer.Synced())
+	}
+	assert.Nil(t, writer.Close())
+	assert.Equal(t, offset, writer.Synced())
+}
+
+func registeredSyncer(s *fileSyncer) bool {
+	syncersLock.Lock()
+	defer syncersLock.Unlock()
+	for _, registered := range syncers {
+		if registered == s {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_fsync_unregister(t *testing.T) {
+	writer, err := NewAofAddIndexWriter("testWriter", t.TempDir(), 1024)
+	assert.Nil(t, err)
+	// the syncer stays across segments
+	for i := 0; i < 100; i++ {
+		_, err = writer.Write([]byte(testCommand(i)))
+		assert.Nil(t, err)
+	}
+	assert.True(t, registeredSyncer(writer.syncer))
+	assert.Nil(t, writer.Close())
+	assert.False(t, registeredSyncer(writer.syncer))
+}
+
+func Test_fsync_everysec(t *testing.T) {
+	setTestFsync(t, FsyncEverysec)
+	writer, err := NewAofAddIndexWriter("testWriter", t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+	n, err := writer.Write([]byte(testCommand(0)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), writer.Synced())
+	assert.Eventually(t, func() bool { return writer.Synced() == int64(n) }, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, int64(1), writer.syncer.syncs.Load())
+	assert.Nil(t, writer.Close())
+}
+
+func Test_fsync_no(t *testing.T) {
+	setTestFsync(t, FsyncNo)
+	writer, err := NewAofAddIndexWriter("testWriter", t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+	n, err := writer.Write([]byte(testCommand(0)))
+	assert.Nil(t, err)
+	time.Sleep(1200 * time.Millisecond)
+	assert.Equal(t, int64(0), writer.Synced())
+	// close always syncs
+	assert.Nil(t, writer.Close())
+	assert.Equal(t, int64(n), writer.Synced())
+}
+
+func Test_fsync_group_commit(t *testing.T) {
+	setTestFsync(t, FsyncAlways)
+	file, err := os.Create(filepath.Join(t.TempDir(), "0.aof"))
+	assert.Nil(t, err)
+	defer file.Close()
+	s := newFileSyncer("testSyncer", 0)
+	s.open(file)
+
+	var lock sync.Mutex
+	var offset int64
+	var wg sync.WaitGroup
+	count := 64
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock.Lock()
+			n, err := file.WriteString(testCommand(i))
+			assert.Nil(t, err)
+			offset += int64(n)
+			written := offset
+			lock.Unlock()
+			assert.Nil(t, s.wrote(written))
+			assert.True(t, s.Synced() >= written)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, offset, s.Synced())
+	assert.True(t, s.syncs.Load() <= int64(count))
+}
@@ -0,0 +1,149 @@
+package rotate
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// pollInterval is how often readers check a directory that is not watched.
+	pollInterval = 100 * time.Millisecond
+	// watchedPollInterval is how often readers check a watched directory anyway, an
+	// event can be missed, on network file systems for example.
+	watchedPollInterval = time.Second
+)
+
+// dirNotifier wakes up the readers of a directory when a segment of it is written or
+// created. A writer in this process signals it directly, one in another process is
+// seen by fsnotify.
+type dirNotifier struct {
+	dir string
+
+	lock    sync.Mutex
+	ch      chan struct{} // closed by the next signal
+	waiting bool          // ch was taken since the last signal
+	readers int
+	watched bool // fsnotify watches dir
+}
+
+type notifierRegistry struct {
+	lock      sync.Mutex
+	notifiers map[string]*dirNotifier
+	watcher   *fsnotify.Watcher // nil when fsnotify is not available
+	once      sync.Once
+}
+
+var notifiers = notifierRegistry{
+	notifiers: make(map[string]*dirNotifier),
+}
+
+// dirNotifierOf returns the notifier of dir, shared by the readers and writers of it.
+func dirNotifierOf(dir string) *dirNotifier {
+	dir = filepath.Clean(dir)
+	notifiers.lock.Lock()
+	defer notifiers.lock.Unlock()
+	n, ok := notifiers.notifiers[dir]
+	if !ok {
+		n = &dirNotifier{dir: dir, ch: make(chan struct{})}
+		notifiers.notifiers[dir] = n
+	}
+	return n
+}
+
+func startWatcher() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("fsnotify is not available, readers poll", slog.String("error", err.Error()))
+		return
+	}
+	notifiers.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				notifiers.lock.Lock()
+				n := notifiers.notifiers[filepath.Dir(event.Name)]
+				notifiers.lock.Unlock()
+				n.signal()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("fsnotify error", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// watchDir returns the notifier of dir for a reader, call unwatch when the reader is done.
+// dir is watched by fsnotify while it has readers.
+func watchDir(dir string) *dirNotifier {
+	n := dirNotifierOf(dir)
+	notifiers.once.Do(startWatcher)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.readers++
+	if n.readers == 1 && notifiers.watcher != nil {
+		if err := notifiers.watcher.Add(n.dir); err != nil {
+			slog.Warn("fsnotify watch dir error, readers poll", slog.String("dir", n.dir), slog.String("error", err.Error()))
+		} else {
+			n.watched = true
+		}
+	}
+	return n
+}
+
+func (n *dirNotifier) unwatch() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.readers--
+	if n.readers == 0 && n.watched {
+		_ = notifiers.watcher.Remove(n.dir)
+		n.watched = false
+	}
+}
+
+// changed returns a channel closed by the next signal. Take it before checking the
+// directory, so a change after the check is not missed.
+func (n *dirNotifier) changed() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.waiting = true
+	return n.ch
+}
+
+// interval is how often a reader checks dir without a signal.
+func (n *dirNotifier) interval() time.Duration {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.watched {
+		return watchedPollInterval
+	}
+	return pollInterval
+}
+
+// signal wakes up the readers waiting for a change, nil-safe.
+func (n *dirNotifier) signal() {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.waiting {
+		// writers signal every write, nobody waits most of the time
+		return
+	}
+	close(n.ch)
+	n.ch = make(chan struct{})
+	n.waiting = false
+}
@@ -0,0 +1,84 @@
+package rotate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dirNotifier(t *testing.T) {
+	n := dirNotifierOf(t.TempDir())
+	n.signal() // nobody waits
+	changed := n.changed()
+	select {
+	case <-changed:
+		t.Fatal("changed before a signal")
+	default:
+	}
+	n.signal()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("not changed after a signal")
+	}
+	assert.NotEqual(t, changed, n.changed())
+}
+
+// readAfterWrite waits until the reader returns command while write is called
+// 200ms later, and returns how long the reader took after write.
+func readAfterWrite(t *testing.T, reader *AofAddIndexReader, command string, write func()) time.Duration {
+	done := make(chan time.Time)
+	go func() {
+		readTestCommand(t, reader, command)
+		done <- time.Now()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	writtenAt := time.Now()
+	write()
+	select {
+	case readAt := <-done:
+		return readAt.Sub(writtenAt)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader did not wake up")
+		return 0
+	}
+}
+
+func Test_AofAddIndexReader_notify_writer(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 200)
+	assert.Nil(t, err)
+	defer writer.Close()
+	reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+	defer reader.Close()
+
+	for i := 0; i < 5; i++ {
+		command := testCommand(i)
+		elapsed := readAfterWrite(t, reader, command, func() {
+			_, err := writer.Write([]byte(command))
+			assert.Nil(t, err)
+		})
+		// woken up by the writer, not by a poll
+		assert.Less(t, elapsed, 50*time.Millisecond)
+	}
+}
+
+func Test_AofAddIndexReader_notify_fsnotify(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCommands(t, dir, 1)
+	reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+	defer reader.Close()
+	if !reader.notifier.watched {
+		t.Skip("fsnotify is not available")
+	}
+	readTestCommand(t, reader, testCommand(0))
+
+	// a writer in another process is seen by fsnotify
+	command := testCommand(1)
+	elapsed := readAfterWrite(t, reader, command, func() {
+		appendTestFile(t, segmentPath(dir, 0), command)
+	})
+	assert.Less(t, elapsed, watchedPollInterval/2)
+}
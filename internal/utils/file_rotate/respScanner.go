@@ -0,0 +1,149 @@
+package rotate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// maxHeaderLine is the longest header or inline command line, a longer one means
+// the stream is not RESP.
+const maxHeaderLine = 64 * 1024
+
+// respScanner finds where the commands of a replication stream start and end
+// without parsing them. It is fed the stream in pieces of any size, and its state
+// can be saved, because a command may be split across two segments.
+type respScanner struct {
+	pos     int64   // bytes scanned
+	bulk    int64   // bytes of a bulk string and its CRLF still to skip
+	line    []byte  // the header line being read
+	pending []int64 // elements left in the arrays being read
+	inEntry bool    // in the middle of a command
+	lastEnd int64   // pos after the last complete command
+	err     error
+}
+
+// scan feeds p, onStart is called with the position of every command that starts.
+func (s *respScanner) scan(p []byte, onStart func(pos int64)) {
+	for i := 0; i < len(p) && s.err == nil; {
+		if s.bulk > 0 {
+			n := min(s.bulk, int64(len(p)-i))
+			s.bulk -= n
+			s.pos += n
+			i += int(n)
+			if s.bulk == 0 {
+				s.elementDone()
+			}
+			continue
+		}
+		if !s.inEntry {
+			// newlines between commands are keepalives of the master
+			if p[i] == '\r' || p[i] == '\n' {
+				i++
+				s.pos++
+				s.lastEnd = s.pos
+				continue
+			}
+			s.inEntry = true
+			if onStart != nil {
+				onStart(s.pos)
+			}
+		}
+		j := bytes.IndexByte(p[i:], '\n')
+		if j < 0 {
+			s.line = append(s.line, p[i:]...)
+			s.pos += int64(len(p) - i)
+			if len(s.line) > maxHeaderLine {
+				s.err = fmt.Errorf("line longer than %d bytes at offset %d", maxHeaderLine, s.pos)
+			}
+			return
+		}
+		s.line = append(s.line, p[i:i+j]...)
+		s.pos += int64(j + 1)
+		i += j + 1
+		s.header(bytes.TrimSuffix(s.line, []byte{'\r'}))
+		s.line = s.line[:0]
+	}
+}
+
+func (s *respScanner) header(line []byte) {
+	if len(line) == 0 {
+		s.err = fmt.Errorf("empty line at offset %d", s.pos)
+		return
+	}
+	switch line[0] {
+	case '*', '$':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			s.err = fmt.Errorf("invalid length [%s] at offset %d", line, s.pos)
+			return
+		}
+		if line[0] == '$' && n >= 0 {
+			s.bulk = n + 2
+			return
+		}
+		if line[0] == '*' && n > 0 {
+			s.pending = append(s.pending, n)
+			return
+		}
+	case '+', '-', ':':
+	default:
+		// inline command, only at the top level
+		if len(s.pending) > 0 {
+			s.err = fmt.Errorf("invalid element [%s] at offset %d", line, s.pos)
+			return
+		}
+	}
+	s.elementDone()
+}
+
+func (s *respScanner) elementDone() {
+	for len(s.pending) > 0 {
+		top := len(s.pending) - 1
+		s.pending[top]--
+		if s.pending[top] > 0 {
+			return
+		}
+		s.pending = s.pending[:top]
+	}
+	s.inEntry = false
+	s.lastEnd = s.pos
+}
+
+// atBoundary tells whether the scanned bytes end between two commands.
+func (s *respScanner) atBoundary() bool {
+	return !s.inEntry && s.bulk == 0 && len(s.line) == 0
+}
+
+// marshalState encodes what is needed to go on scanning at pos in another process.
+func (s *respScanner) marshalState() []byte {
+	buf := new(bytes.Buffer)
+	inEntry := int64(0)
+	if s.inEntry {
+		inEntry = 1
+	}
+	_ = binary.Write(buf, binary.LittleEndian, []int64{s.bulk, inEntry, int64(len(s.pending)), int64(len(s.line))})
+	_ = binary.Write(buf, binary.LittleEndian, s.pending)
+	buf.Write(s.line)
+	return buf.Bytes()
+}
+
+func unmarshalScanner(data []byte, pos int64) (*respScanner, error) {
+	rd := bytes.NewReader(data)
+	head := make([]int64, 4)
+	if err := binary.Read(rd, binary.LittleEndian, head); err != nil {
+		return nil, err
+	}
+	if head[2] < 0 || head[3] < 0 || head[2]*8+head[3] != int64(rd.Len()) {
+		return nil, fmt.Errorf("invalid scanner state")
+	}
+	s := &respScanner{pos: pos, lastEnd: pos, bulk: head[0], inEntry: head[1] == 1}
+	s.pending = make([]int64, head[2])
+	if err := binary.Read(rd, binary.LittleEndian, s.pending); err != nil {
+		return nil, err
+	}
+	s.line = make([]byte, head[3])
+	_, _ = rd.Read(s.line)
+	return s, nil
+}
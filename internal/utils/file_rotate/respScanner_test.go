@@ -0,0 +1,53 @@
+package rotate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_respScanner(t *testing.T) {
+	commands := []string{
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n",
+		"\n", // keepalive
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$4\r\n\r\n\r\n\r\n",
+		"PING\r\n",
+		"*1\r\n*0\r\n",
+	}
+	stream := ""
+	var starts []int64
+	for _, command := range commands {
+		if command != "\n" {
+			starts = append(starts, int64(len(stream)))
+		}
+		stream += command
+	}
+	// any split gives the same result
+	for split := 0; split <= len(stream); split++ {
+		s := new(respScanner)
+		var got []int64
+		onStart := func(pos int64) { got = append(got, pos) }
+		s.scan([]byte(stream[:split]), onStart)
+
+		// go on with a saved state, as in the next segment
+		s, err := unmarshalScanner(s.marshalState(), s.pos)
+		assert.Nil(t, err)
+		s.scan([]byte(stream[split:]), onStart)
+		assert.Nil(t, s.err)
+		assert.Equal(t, starts, got, split)
+		assert.True(t, s.atBoundary())
+		assert.Equal(t, int64(len(stream)), s.lastEnd)
+	}
+}
+
+func Test_respScanner_partial(t *testing.T) {
+	s := new(respScanner)
+	s.scan([]byte("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r"), nil)
+	assert.Nil(t, s.err)
+	assert.False(t, s.atBoundary())
+	assert.Equal(t, int64(14), s.lastEnd)
+
+	s = new(respScanner)
+	s.scan([]byte("*2\r\n$x\r\n"), nil)
+	assert.NotNil(t, s.err)
+}
@@ -0,0 +1,328 @@
+package rotate
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/status"
+)
+
+// RetentionPolicy decides which rotated segments are deleted. Only the oldest
+// segments are deleted, so the remaining ones are still contiguous, and the last
+// segment (being written) and segments open in this process are always kept.
+type RetentionPolicy struct {
+	MaxTotalBytes  int64         // delete the oldest segments while the dir is larger, 0 for no limit
+	MaxAge         time.Duration // delete segments not written for longer, 0 for no limit
+	DeleteConsumed bool          // delete segments all registered cursors have read past
+	Interval       time.Duration // how often Run checks
+}
+
+func (p *RetentionPolicy) enabled() bool {
+	return p.MaxTotalBytes > 0 || p.MaxAge > 0 || p.DeleteConsumed
+}
+
+// ConfigRetentionPolicy returns the policy of the aof_retention_* options.
+func ConfigRetentionPolicy() RetentionPolicy {
+	opts := &config.Opt.Advanced
+	return RetentionPolicy{
+		MaxTotalBytes:  opts.AofRetentionMaxBytes,
+		MaxAge:         time.Duration(opts.AofRetentionMaxAgeSec) * time.Second,
+		DeleteConsumed: opts.AofRetentionDeleteConsumed,
+		Interval:       time.Duration(opts.AofRetentionIntervalSec) * time.Second,
+	}
+}
+
+type Retention struct {
+	name   string
+	dir    string
+	policy RetentionPolicy
+	// truncate, when set, deletes the data before an offset of the stream instead of the
+	// retention deleting segments, for dirs whose owner has to know what is gone
+	truncate func(offset int64) error
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	runs         *atomic.Int64
+	deletedFiles *atomic.Int64
+	deletedBytes *atomic.Int64
+	files        *atomic.Int64
+	totalBytes   *atomic.Int64
+}
+
+type retentionStatus struct {
+	Name         string `json:"name"`
+	Dir          string `json:"dir"`
+	Runs         int64  `json:"runs"`
+	DeletedFiles int64  `json:"deleted_files"`
+	DeletedBytes int64  `json:"deleted_bytes"`
+	Files        int64  `json:"files"`
+	TotalBytes   int64  `json:"total_bytes"`
+}
+
+// retentions are the running retentions by dir, one per dir.
+var (
+	retentionsLock sync.Mutex
+	retentions     = make(map[string]*Retention)
+)
+
+func init() {
+	status.RegisterHandler("/retention", retentionStatusHandler)
+}
+
+// NewRetention returns the retention of the aof segments in dir, nil when the policy
+// deletes nothing.
+func NewRetention(name string, dir string, policy RetentionPolicy) *Retention {
+	if !policy.enabled() {
+		return nil
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = time.Minute
+	}
+	r := &Retention{
+		name:         name,
+		dir:          dir,
+		policy:       policy,
+		runs:         atomic.NewInt64(0),
+		deletedFiles: atomic.NewInt64(0),
+		deletedBytes: atomic.NewInt64(0),
+		files:        atomic.NewInt64(0),
+		totalBytes:   atomic.NewInt64(0),
+	}
+	return r
+}
+
+// NewTruncateRetention is NewRetention for a dir owned by a storage. The segments the
+// policy allows to delete are handed to truncate as the end offset of the last one,
+// truncate deletes them, see RemoveSegmentsBefore.
+func NewTruncateRetention(name string, dir string, policy RetentionPolicy, truncate func(offset int64) error) *Retention {
+	r := NewRetention(name, dir, policy)
+	if r != nil {
+		r.truncate = truncate
+	}
+	return r
+}
+
+// Run checks every policy.Interval until ctx is done or Stop is called. Only one
+// retention runs on a dir, Run returns false when another one runs already.
+func (r *Retention) Run(ctx context.Context) bool {
+	if r == nil {
+		return false
+	}
+	retentionsLock.Lock()
+	if running, ok := retentions[r.dir]; ok {
+		retentionsLock.Unlock()
+		slog.Warn("retention runs on dir already", slog.String("name", r.name), slog.String("dir", r.dir), slog.String("running", running.name))
+		return false
+	}
+	retentions[r.dir] = r
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	retentionsLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(r.policy.Interval)
+		defer func() {
+			ticker.Stop()
+			retentionsLock.Lock()
+			delete(retentions, r.dir)
+			retentionsLock.Unlock()
+			close(r.done)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Check()
+			}
+		}
+	}()
+	return true
+}
+
+// Stop stops a running retention and waits until it is unregistered, so another
+// retention can run on the dir.
+func (r *Retention) Stop() {
+	if r == nil || r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// Check deletes the segments the policy allows and returns what it freed.
+func (r *Retention) Check() (files int, bytes int64) {
+	r.runs.Inc()
+	segments := listSegments(r.dir)
+	var total int64
+	for _, s := range segments {
+		total += s.size
+	}
+	positions := cursorPositions(r.dir)
+	now := time.Now()
+
+	kept := len(segments)
+	owned := 0
+	for i := 0; i < len(segments)-1; i++ {
+		s := segments[i]
+		if isOpen(s.path) {
+			break
+		}
+		reason := ""
+		switch {
+		case r.policy.DeleteConsumed && consumed(segments[i+1].number, positions):
+			reason = "consumed"
+		case r.policy.MaxTotalBytes > 0 && total > r.policy.MaxTotalBytes:
+			reason = "size"
+		case r.policy.MaxAge > 0 && now.Sub(s.modTime) > r.policy.MaxAge:
+			reason = "age"
+		}
+		if reason == "" {
+			break
+		}
+		if r.truncate != nil {
+			// the owner deletes the segments after the loop
+			total -= s.size
+			owned = i + 1
+			continue
+		}
+		if err := os.Remove(s.path); err != nil {
+			slog.Error("retention remove file error", slog.String("name", r.name), slog.String("filepath", s.path), slog.String("error", err.Error()))
+			break
+		}
+		_ = os.Remove(indexPath(segmentPath(r.dir, s.number)))
+		slog.Info("retention remove file success", slog.String("name", r.name), slog.String("filepath", s.path), slog.Int64("filesize", s.size), slog.String("reason", reason))
+		total -= s.size
+		kept--
+		files++
+		bytes += s.size
+	}
+	if owned > 0 {
+		files, bytes = r.truncateSegments(segments, owned)
+		total = SegmentsSize(r.dir)
+		kept = len(segments) - files
+	}
+	r.deletedFiles.Add(int64(files))
+	r.deletedBytes.Add(bytes)
+	r.files.Store(int64(kept))
+	r.totalBytes.Store(total)
+	if files > 0 {
+		slog.Info("retention freed files", slog.String("name", r.name), slog.String("dir", r.dir), slog.Int("files", files), slog.Int64("bytes", bytes), slog.Int64("totalBytes", total))
+	}
+	return files, bytes
+}
+
+// truncateSegments hands the end of the first n segments to the truncate func and
+// returns the segments it deleted.
+func (r *Retention) truncateSegments(segments []segment, n int) (files int, bytes int64) {
+	indexes, err := LoadIndex(r.dir)
+	if err != nil {
+		slog.Error("retention load index error", slog.String("name", r.name), slog.String("dir", r.dir), slog.String("error", err.Error()))
+		return 0, 0
+	}
+	last := segments[n-1].number
+	offset := int64(-1)
+	for _, index := range indexes {
+		if index.Number == last {
+			offset = index.EndOffset
+		}
+	}
+	if offset < 0 {
+		return 0, 0
+	}
+	if err = r.truncate(offset); err != nil {
+		slog.Error("retention truncate error", slog.String("name", r.name), slog.String("dir", r.dir), slog.Int64("offset", offset), slog.String("error", err.Error()))
+	}
+	left := make(map[int64]bool)
+	for _, s := range listSegments(r.dir) {
+		left[s.number] = true
+	}
+	for _, s := range segments[:n] {
+		if !left[s.number] {
+			files++
+			bytes += s.size
+		}
+	}
+	return files, bytes
+}
+
+// RemoveSegmentsBefore deletes the oldest segments of dir that end at or before offset
+// of the stream, see SegmentIndex. Like retention, it keeps the last segment and
+// segments open in this process.
+func RemoveSegmentsBefore(dir string, offset int64) (files int, err error) {
+	indexes, err := LoadIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	segments := listSegments(dir)
+	for i := 0; i < len(indexes)-1 && i < len(segments)-1; i++ {
+		s := segments[i]
+		if indexes[i].Number != s.number || indexes[i].EndOffset > offset || isOpen(s.path) {
+			break
+		}
+		if err = os.Remove(s.path); err != nil {
+			return files, err
+		}
+		_ = os.Remove(indexPath(segmentPath(dir, s.number)))
+		slog.Info("remove file before offset success", slog.String("filepath", s.path), slog.Int64("endOffset", indexes[i].EndOffset), slog.Int64("offset", offset))
+		files++
+	}
+	return files, nil
+}
+
+// SegmentsSize returns the bytes the segments of dir take on disk.
+func SegmentsSize(dir string) int64 {
+	var total int64
+	for _, s := range listSegments(dir) {
+		total += s.size
+	}
+	return total
+}
+
+// consumed tells whether every cursor is at or past next, the start of the next segment.
+// Nothing is consumed when there is no cursor.
+func consumed(next int64, positions []int64) bool {
+	if len(positions) == 0 {
+		return false
+	}
+	for _, position := range positions {
+		if position < next {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Retention) Status() interface{} {
+	return retentionStatus{
+		Name:         r.name,
+		Dir:          r.dir,
+		Runs:         r.runs.Load(),
+		DeletedFiles: r.deletedFiles.Load(),
+		DeletedBytes: r.deletedBytes.Load(),
+		Files:        r.files.Load(),
+		TotalBytes:   r.totalBytes.Load(),
+	}
+}
+
+func retentionStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	retentionsLock.Lock()
+	ret := make([]retentionStatus, 0, len(retentions))
+	for _, r := range retentions {
+		ret = append(ret, r.Status().(retentionStatus))
+	}
+	retentionsLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Dir < ret[j].Dir })
+	jsonBytes, _ := json.Marshal(ret)
+	_, _ = w.Write(jsonBytes)
+}
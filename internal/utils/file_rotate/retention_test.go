@@ -0,0 +1,130 @@
+package rotate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestSegments(t *testing.T, dir string, count int, size int) {
+	for i := 0; i < count; i++ {
+		fp := filepath.Join(dir, fmt.Sprintf("%d.aof", i))
+		assert.Nil(t, os.WriteFile(fp, make([]byte, size), 0644))
+	}
+}
+
+func segmentNumbers(dir string) []int64 {
+	return ScanAddIndexSuffixFiles(dir, ".aof")
+}
+
+func Test_Retention_size(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 4, 100)
+	r := NewRetention("test", dir, RetentionPolicy{MaxTotalBytes: 250})
+	files, bytes := r.Check()
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(200), bytes)
+	assert.Equal(t, []int64{2, 3}, segmentNumbers(dir))
+
+	// the last segment is being written, it is kept whatever its size
+	r = NewRetention("test", dir, RetentionPolicy{MaxTotalBytes: 1})
+	r.Check()
+	assert.Equal(t, []int64{3}, segmentNumbers(dir))
+}
+
+func Test_Retention_open(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 4, 100)
+	fp := filepath.Join(dir, "1.aof")
+	markOpen(fp)
+	r := NewRetention("test", dir, RetentionPolicy{MaxTotalBytes: 1})
+	files, _ := r.Check()
+	assert.Equal(t, 1, files)
+	assert.Equal(t, []int64{1, 2, 3}, segmentNumbers(dir))
+
+	markClosed(fp)
+	r.Check()
+	assert.Equal(t, []int64{3}, segmentNumbers(dir))
+}
+
+func Test_Retention_consumed(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 4, 100)
+	r := NewRetention("test", dir, RetentionPolicy{DeleteConsumed: true})
+	files, _ := r.Check()
+	assert.Equal(t, 0, files, "nothing is consumed without cursors")
+
+	unregisterA := RegisterCursor(dir, "a", func() int64 { return 2 })
+	unregisterB := RegisterCursor(dir, "b", func() int64 { return 1 })
+	r.Check()
+	assert.Equal(t, []int64{1, 2, 3}, segmentNumbers(dir))
+	unregisterB()
+	r.Check()
+	assert.Equal(t, []int64{2, 3}, segmentNumbers(dir))
+	unregisterA()
+}
+
+func Test_Retention_age(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 3, 100)
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "0.aof"), old, old))
+	r := NewRetention("test", dir, RetentionPolicy{MaxAge: time.Hour})
+	r.Check()
+	assert.Equal(t, []int64{1, 2}, segmentNumbers(dir))
+	assert.Nil(t, NewRetention("test", dir, RetentionPolicy{}))
+}
+
+func Test_Retention_run(t *testing.T) {
+	dir := t.TempDir()
+	policy := RetentionPolicy{MaxTotalBytes: 1, Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRetention("test", dir, policy)
+	assert.True(t, r.Run(ctx))
+	assert.False(t, NewRetention("other", dir, policy).Run(context.Background()), "one retention per dir")
+
+	// a stopped retention is unregistered, another one can run on the dir
+	r.Stop()
+	retentionsLock.Lock()
+	assert.NotContains(t, retentions, dir)
+	retentionsLock.Unlock()
+	r = NewRetention("test", dir, policy)
+	assert.True(t, r.Run(ctx))
+	cancel()
+	<-r.done
+	retentionsLock.Lock()
+	assert.NotContains(t, retentions, dir)
+	retentionsLock.Unlock()
+}
+
+func Test_AofAddIndexReader_cursor(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 100)
+	assert.Nil(t, err)
+	buf := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		_, err = writer.Write(buf)
+		assert.Nil(t, err)
+	}
+	_, err = writer.Write(buf[:10])
+	assert.Nil(t, err)
+
+	reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+	_, err = reader.Read(buf)
+	assert.Nil(t, err)
+	_, err = reader.Read(buf)
+	assert.Nil(t, err)
+	r := NewRetention("test", dir, RetentionPolicy{DeleteConsumed: true})
+	r.Check()
+	assert.Equal(t, []int64{1, 2, 3}, segmentNumbers(dir), "file 1 is open by the reader")
+
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, writer.Close())
+	r.Check()
+	assert.Equal(t, []int64{1, 2, 3}, segmentNumbers(dir), "no cursor after Close")
+}
@@ -0,0 +1,339 @@
+package rotate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// IndexSuffix is the suffix of the sidecar index of a segment, "12.aof.idx" indexes "12.aof".
+const IndexSuffix = ".idx"
+
+// IndexInterval is how many commands there are between two checkpoints of an index.
+const IndexInterval = 1024
+
+var indexMagic = []byte("AOFIDX02")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checkpoint is where a command starts in a segment.
+type Checkpoint struct {
+	Entry    int64 // commands of the segment before this one
+	Position int64 // byte position in the segment
+	Time     int64 // receive time, unix milliseconds
+}
+
+// SegmentIndex describes one segment of the stream stored in a directory. Offsets
+// count the bytes of the stream, entries count the commands that start in the segment.
+type SegmentIndex struct {
+	Number      int64 // the file index, not stored
+	StartOffset int64
+	EndOffset   int64
+	FirstEntry  int64 // commands started before the segment
+	Entries     int64
+	FirstTime   int64 // receive time of the first and last write, unix milliseconds
+	LastTime    int64
+	Checksum    uint32       // crc32c of the raw content
+	Checkpoints []Checkpoint // every IndexInterval commands
+
+	startState []byte // scanner state at StartOffset, a command may go on from the last segment
+}
+
+func indexPath(segmentPath string) string {
+	return segmentPath + IndexSuffix
+}
+
+func (idx *SegmentIndex) marshal() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(indexMagic)
+	_ = binary.Write(buf, binary.LittleEndian, []int64{
+		IndexInterval, idx.StartOffset, idx.EndOffset, idx.FirstEntry, idx.Entries,
+		idx.FirstTime, idx.LastTime, int64(len(idx.startState)), int64(len(idx.Checkpoints)), int64(idx.Checksum),
+	})
+	buf.Write(idx.startState)
+	_ = binary.Write(buf, binary.LittleEndian, idx.Checkpoints)
+	_ = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func unmarshalIndex(data []byte) (*SegmentIndex, error) {
+	if len(data) < len(indexMagic)+4 || !bytes.Equal(data[:len(indexMagic)], indexMagic) {
+		return nil, fmt.Errorf("not an index file")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("index checksum mismatch")
+	}
+	rd := bytes.NewReader(body[len(indexMagic):])
+	head := make([]int64, 10)
+	if err := binary.Read(rd, binary.LittleEndian, head); err != nil {
+		return nil, err
+	}
+	if head[7] < 0 || head[8] < 0 || head[7]+head[8]*24 != int64(rd.Len()) {
+		return nil, fmt.Errorf("index size mismatch")
+	}
+	idx := &SegmentIndex{
+		StartOffset: head[1],
+		EndOffset:   head[2],
+		FirstEntry:  head[3],
+		Entries:     head[4],
+		FirstTime:   head[5],
+		LastTime:    head[6],
+		Checksum:    uint32(head[9]),
+		startState:  make([]byte, head[7]),
+		Checkpoints: make([]Checkpoint, head[8]),
+	}
+	_, _ = rd.Read(idx.startState)
+	if err := binary.Read(rd, binary.LittleEndian, idx.Checkpoints); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// writeIndexFile replaces the index of a segment atomically.
+func writeIndexFile(segmentPath string, idx *SegmentIndex) error {
+	fp := indexPath(segmentPath)
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, idx.marshal(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+func readIndexFile(segmentPath string) (*SegmentIndex, error) {
+	data, err := os.ReadFile(indexPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalIndex(data)
+}
+
+// indexBuilder builds the index of the segment being written.
+type indexBuilder struct {
+	index   SegmentIndex
+	scanner *respScanner
+	now     int64
+}
+
+func newIndexBuilder(number int64, startOffset int64, firstEntry int64, scanner *respScanner) *indexBuilder {
+	if scanner == nil || scanner.err != nil {
+		// a stream that is not RESP is indexed by offsets only, try again at the segment
+		scanner = &respScanner{pos: startOffset, lastEnd: startOffset}
+	}
+	return &indexBuilder{
+		index: SegmentIndex{
+			Number:      number,
+			StartOffset: startOffset,
+			EndOffset:   startOffset,
+			FirstEntry:  firstEntry,
+			startState:  scanner.marshalState(),
+		},
+		scanner: scanner,
+	}
+}
+
+// next returns the builder of the segment after this one.
+func (b *indexBuilder) next(number int64) *indexBuilder {
+	if b == nil {
+		return newIndexBuilder(number, 0, 0, nil)
+	}
+	return newIndexBuilder(number, b.index.EndOffset, b.index.FirstEntry+b.index.Entries, b.scanner)
+}
+
+func (b *indexBuilder) write(p []byte, now time.Time) {
+	b.now = now.UnixMilli()
+	if b.index.FirstTime == 0 {
+		b.index.FirstTime = b.now
+	}
+	b.index.LastTime = b.now
+	b.scanner.scan(p, b.onStart)
+	b.index.EndOffset += int64(len(p))
+	b.index.Checksum = crc32.Update(b.index.Checksum, castagnoli, p)
+}
+
+func (b *indexBuilder) onStart(pos int64) {
+	if b.index.Entries%IndexInterval == 0 {
+		b.index.Checkpoints = append(b.index.Checkpoints, Checkpoint{
+			Entry:    b.index.Entries,
+			Position: pos - b.index.StartOffset,
+			Time:     b.now,
+		})
+	}
+	b.index.Entries++
+}
+
+func (b *indexBuilder) save(segmentPath string) error {
+	return writeIndexFile(segmentPath, &b.index)
+}
+
+// scanSegment rebuilds the index of a segment from its content, starting with the
+// scanner state at its start. Receive times are not in the segment, the modification
+// time of the file is used for both.
+func scanSegment(dir string, s segment, b *indexBuilder) error {
+	file, err := openSegmentFile(dir, s.number)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf := make([]byte, 64*1024)
+	modTime := s.modTime
+	for {
+		n, err := file.rd.Read(buf)
+		if n > 0 {
+			b.write(buf[:n], modTime)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// LoadIndex returns the index of every segment in dir. Sidecars that are missing,
+// damaged or do not match their segment are rebuilt from the segments and saved,
+// except for the last segment, which may still be written.
+func LoadIndex(dir string) ([]SegmentIndex, error) {
+	indexes, _, err := loadIndex(dir)
+	return indexes, err
+}
+
+// loadIndex also returns the builder of the last segment, to go on writing it.
+func loadIndex(dir string) ([]SegmentIndex, *indexBuilder, error) {
+	segments := listSegments(dir)
+	indexes := make([]SegmentIndex, 0, len(segments))
+	var last *indexBuilder
+	for i, s := range segments {
+		idx, err := readIndexFile(segmentPath(dir, s.number))
+		// the raw size of a compressed segment is not known without reading it
+		valid := err == nil && (s.codec != "" || idx.EndOffset-idx.StartOffset == contentSize(s)) && i < len(segments)-1
+		if valid && i > 0 {
+			prev := &indexes[i-1]
+			valid = idx.StartOffset == prev.EndOffset && idx.FirstEntry == prev.FirstEntry+prev.Entries
+		}
+		if valid {
+			idx.Number = s.number
+			indexes = append(indexes, *idx)
+			last = nil
+			continue
+		}
+
+		var b *indexBuilder
+		switch {
+		case last != nil:
+			b = last.next(s.number)
+		case err == nil && i > 0 && idx.StartOffset == indexes[i-1].EndOffset && idx.FirstEntry == indexes[i-1].FirstEntry+indexes[i-1].Entries:
+			// the segment grew after its index was saved, the start is still right
+			scanner, err := unmarshalScanner(idx.startState, idx.StartOffset)
+			if err != nil {
+				return nil, nil, err
+			}
+			b = newIndexBuilder(s.number, idx.StartOffset, idx.FirstEntry, scanner)
+		case i > 0:
+			// go on from the state the previous segment ends with
+			prev := indexes[i-1]
+			scanner, err := unmarshalScanner(prev.startState, prev.StartOffset)
+			if err != nil {
+				return nil, nil, err
+			}
+			b = newIndexBuilder(segments[i-1].number, prev.StartOffset, prev.FirstEntry, scanner)
+			if err := scanSegment(dir, segments[i-1], b); err != nil {
+				return nil, nil, err
+			}
+			b = b.next(s.number)
+		case err == nil:
+			// the first segment, keep where its stream starts
+			scanner, _ := unmarshalScanner(idx.startState, idx.StartOffset)
+			b = newIndexBuilder(s.number, idx.StartOffset, idx.FirstEntry, scanner)
+		default:
+			b = newIndexBuilder(s.number, 0, 0, nil)
+		}
+		if err := scanSegment(dir, s, b); err != nil {
+			return nil, nil, err
+		}
+		if i < len(segments)-1 {
+			if err := b.save(segmentPath(dir, s.number)); err != nil {
+				slog.Warn("save rebuilt index error", slog.String("filepath", s.path), slog.String("error", err.Error()))
+			} else {
+				slog.Info("rebuild index success", slog.String("filepath", s.path), slog.Int64("entries", b.index.Entries))
+			}
+		}
+		indexes = append(indexes, b.index)
+		last = b
+	}
+	return indexes, last, nil
+}
+
+// findSegmentByOffset returns the segment holding offset, the end of the last
+// segment belongs to the last segment.
+func findSegmentByOffset(indexes []SegmentIndex, offset int64) (*SegmentIndex, error) {
+	i := sort.Search(len(indexes), func(i int) bool { return indexes[i].EndOffset > offset })
+	if i == len(indexes) && len(indexes) > 0 && indexes[i-1].EndOffset == offset {
+		i--
+	}
+	if i == len(indexes) || indexes[i].StartOffset > offset {
+		return nil, fmt.Errorf("offset %d is not stored", offset)
+	}
+	return &indexes[i], nil
+}
+
+// findEntry returns the segment where command n starts and the position in it.
+func findEntry(dir string, indexes []SegmentIndex, n int64) (*SegmentIndex, int64, error) {
+	i := sort.Search(len(indexes), func(i int) bool { return indexes[i].FirstEntry+indexes[i].Entries > n })
+	if i == len(indexes) {
+		if len(indexes) > 0 && indexes[i-1].FirstEntry+indexes[i-1].Entries == n {
+			// after the last command
+			idx := &indexes[i-1]
+			return idx, idx.EndOffset - idx.StartOffset, nil
+		}
+		return nil, 0, fmt.Errorf("entry %d is not stored", n)
+	}
+	idx := &indexes[i]
+	if idx.FirstEntry > n {
+		return nil, 0, fmt.Errorf("entry %d is not stored", n)
+	}
+	rel := n - idx.FirstEntry
+	c := sort.Search(len(idx.Checkpoints), func(c int) bool { return idx.Checkpoints[c].Entry > rel }) - 1
+	if c < 0 {
+		return nil, 0, fmt.Errorf("no checkpoint for entry %d", n)
+	}
+	checkpoint := idx.Checkpoints[c]
+
+	// commands start at checkpoints, so scanning from there needs no state
+	file, err := openSegmentFile(dir, idx.Number)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	if _, err = io.CopyN(io.Discard, file.rd, checkpoint.Position); err != nil {
+		return nil, 0, err
+	}
+	scanner := &respScanner{pos: checkpoint.Position}
+	skip := rel - checkpoint.Entry
+	found := int64(-1)
+	buf := make([]byte, 64*1024)
+	for found < 0 {
+		read, err := file.rd.Read(buf)
+		scanner.scan(buf[:read], func(pos int64) {
+			if skip == 0 && found < 0 {
+				found = pos
+			}
+			skip--
+		})
+		if scanner.err != nil {
+			return nil, 0, scanner.err
+		}
+		if err != nil && found < 0 {
+			return nil, 0, fmt.Errorf("entry %d not found in [%s]: %v", n, file.path, err)
+		}
+	}
+	return idx, found, nil
+}
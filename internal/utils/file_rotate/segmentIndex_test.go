@@ -0,0 +1,124 @@
+package rotate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCommand(i int) string {
+	key := fmt.Sprintf("key:%d", i)
+	value := fmt.Sprintf("value\r\n%d", i)
+	return fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
+}
+
+// writeTestCommands writes count commands in pieces of 50 bytes, so commands are
+// split across segments, and returns the offset of every command.
+func writeTestCommands(t *testing.T, dir string, count int) []int64 {
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	stream := ""
+	offsets := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		offsets = append(offsets, int64(len(stream)))
+		stream += testCommand(i)
+	}
+	for i := 0; i < len(stream); i += 50 {
+		_, err = writer.Write([]byte(stream[i:min(i+50, len(stream))]))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, writer.Close())
+	writer.compressor.wait()
+	return offsets
+}
+
+func checkTestIndex(t *testing.T, indexes []SegmentIndex, count int) {
+	var entries int64
+	for i, idx := range indexes {
+		assert.Equal(t, int64(i), idx.Number)
+		assert.Equal(t, entries, idx.FirstEntry)
+		if i > 0 {
+			assert.Equal(t, indexes[i-1].EndOffset, idx.StartOffset)
+		}
+		entries += idx.Entries
+	}
+	assert.Equal(t, int64(count), entries)
+}
+
+func readTestCommand(t *testing.T, reader *AofAddIndexReader, expected string) {
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(reader, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(buf))
+}
+
+func Test_SegmentIndex(t *testing.T) {
+	dir := t.TempDir()
+	count := 3000
+	offsets := writeTestCommands(t, dir, count)
+
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, count)
+	assert.True(t, len(indexes) > 3)
+
+	// missing and damaged sidecars are rebuilt the same
+	assert.Nil(t, os.Remove(indexPath(segmentPath(dir, 1))))
+	assert.Nil(t, os.WriteFile(indexPath(segmentPath(dir, 3)), []byte("AOFIDX01 damaged"), 0644))
+	rebuilt, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, rebuilt, count)
+	for i := range indexes {
+		assert.Equal(t, indexes[i].Entries, rebuilt[i].Entries)
+		assert.Equal(t, indexes[i].Checkpoints[0].Position, rebuilt[i].Checkpoints[0].Position)
+	}
+	_, err = readIndexFile(segmentPath(dir, 3))
+	assert.Nil(t, err)
+
+	for _, n := range []int{0, 1, 1023, 1024, 1500, count - 1} {
+		reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+		offset, err := reader.SeekEntry(int64(n))
+		assert.Nil(t, err)
+		assert.Equal(t, offsets[n], offset, n)
+		readTestCommand(t, reader, testCommand(n))
+		_ = reader.Close()
+
+		reader = NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+		assert.Nil(t, reader.SeekOffset(offsets[n]))
+		readTestCommand(t, reader, testCommand(n))
+		_ = reader.Close()
+	}
+	reader := NewAofAddIndexReader(context.Background(), "testReader", dir, 0)
+	_, err = reader.SeekEntry(int64(count + 1))
+	assert.NotNil(t, err)
+	_ = reader.Close()
+}
+
+func Test_SegmentIndex_reopen(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCommands(t, dir, 100)
+	// go on writing the last segment, a command split across Close is still counted once
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	command := testCommand(100)
+	_, err = writer.Write([]byte(command[:10]))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	writer, err = NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte(command[10:]))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, 101)
+	data, err := os.ReadFile(segmentPath(dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, testCommand(0), string(data[:len(testCommand(0))]))
+	assert.Equal(t, command, string(data[len(data)-len(command):]))
+}
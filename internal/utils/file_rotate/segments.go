@@ -0,0 +1,171 @@
+package rotate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redisFlutter/constDefine"
+)
+
+// segment is one file of a rotated directory. Files are named by a number, the file
+// index for AofAddIndexWriter and the start offset for AOFWriter.
+type segment struct {
+	number  int64
+	path    string // the file on disk, compressed segments end with the codec suffix
+	codec   string // "" for a raw segment
+	size    int64  // size on disk
+	modTime time.Time
+}
+
+func segmentPath(dir string, number int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", number, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX))
+}
+
+// listSegments returns the raw and compressed segments of dir in order of their
+// number. When a segment has both, it is being compressed and the raw one is returned.
+func listSegments(dir string) []segment {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	found := make(map[int64]segment)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name, codec := entry.Name(), ""
+		for _, s := range compressedSuffixes {
+			if strings.HasSuffix(name, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX+s.suffix) {
+				name, codec = strings.TrimSuffix(name, s.suffix), s.codec
+				break
+			}
+		}
+		if !strings.HasSuffix(name, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX) {
+			continue
+		}
+		number, err := strconv.ParseInt(strings.TrimSuffix(name, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		if s, ok := found[number]; ok && s.codec == "" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		found[number] = segment{
+			number:  number,
+			path:    filepath.Join(dir, entry.Name()),
+			codec:   codec,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+	}
+	segments := make([]segment, 0, len(found))
+	for _, s := range found {
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].number < segments[j].number
+	})
+	return segments
+}
+
+// rawSegmentPath is the path of a segment without the suffix of its codec, open
+// segments are known by it.
+func rawSegmentPath(fp string) string {
+	for _, s := range compressedSuffixes {
+		if strings.HasSuffix(fp, constDefine.REDIS_APPEND_CMD_FILE_SUFFIX+s.suffix) {
+			return strings.TrimSuffix(fp, s.suffix)
+		}
+	}
+	return fp
+}
+
+// cursor is a registered consumer of a directory.
+type cursor struct {
+	name     string
+	position func() int64
+}
+
+// segmentRegistry knows which segments are open by readers and writers of this
+// process, and how far the consumers of every directory got.
+type segmentRegistry struct {
+	lock    sync.Mutex
+	open    map[string]int                  // path -> times opened
+	cursors map[string]map[*cursor]struct{} // dir -> cursors
+}
+
+var registry = segmentRegistry{
+	open:    make(map[string]int),
+	cursors: make(map[string]map[*cursor]struct{}),
+}
+
+func markOpen(fp string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.open[filepath.Clean(rawSegmentPath(fp))]++
+}
+
+func markClosed(fp string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	fp = filepath.Clean(rawSegmentPath(fp))
+	if registry.open[fp] <= 1 {
+		delete(registry.open, fp)
+		return
+	}
+	registry.open[fp]--
+}
+
+func isOpen(fp string) bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	return registry.open[filepath.Clean(rawSegmentPath(fp))] > 0
+}
+
+// RegisterCursor registers a consumer of the segments in dir. position returns the
+// number of the segment or the offset the consumer is reading, a segment is consumed
+// when the next segment starts at or before it. Call the returned func when the
+// consumer is gone.
+func RegisterCursor(dir string, name string, position func() int64) (unregister func()) {
+	dir = filepath.Clean(dir)
+	c := &cursor{name: name, position: position}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.cursors[dir] == nil {
+		registry.cursors[dir] = make(map[*cursor]struct{})
+	}
+	registry.cursors[dir][c] = struct{}{}
+	return func() {
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		delete(registry.cursors[dir], c)
+		if len(registry.cursors[dir]) == 0 {
+			delete(registry.cursors, dir)
+		}
+	}
+}
+
+// cursorPositions returns the positions of the cursors of dir, registered and saved.
+func cursorPositions(dir string) []int64 {
+	registry.lock.Lock()
+	cursors := make([]*cursor, 0, len(registry.cursors[filepath.Clean(dir)]))
+	for c := range registry.cursors[filepath.Clean(dir)] {
+		cursors = append(cursors, c)
+	}
+	registry.lock.Unlock()
+	positions := make([]int64, 0, len(cursors))
+	for _, c := range cursors {
+		positions = append(positions, c.position())
+	}
+	// consumers not running hold back retention with their durable cursors
+	return append(positions, savedCursorPositions(dir)...)
+}
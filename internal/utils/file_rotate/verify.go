@@ -0,0 +1,217 @@
+package rotate
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+
+	"redisFlutter/internal/utils/encrypt"
+)
+
+const (
+	VerifyOff  = "off"
+	VerifyTail = "tail"
+	VerifyFull = "full"
+)
+
+// SegmentProblem is something wrong found in a segment.
+type SegmentProblem struct {
+	Path     string `json:"path"`
+	Position int64  `json:"position"` // in the raw content of the segment
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// VerifyReport is the result of VerifyDir.
+type VerifyReport struct {
+	Dir       string           `json:"dir"`
+	Segments  int              `json:"segments"`
+	Bytes     int64            `json:"bytes"` // raw bytes checked
+	Entries   int64            `json:"entries"`
+	Problems  []SegmentProblem `json:"problems"`
+	Truncated int64            `json:"truncated"` // bytes cut by repair
+}
+
+// OK tells whether there is no problem left.
+func (r *VerifyReport) OK() bool {
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *VerifyReport) addProblem(path string, position int64, format string, args ...interface{}) *SegmentProblem {
+	r.Problems = append(r.Problems, SegmentProblem{Path: path, Position: position, Problem: fmt.Sprintf(format, args...)})
+	problem := &r.Problems[len(r.Problems)-1]
+	slog.Warn("verify found problem", slog.String("filepath", path), slog.Int64("position", position), slog.String("problem", problem.Problem))
+	return problem
+}
+
+// VerifyDir checks the segments of dir: every command is complete RESP, and the content
+// matches the checksum and size of the index. Only the last segment is checked unless
+// full is set, a crash leaves its damage there. With repair, a tail ending in the middle
+// of a command or with invalid RESP is truncated to the last complete command, like
+// redis-check-aof --fix. Damage in other segments is reported and never repaired.
+// dir must not be written while it is checked.
+func VerifyDir(dir string, full bool, repair bool) (*VerifyReport, error) {
+	segments := listSegments(dir)
+	if len(segments) == 0 {
+		return &VerifyReport{Dir: dir}, nil
+	}
+	first := len(segments) - 1
+	if full {
+		first = 0
+	}
+	return verifySegments(dir, segments, first, repair)
+}
+
+// verifySegments checks segments from first to the last.
+func verifySegments(dir string, segments []segment, first int, repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{Dir: dir}
+	scanner, err := verifyStartScanner(dir, segments, first)
+	if err != nil {
+		return nil, err
+	}
+	midCommand := !scanner.atBoundary()
+
+	last := len(segments) - 1
+	starts := make([]int64, len(segments))
+	errSegment := -1 // the segment where the RESP is invalid
+	errProblem := -1
+	buf := make([]byte, 64*1024)
+	for i := first; i <= last; i++ {
+		s := segments[i]
+		if scanner.err != nil {
+			// reported already, go on at the segment
+			scanner = &respScanner{pos: scanner.pos, lastEnd: scanner.pos}
+		}
+		starts[i] = scanner.pos
+		file, err := openSegmentFile(dir, s.number)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		var checksum uint32
+		for {
+			n, err := file.rd.Read(buf)
+			size += int64(n)
+			checksum = crc32.Update(checksum, castagnoli, buf[:n])
+			hadErr := scanner.err != nil
+			scanner.scan(buf[:n], func(int64) { report.Entries++ })
+			if scanner.err != nil && !hadErr {
+				errSegment, errProblem = i, len(report.Problems)
+				report.addProblem(s.path, scanner.lastEnd-starts[i], "invalid RESP: %v", scanner.err)
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				file.Close()
+				report.addProblem(s.path, size, "read failed: %v", err)
+				return report, nil
+			}
+		}
+		file.Close()
+		// the scanner stops at invalid RESP, go on counting bytes from where the segment ends
+		scanner.pos = starts[i] + size
+		report.Segments++
+		report.Bytes += size
+
+		if idx, err := readIndexFile(segmentPath(dir, s.number)); err == nil {
+			indexSize := idx.EndOffset - idx.StartOffset
+			if indexSize == size && idx.Checksum != checksum {
+				report.addProblem(s.path, 0, "checksum %08x differs from index %08x", checksum, idx.Checksum)
+			} else if indexSize != size && i < last {
+				report.addProblem(s.path, min(size, indexSize), "size %d differs from index %d", size, indexSize)
+			}
+		}
+	}
+	truncated := scanner.err == nil && !scanner.atBoundary()
+	if truncated {
+		errSegment, errProblem = last, len(report.Problems)
+		report.addProblem(segments[last].path, scanner.lastEnd-starts[last], "the last command is truncated")
+	}
+	if !repair || errSegment < 0 {
+		return report, nil
+	}
+	if errSegment != last {
+		slog.Warn("verify can not repair segments before the last", slog.String("dir", dir))
+		return report, nil
+	}
+	if midCommand && scanner.lastEnd == starts[first] && first > 0 {
+		// the command to cut began in a segment not checked, check from there
+		return verifySegments(dir, segments, first-1, repair)
+	}
+	if err := truncateTail(report, segments[first:], starts[first:], scanner.lastEnd); err != nil {
+		return report, err
+	}
+	report.Problems[errProblem].Repaired = true
+	return report, nil
+}
+
+// verifyStartScanner returns the scanner state at the start of segments[i]. The state is
+// saved in the index of the segment, or found by scanning the segment before it.
+func verifyStartScanner(dir string, segments []segment, i int) (*respScanner, error) {
+	if idx, err := readIndexFile(segmentPath(dir, segments[i].number)); err == nil {
+		if scanner, err := unmarshalScanner(idx.startState, 0); err == nil {
+			return scanner, nil
+		}
+	}
+	if i > 0 {
+		if prev, err := readIndexFile(segmentPath(dir, segments[i-1].number)); err == nil {
+			scanner, err := unmarshalScanner(prev.startState, 0)
+			if err == nil {
+				b := &indexBuilder{scanner: scanner}
+				if err := scanSegment(dir, segments[i-1], b); err != nil {
+					return nil, err
+				}
+				return b.scanner, nil
+			}
+		}
+	}
+	return &respScanner{}, nil
+}
+
+// truncateSegment cuts the raw segment s to size bytes of content.
+func truncateSegment(s segment, size int64) error {
+	if !encrypt.IsEncryptedFile(s.path) {
+		return os.Truncate(s.path, size)
+	}
+	ring, err := encrypt.ConfigKeyRing()
+	if err != nil {
+		return err
+	}
+	return encrypt.Truncate(s.path, size, ring)
+}
+
+// truncateTail cuts the stream at end, where the last complete command ends. A command
+// may have begun in segments before the last, they are cut too and left empty.
+func truncateTail(report *VerifyReport, segments []segment, starts []int64, end int64) error {
+	for j := len(segments) - 1; j >= 0; j-- {
+		s := segments[j]
+		keep := max(end-starts[j], 0)
+		size := contentSize(s)
+		if keep >= size {
+			break
+		}
+		if s.codec != "" {
+			return fmt.Errorf("can not truncate compressed segment [%s]", s.path)
+		}
+		if err := truncateSegment(s, keep); err != nil {
+			return err
+		}
+		// the index is rebuilt from the truncated segment
+		_ = os.Remove(indexPath(s.path))
+		report.Truncated += size - keep
+		slog.Warn("verify truncated file", slog.String("filepath", s.path), slog.Int64("from", size), slog.Int64("to", keep))
+		if keep > 0 {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package rotate
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/config"
+)
+
+func setTestVerify(t *testing.T, mode string, repair bool) {
+	oldMode, oldRepair := config.Opt.Advanced.AofVerify, config.Opt.Advanced.AofRepair
+	config.Opt.Advanced.AofVerify, config.Opt.Advanced.AofRepair = mode, repair
+	t.Cleanup(func() { config.Opt.Advanced.AofVerify, config.Opt.Advanced.AofRepair = oldMode, oldRepair })
+}
+
+func appendTestFile(t *testing.T, fp string, data string) {
+	file, err := os.OpenFile(fp, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteString(data)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
+
+func lastTestSegment(t *testing.T, dir string) segment {
+	segments := listSegments(dir)
+	assert.True(t, len(segments) > 1)
+	return segments[len(segments)-1]
+}
+
+func Test_VerifyDir_ok(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+
+	for _, full := range []bool{false, true} {
+		report, err := VerifyDir(dir, full, true)
+		assert.Nil(t, err)
+		assert.True(t, report.OK())
+		assert.Empty(t, report.Problems)
+		assert.Equal(t, int64(0), report.Truncated)
+	}
+	report, err := VerifyDir(dir, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(listSegments(dir)), report.Segments)
+	assert.Equal(t, int64(count), report.Entries)
+}
+
+func Test_VerifyDir_truncated(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+	last := lastTestSegment(t, dir)
+	partial := testCommand(count)[:20]
+	appendTestFile(t, last.path, partial)
+
+	report, err := VerifyDir(dir, false, false)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, last.size, report.Problems[0].Position)
+
+	report, err = VerifyDir(dir, false, true)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.True(t, report.Problems[0].Repaired)
+	assert.Equal(t, int64(len(partial)), report.Truncated)
+	assert.Equal(t, last.size, lastTestSegment(t, dir).size)
+
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, count)
+}
+
+func Test_VerifyDir_invalid(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+	last := lastTestSegment(t, dir)
+	appendTestFile(t, last.path, testCommand(count)+"*garbage\r\n"+testCommand(count+1))
+
+	report, err := VerifyDir(dir, false, true)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Contains(t, report.Problems[0].Problem, "invalid RESP")
+
+	// the complete command before the garbage is kept
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, count+1)
+}
+
+func Test_VerifyDir_checksum(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+	fp := segmentPath(dir, 1)
+	data, err := os.ReadFile(fp)
+	assert.Nil(t, err)
+	i := bytes.Index(data, []byte("value"))
+	assert.True(t, i >= 0)
+	data[i] = 'w' // still valid RESP
+	assert.Nil(t, os.WriteFile(fp, data, 0644))
+
+	// only the last segment is checked by default
+	report, err := VerifyDir(dir, false, true)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	report, err = VerifyDir(dir, true, true)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, fp, report.Problems[0].Path)
+	assert.Contains(t, report.Problems[0].Problem, "checksum")
+	assert.Equal(t, int64(0), report.Truncated)
+	after, err := os.ReadFile(fp)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after)
+}
+
+func Test_VerifyDir_span(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	offsets := writeTestCommands(t, dir, count)
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	last := lastTestSegment(t, dir)
+	prev := indexes[len(indexes)-2]
+	start := indexes[len(indexes)-1].StartOffset
+
+	// cut the last segment inside the command that begins in the segment before it
+	k := 0
+	for k+1 < len(offsets) && offsets[k+1] <= start {
+		k++
+	}
+	if offsets[k] == start {
+		t.Skip("the last segment begins with a command")
+	}
+	assert.Nil(t, os.Truncate(last.path, offsets[k+1]-start-1))
+
+	report, err := VerifyDir(dir, false, true)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	info, err := os.Stat(last.path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	info, err = os.Stat(segmentPath(dir, prev.Number))
+	assert.Nil(t, err)
+	assert.Equal(t, offsets[k]-prev.StartOffset, info.Size())
+
+	indexes, err = LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, k)
+}
+
+func Test_NewAofAddIndexWriter_repair(t *testing.T) {
+	dir := t.TempDir()
+	count := 1000
+	writeTestCommands(t, dir, count)
+	appendTestFile(t, lastTestSegment(t, dir).path, testCommand(count)[:20])
+
+	setTestVerify(t, VerifyTail, true)
+	writer, err := NewAofAddIndexWriter("testWriter", dir, 4*1024)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte(testCommand(count)))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	indexes, err := LoadIndex(dir)
+	assert.Nil(t, err)
+	checkTestIndex(t, indexes, count+1)
+}
@@ -0,0 +1,224 @@
+package writer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/filter"
+	"redisFlutter/internal/log"
+)
+
+// ShardedWriter opens several connections to the same target and spreads entries
+// over them by the slot of their keys. Entries of one key always go to the same lane,
+// so per-key order is kept. Entries that can not be bound to a single lane
+// (keyless commands, keys spanning lanes, scripts, transactions) are barriers:
+// all lanes are drained before the barrier is executed, and the barrier is drained
+// before anything after it is dispatched.
+//
+// With big_key_action = slow_lane, big keys of the rdb phase go to one more
+// connection, so they do not hold back the other keys. The slow lane is drained
+// before the first entry after the rdb phase.
+type ShardedWriter struct {
+	name  string
+	lanes []*StandaloneWriter
+
+	slow     *StandaloneWriter
+	slowUsed bool
+
+	ch   chan *entry.Entry
+	chWg sync.WaitGroup
+
+	// inMulti is true between MULTI and EXEC/DISCARD, the whole block stays on lane 0
+	inMulti bool
+
+	stat struct {
+		Name         string        `json:"name"`
+		Lanes        int           `json:"lanes"`
+		BarrierCount int64         `json:"barrier_count"`
+		LaneStatus   []interface{} `json:"lane_status"`
+	}
+}
+
+func NewShardedWriter(ctx context.Context, opts *RedisWriterOptions) (Writer, error) {
+	laneCount := opts.Connections
+	slowLane := config.Opt.Filter.BigKeyAction == filter.BigKeyActionSlowLane
+	if laneCount <= 1 && !slowLane {
+		return NewStandaloneWriter(ctx, opts)
+	}
+	if laneCount < 1 {
+		laneCount = 1
+	}
+	w := new(ShardedWriter)
+	w.name = "sharded_writer_" + strings.Replace(opts.Address, ":", "_", -1)
+	w.stat.Name = w.name
+	w.stat.Lanes = laneCount
+	w.lanes = make([]*StandaloneWriter, 0, laneCount)
+	for i := 0; i < laneCount; i++ {
+		lane, err := NewStandaloneWriter(ctx, opts)
+		if err != nil {
+			for _, opened := range w.lanes {
+				opened.Close()
+			}
+			return nil, err
+		}
+		sw := lane.(*StandaloneWriter)
+		sw.stat.Name = fmt.Sprintf("%s_lane%d", sw.stat.Name, i)
+		w.lanes = append(w.lanes, sw)
+	}
+	if slowLane {
+		lane, err := NewStandaloneWriter(ctx, opts)
+		if err != nil {
+			for _, opened := range w.lanes {
+				opened.Close()
+			}
+			return nil, err
+		}
+		w.slow = lane.(*StandaloneWriter)
+		w.slow.stat.Name += "_slow"
+	}
+	w.ch = make(chan *entry.Entry, config.Opt.Advanced.PipelineCountLimit)
+	log.Infof("[%s] open %d lanes to target", w.name, laneCount)
+	return w, nil
+}
+
+func (w *ShardedWriter) StartWrite(ctx context.Context) chan *entry.Entry {
+	for _, lane := range w.allLanes() {
+		lane.StartWrite(ctx)
+	}
+	w.chWg = sync.WaitGroup{}
+	w.chWg.Add(1)
+	go w.processDispatch()
+	return w.ch
+}
+
+func (w *ShardedWriter) Write(e *entry.Entry) {
+	w.ch <- e
+}
+
+func (w *ShardedWriter) Close() {
+	close(w.ch)
+	w.chWg.Wait()
+	for _, lane := range w.allLanes() {
+		lane.Close()
+	}
+}
+
+func (w *ShardedWriter) processDispatch() {
+	for e := range w.ch {
+		w.dispatch(e)
+	}
+	w.drainAll()
+	w.chWg.Done()
+}
+
+func (w *ShardedWriter) dispatch(e *entry.Entry) {
+	if e.CmdName == "" {
+		e.Parse()
+	}
+	// every lane switches db by itself according to Entry.DbId
+	if strings.EqualFold(e.CmdName, "SELECT") {
+		return
+	}
+	if e.SlowLane && w.slow != nil {
+		w.slowUsed = true
+		w.slow.Write(e)
+		return
+	}
+	if w.slowUsed && !e.FromRdb {
+		w.slowUsed = false
+		w.slow.Drain()
+	}
+	if w.inMulti {
+		w.lanes[0].Write(e)
+		if isTransactionEnd(e.CmdName) {
+			w.inMulti = false
+			w.lanes[0].Drain()
+		}
+		return
+	}
+	if strings.EqualFold(e.CmdName, "MULTI") {
+		w.drainAll()
+		atomic.AddInt64(&w.stat.BarrierCount, 1)
+		w.inMulti = true
+		w.lanes[0].Write(e)
+		return
+	}
+	lane, ok := laneOf(e, len(w.lanes))
+	if ok {
+		w.lanes[lane].Write(e)
+		return
+	}
+	// barrier
+	w.drainAll()
+	atomic.AddInt64(&w.stat.BarrierCount, 1)
+	w.lanes[0].Write(e)
+	w.lanes[0].Drain()
+}
+
+func (w *ShardedWriter) drainAll() {
+	for _, lane := range w.allLanes() {
+		lane.Drain()
+	}
+}
+
+func (w *ShardedWriter) allLanes() []*StandaloneWriter {
+	if w.slow == nil {
+		return w.lanes
+	}
+	return append(w.lanes[:len(w.lanes):len(w.lanes)], w.slow)
+}
+
+// laneOf returns the lane an entry is bound to, or false if the entry is a barrier.
+func laneOf(e *entry.Entry, laneCount int) (int, bool) {
+	if len(e.Keys) == 0 || e.Group == "SCRIPTING" || e.Group == "TRANSACTIONS" {
+		return 0, false
+	}
+	slots := e.Slots
+	if len(slots) != len(e.Keys) {
+		return 0, false
+	}
+	lane := slots[0] % laneCount
+	for _, slot := range slots[1:] {
+		if slot%laneCount != lane {
+			return 0, false
+		}
+	}
+	return lane, true
+}
+
+func isTransactionEnd(cmdName string) bool {
+	return strings.EqualFold(cmdName, "EXEC") || strings.EqualFold(cmdName, "DISCARD")
+}
+
+func (w *ShardedWriter) Status() interface{} {
+	laneStatus := make([]interface{}, 0, len(w.lanes)+1)
+	for _, lane := range w.allLanes() {
+		laneStatus = append(laneStatus, lane.Status())
+	}
+	stat := w.stat
+	stat.BarrierCount = atomic.LoadInt64(&w.stat.BarrierCount)
+	stat.LaneStatus = laneStatus
+	return stat
+}
+
+func (w *ShardedWriter) StatusString() string {
+	items := make([]string, 0, len(w.lanes)+1)
+	for _, lane := range w.allLanes() {
+		items = append(items, lane.StatusString())
+	}
+	return fmt.Sprintf("[%s]: barriers=%d, %s", w.name, atomic.LoadInt64(&w.stat.BarrierCount), strings.Join(items, ", "))
+}
+
+func (w *ShardedWriter) StatusConsistent() bool {
+	for _, lane := range w.allLanes() {
+		if !lane.StatusConsistent() {
+			return false
+		}
+	}
+	return true
+}
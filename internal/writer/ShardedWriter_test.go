@@ -0,0 +1,39 @@
+package writer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/entry"
+)
+
+func newParsedEntry(argv ...string) *entry.Entry {
+	e := entry.NewEntry()
+	e.Argv = append(e.Argv, argv...)
+	e.Parse()
+	return e
+}
+
+func Test_shardedWriter_laneOf(t *testing.T) {
+	laneCount := 4
+
+	lane1, ok := laneOf(newParsedEntry("SET", "{user1}:a", "1"), laneCount)
+	assert.True(t, ok)
+	lane2, ok := laneOf(newParsedEntry("HSET", "{user1}:b", "f", "v"), laneCount)
+	assert.True(t, ok)
+	assert.Equal(t, lane1, lane2)
+
+	lane3, ok := laneOf(newParsedEntry("MSET", "{user1}:a", "1", "{user1}:b", "2"), laneCount)
+	assert.True(t, ok)
+	assert.Equal(t, lane1, lane3)
+
+	_, ok = laneOf(newParsedEntry("FLUSHDB"), laneCount)
+	assert.False(t, ok)
+	_, ok = laneOf(newParsedEntry("MULTI"), laneCount)
+	assert.False(t, ok)
+	_, ok = laneOf(newParsedEntry("EVAL", "return 1", "1", "key"), laneCount)
+	assert.False(t, ok)
+	_, ok = laneOf(newParsedEntry("DEL", "a", "b", "c", "d", "e", "f"), laneCount)
+	assert.False(t, ok)
+}
@@ -13,6 +13,7 @@ import (
 
 	"redisFlutter/internal/client"
 	"redisFlutter/internal/client/proto"
+	"redisFlutter/internal/compat"
 	"redisFlutter/internal/config"
 	"redisFlutter/internal/entry"
 	"redisFlutter/internal/log"
@@ -26,6 +27,10 @@ type RedisWriterOptions struct {
 	Tls       bool             `mapstructure:"tls" default:"false"`
 	TlsConfig client.TlsConfig `mapstructure:"tls_config" default:"{}"`
 	OffReply  bool             `mapstructure:"off_reply" default:"false"`
+
+	// Connections > 1 makes NewShardedWriter open that many connections and
+	// spread entries over them by key slot
+	Connections int `mapstructure:"connections" default:"1"`
 }
 
 type StandaloneWriter struct {
@@ -36,13 +41,31 @@ type StandaloneWriter struct {
 	chWaitReply chan *entry.Entry
 	chWaitWg    sync.WaitGroup
 	offReply    bool
+	cluster     bool
 	ch          chan *entry.Entry
 	chWg        sync.WaitGroup
 
+	// pending counts entries accepted by Write that are not answered yet,
+	// Drain waits on idleCond until it drops to zero
+	pending  int64
+	idleLock sync.Mutex
+	idleCond *sync.Cond
+
+	txCollector *entry.TransactionCollector
+	budget      *flowBudget
+	limiter     *RateLimiter
+	rewriter    *compat.Rewriter
+
 	stat struct {
-		Name              string `json:"name"`
-		UnansweredBytes   int64  `json:"unanswered_bytes"`
-		UnansweredEntries int64  `json:"unanswered_entries"`
+		Name              string      `json:"name"`
+		UnansweredBytes   int64       `json:"unanswered_bytes"`
+		UnansweredEntries int64       `json:"unanswered_entries"`
+		TransactionCount  int64       `json:"transaction_count"`
+		SplitTransactions int64       `json:"split_transactions"` // cross-slot transactions sent as one block per slot, not atomic
+		RejectedEntries   int64       `json:"rejected_entries"`   // commands of a transaction spanning slots themselves, not sent
+		BlockedCount      int64       `json:"blocked_count"`
+		BlockedMs         int64       `json:"blocked_ms"`
+		Compat            interface{} `json:"compat,omitempty"`
 	}
 }
 
@@ -50,12 +73,22 @@ func NewStandaloneWriter(ctx context.Context, opts *RedisWriterOptions) (Writer,
 	var err error
 	rw := new(StandaloneWriter)
 	rw.address = opts.Address
+	rw.cluster = opts.Cluster
 	rw.stat.Name = "writer_" + strings.Replace(opts.Address, ":", "_", -1)
 	rw.client, err = client.NewRedisClient(ctx, opts.Address, opts.Username, opts.Password, opts.Tls, opts.TlsConfig, false)
 	if err != nil {
 		return nil, err
 	}
+	if config.Opt.Advanced.TargetCompat != "" && config.Opt.Advanced.TargetCompat != compat.ModeOff {
+		targetVersion := rw.client.ServerVersion()
+		log.Infof("[%s] target redis_version: [%s]", rw.stat.Name, targetVersion)
+		rw.rewriter = compat.NewRewriter(config.Opt.Advanced.TargetCompat, targetVersion)
+	}
 	rw.ch = make(chan *entry.Entry, config.Opt.Advanced.PipelineCountLimit)
+	rw.idleCond = sync.NewCond(&rw.idleLock)
+	rw.txCollector = entry.NewTransactionCollector()
+	rw.limiter = GetRateLimiter()
+	rw.budget = newFlowBudget(config.Opt.Advanced.TargetRedisClientMaxQuerybufLen, config.Opt.Advanced.TargetRedisMaxInflightEntries)
 	if opts.OffReply {
 		log.Infof("turn off the reply of write")
 		rw.offReply = true
@@ -85,9 +118,28 @@ func (w *StandaloneWriter) StartWrite(ctx context.Context) chan *entry.Entry {
 }
 
 func (w *StandaloneWriter) Write(e *entry.Entry) {
+	atomic.AddInt64(&w.pending, 1)
 	w.ch <- e
 }
 
+// Drain blocks until every entry passed to Write has been sent and answered by the target.
+// With off_reply there is no answer, so it returns once the entries are flushed to the connection.
+func (w *StandaloneWriter) Drain() {
+	w.idleLock.Lock()
+	defer w.idleLock.Unlock()
+	for atomic.LoadInt64(&w.pending) > 0 {
+		w.idleCond.Wait()
+	}
+}
+
+func (w *StandaloneWriter) donePending() {
+	if atomic.AddInt64(&w.pending, -1) == 0 {
+		w.idleLock.Lock()
+		w.idleCond.Broadcast()
+		w.idleLock.Unlock()
+	}
+}
+
 func (w *StandaloneWriter) switchDbTo(newDbId int) {
 	log.Debugf("[%s] switch db to [%d]", w.stat.Name, newDbId)
 	w.client.Send("select", strconv.Itoa(newDbId))
@@ -112,35 +164,100 @@ func (w *StandaloneWriter) processWrite(ctx context.Context) {
 		case e, ok := <-w.ch:
 			if !ok {
 				// clean up and exit
+				if dropped := w.txCollector.Reset(); len(dropped) > 0 {
+					log.Warnf("[%s] drop incomplete transaction on close. entries=[%d]", w.stat.Name, len(dropped))
+					for range dropped {
+						w.donePending()
+					}
+				}
 				w.client.Flush()
 				w.chWg.Done()
 				return
 			}
-			// switch db if we need
-			if w.DbId != e.DbId {
-				w.switchDbTo(e.DbId)
-			}
-			// send
-			bytes := e.Serialize()
-			for e.SerializedSize+atomic.LoadInt64(&w.stat.UnansweredBytes) > config.Opt.Advanced.TargetRedisClientMaxQuerybufLen {
-				time.Sleep(1 * time.Nanosecond)
+			rewritten := w.rewriter.Rewrite(e)
+			if len(rewritten) == 0 {
+				w.donePending()
+			} else {
+				atomic.AddInt64(&w.pending, int64(len(rewritten)-1))
 			}
-			//slog.Debug("send redis cmd", slog.String("cmd", e.String()))
-			if !w.offReply {
-				select {
-				case w.chWaitReply <- e:
-				default:
-					w.client.Flush()
-					w.chWaitReply <- e
-				}
-				atomic.AddInt64(&w.stat.UnansweredBytes, e.SerializedSize)
-				atomic.AddInt64(&w.stat.UnansweredEntries, 1)
+			for _, item := range rewritten {
+				w.collectAndSend(item)
 			}
-			w.client.SendBytesBuff(bytes)
 		}
 	}
 }
 
+// collectAndSend sends MULTI ... EXEC only once the whole block arrived. A cluster
+// target rejects a transaction spanning slots, so it is sent as one block per run of
+// commands on a slot, and commands spanning slots themselves are not sent.
+func (w *StandaloneWriter) collectAndSend(e *entry.Entry) {
+	ready, discarded := w.txCollector.Push(e)
+	for range discarded {
+		w.donePending()
+	}
+	if !entry.IsTransactionBlock(ready) {
+		for _, item := range ready {
+			w.sendEntry(item)
+		}
+		return
+	}
+	atomic.AddInt64(&w.stat.TransactionCount, 1)
+	blocks := [][]*entry.Entry{ready}
+	if w.cluster {
+		var rejected []*entry.Entry
+		blocks, rejected = entry.SplitTransactionBySlot(ready)
+		for range rejected {
+			atomic.AddInt64(&w.stat.RejectedEntries, 1)
+			w.donePending()
+		}
+	}
+	if len(blocks) > 1 {
+		atomic.AddInt64(&w.stat.SplitTransactions, 1)
+		// every block but the first adds a MULTI and an EXEC to answer
+		atomic.AddInt64(&w.pending, int64(2*(len(blocks)-1)))
+	}
+	for _, block := range blocks {
+		for _, item := range block {
+			w.sendEntry(item)
+		}
+	}
+	w.client.Flush()
+}
+
+func (w *StandaloneWriter) sendEntry(e *entry.Entry) {
+	// switch db if we need
+	if w.DbId != e.DbId {
+		w.switchDbTo(e.DbId)
+	}
+	// send
+	bytes := e.Serialize()
+	if delay := w.limiter.Reserve(e); delay > 0 {
+		w.client.Flush()
+		time.Sleep(delay)
+	}
+	//slog.Debug("send redis cmd", slog.String("cmd", e.String()))
+	if !w.offReply {
+		if !w.budget.TryAcquire(e.SerializedSize) {
+			// the buffered commands must reach the target, or their replies never release the budget
+			w.client.Flush()
+			w.budget.Acquire(e.SerializedSize)
+		}
+		select {
+		case w.chWaitReply <- e:
+		default:
+			w.client.Flush()
+			w.chWaitReply <- e
+		}
+	}
+	w.client.SendBytesBuff(bytes)
+	if w.offReply {
+		if len(w.ch) == 0 {
+			w.client.Flush()
+		}
+		w.donePending()
+	}
+}
+
 func (w *StandaloneWriter) processReply() {
 	var count int64 = 0
 	for e := range w.chWaitReply {
@@ -165,21 +282,55 @@ func (w *StandaloneWriter) processReply() {
 		if strings.EqualFold(e.CmdName, "select") { // skip select command
 			continue
 		}
-		atomic.AddInt64(&w.stat.UnansweredBytes, -e.SerializedSize)
-		atomic.AddInt64(&w.stat.UnansweredEntries, -1)
+		if len(e.Argv) > 0 && strings.EqualFold(e.Argv[0], "exec") {
+			w.checkExecReply(e, reply, err)
+		}
+		w.budget.Release(e.SerializedSize)
+		w.donePending()
 	}
 	w.chWaitWg.Done()
 	slog.Debug("receive redis reply end", slog.Int64("count", count))
 }
 
+// checkExecReply reports a transaction that was aborted or had failing commands,
+// errors inside EXEC do not break the connection so they are only logged.
+func (w *StandaloneWriter) checkExecReply(e *entry.Entry, reply interface{}, err error) {
+	if errors.Is(err, proto.Nil) {
+		log.Warnf("[%s] transaction aborted by target, EXEC returned nil. db=[%d]", w.stat.Name, e.DbId)
+		return
+	}
+	replies, ok := reply.([]interface{})
+	if !ok {
+		return
+	}
+	for inx, item := range replies {
+		if itemErr, isErr := item.(proto.RedisError); isErr {
+			log.Warnf("[%s] command in transaction failed. index=[%d], error=[%v]", w.stat.Name, inx, itemErr)
+		}
+	}
+}
+
 func (w *StandaloneWriter) Status() interface{} {
-	return w.stat
+	stat := w.stat
+	stat.UnansweredBytes, stat.UnansweredEntries = w.budget.Inflight()
+	blockedCount, blockedDuration := w.budget.Blocked()
+	stat.BlockedCount = blockedCount
+	stat.BlockedMs = blockedDuration.Milliseconds()
+	stat.TransactionCount = atomic.LoadInt64(&w.stat.TransactionCount)
+	stat.SplitTransactions = atomic.LoadInt64(&w.stat.SplitTransactions)
+	stat.RejectedEntries = atomic.LoadInt64(&w.stat.RejectedEntries)
+	if w.rewriter != nil {
+		stat.Compat = w.rewriter.Status()
+	}
+	return stat
 }
 
 func (w *StandaloneWriter) StatusString() string {
-	return fmt.Sprintf("[%s]: unanswered_entries=%d", w.stat.Name, atomic.LoadInt64(&w.stat.UnansweredEntries))
+	_, entries := w.budget.Inflight()
+	return fmt.Sprintf("[%s]: unanswered_entries=%d", w.stat.Name, entries)
 }
 
 func (w *StandaloneWriter) StatusConsistent() bool {
-	return atomic.LoadInt64(&w.stat.UnansweredBytes) == 0 && atomic.LoadInt64(&w.stat.UnansweredEntries) == 0
+	bytes, entries := w.budget.Inflight()
+	return bytes == 0 && entries == 0
 }
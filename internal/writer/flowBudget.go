@@ -0,0 +1,98 @@
+package writer
+
+import (
+	"sync"
+	"time"
+)
+
+// flowBudget limits the bytes and entries that are sent to the target but not answered yet.
+// The writer goroutine acquires before sending, the reply goroutine releases after receiving,
+// a blocked writer sleeps on the condition variable instead of spinning.
+type flowBudget struct {
+	lock *sync.Mutex
+	cond *sync.Cond
+
+	maxBytes   int64 // <= 0 means no limit
+	maxEntries int64 // <= 0 means no limit
+
+	bytes   int64
+	entries int64
+
+	blockedCount    int64
+	blockedDuration time.Duration
+}
+
+func newFlowBudget(maxBytes int64, maxEntries int64) *flowBudget {
+	b := &flowBudget{
+		lock:       new(sync.Mutex),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+	}
+	b.cond = sync.NewCond(b.lock)
+	return b
+}
+
+// exceededNonLock tells whether size more bytes do not fit into the budget.
+// An entry bigger than the whole budget is let through when nothing is in flight,
+// otherwise it could never be sent.
+func (b *flowBudget) exceededNonLock(size int64) bool {
+	if b.entries == 0 {
+		return false
+	}
+	if b.maxEntries > 0 && b.entries >= b.maxEntries {
+		return true
+	}
+	if b.maxBytes > 0 && b.bytes+size > b.maxBytes {
+		return true
+	}
+	return false
+}
+
+// TryAcquire takes the budget for one entry of size bytes if it fits, without waiting.
+func (b *flowBudget) TryAcquire(size int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.exceededNonLock(size) {
+		return false
+	}
+	b.bytes += size
+	b.entries++
+	return true
+}
+
+// Acquire waits until one entry of size bytes fits into the budget and takes it.
+func (b *flowBudget) Acquire(size int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.exceededNonLock(size) {
+		startAt := time.Now()
+		for b.exceededNonLock(size) {
+			b.cond.Wait()
+		}
+		b.blockedCount++
+		b.blockedDuration += time.Since(startAt)
+	}
+	b.bytes += size
+	b.entries++
+}
+
+// Release gives back the budget of one answered entry and wakes up the writer.
+func (b *flowBudget) Release(size int64) {
+	b.lock.Lock()
+	b.bytes -= size
+	b.entries--
+	b.lock.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *flowBudget) Inflight() (bytes int64, entries int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bytes, b.entries
+}
+
+func (b *flowBudget) Blocked() (count int64, duration time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.blockedCount, b.blockedDuration
+}
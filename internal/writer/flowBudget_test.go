@@ -0,0 +1,43 @@
+package writer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_flowBudget_entries(t *testing.T) {
+	b := newFlowBudget(0, 2)
+	assert.True(t, b.TryAcquire(10))
+	assert.True(t, b.TryAcquire(10))
+	assert.False(t, b.TryAcquire(10))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Release(10)
+	}()
+	b.Acquire(10)
+	bytes, entries := b.Inflight()
+	assert.Equal(t, int64(20), bytes)
+	assert.Equal(t, int64(2), entries)
+	count, duration := b.Blocked()
+	assert.Equal(t, int64(1), count)
+	assert.True(t, duration >= 40*time.Millisecond)
+}
+
+func Test_flowBudget_bytes(t *testing.T) {
+	b := newFlowBudget(100, 0)
+	// an entry bigger than the whole budget passes when nothing is in flight
+	assert.True(t, b.TryAcquire(500))
+	assert.False(t, b.TryAcquire(1))
+	b.Release(500)
+	assert.True(t, b.TryAcquire(60))
+	assert.False(t, b.TryAcquire(50))
+	assert.True(t, b.TryAcquire(40))
+	b.Release(60)
+	b.Release(40)
+	bytes, entries := b.Inflight()
+	assert.Equal(t, int64(0), bytes)
+	assert.Equal(t, int64(0), entries)
+}
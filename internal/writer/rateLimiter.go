@@ -0,0 +1,187 @@
+package writer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"redisFlutter/internal/config"
+	"redisFlutter/internal/entry"
+	"redisFlutter/internal/log"
+	"redisFlutter/internal/status"
+)
+
+// tokenBucket refills rate tokens per second up to one second of burst.
+// A request bigger than the burst drives the bucket into debt, so the
+// following requests wait until the debt is paid.
+type tokenBucket struct {
+	rate   float64 // <= 0 means no limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.rate = float64(rate)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// reserve takes n tokens and returns how long the caller must wait before using them.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type RateLimits struct {
+	Ops      int64 `json:"ops"`
+	Bytes    int64 `json:"bytes"`
+	RdbOps   int64 `json:"rdb_ops"`
+	RdbBytes int64 `json:"rdb_bytes"`
+}
+
+// RateLimiter throttles the entries written to target by ops/sec and bytes/sec.
+// It is shared by all writers of the process, so the limits apply to the target as a whole.
+type RateLimiter struct {
+	lock   sync.Mutex
+	limits RateLimits
+
+	ops      tokenBucket
+	bytes    tokenBucket
+	rdbOps   tokenBucket
+	rdbBytes tokenBucket
+
+	throttledCount    int64
+	throttledDuration time.Duration
+}
+
+var (
+	rateLimiterOnce sync.Once
+	rateLimiter     *RateLimiter
+)
+
+func init() {
+	status.RegisterHandler("/rate_limit", rateLimitHandler)
+}
+
+// GetRateLimiter returns the process wide limiter, created from config.Opt.Advanced on first use.
+func GetRateLimiter() *RateLimiter {
+	rateLimiterOnce.Do(func() {
+		rateLimiter = new(RateLimiter)
+		rateLimiter.SetLimits(RateLimits{
+			Ops:      config.Opt.Advanced.RateLimitOps,
+			Bytes:    config.Opt.Advanced.RateLimitBytes,
+			RdbOps:   config.Opt.Advanced.RateLimitRdbOps,
+			RdbBytes: config.Opt.Advanced.RateLimitRdbBytes,
+		})
+	})
+	return rateLimiter
+}
+
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+	l.ops.setRate(limits.Ops)
+	l.bytes.setRate(limits.Bytes)
+	l.rdbOps.setRate(limits.RdbOps)
+	l.rdbBytes.setRate(limits.RdbBytes)
+	log.Infof("writer rate limit set. ops=[%d], bytes=[%d], rdb_ops=[%d], rdb_bytes=[%d]", limits.Ops, limits.Bytes, limits.RdbOps, limits.RdbBytes)
+}
+
+func (l *RateLimiter) Limits() RateLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// Reserve takes the tokens of a serialized entry and returns how long to wait before sending it.
+func (l *RateLimiter) Reserve(e *entry.Entry) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	opsBucket, bytesBucket := &l.ops, &l.bytes
+	if e.FromRdb {
+		if l.rdbOps.rate > 0 {
+			opsBucket = &l.rdbOps
+		}
+		if l.rdbBytes.rate > 0 {
+			bytesBucket = &l.rdbBytes
+		}
+	}
+	now := time.Now()
+	delay := opsBucket.reserve(1, now)
+	if bytesDelay := bytesBucket.reserve(float64(e.SerializedSize), now); bytesDelay > delay {
+		delay = bytesDelay
+	}
+	if delay > 0 {
+		l.throttledCount++
+		l.throttledDuration += delay
+	}
+	return delay
+}
+
+type rateLimitStat struct {
+	RateLimits
+	ThrottledCount int64 `json:"throttled_count"`
+	ThrottledMs    int64 `json:"throttled_ms"`
+}
+
+func (l *RateLimiter) stat() rateLimitStat {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return rateLimitStat{
+		RateLimits:     l.limits,
+		ThrottledCount: l.throttledCount,
+		ThrottledMs:    l.throttledDuration.Milliseconds(),
+	}
+}
+
+// rateLimitHandler shows the limits on GET and changes them on POST, for example:
+//
+//	curl -X POST 'http://localhost:<status_port>/rate_limit?ops=10000&bytes=10485760'
+//
+// Parameters not given keep their current value, 0 removes the limit.
+func rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	limiter := GetRateLimiter()
+	if r.Method == http.MethodPost {
+		limits := limiter.Limits()
+		fields := map[string]*int64{
+			"ops":       &limits.Ops,
+			"bytes":     &limits.Bytes,
+			"rdb_ops":   &limits.RdbOps,
+			"rdb_bytes": &limits.RdbBytes,
+		}
+		query := r.URL.Query()
+		for name, field := range fields {
+			text := query.Get(name)
+			if text == "" {
+				continue
+			}
+			val, err := strconv.ParseInt(text, 10, 64)
+			if err != nil || val < 0 {
+				http.Error(w, name+" is invalid", http.StatusBadRequest)
+				return
+			}
+			*field = val
+		}
+		limiter.SetLimits(limits)
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "only support GET and POST method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsonBytes, _ := json.Marshal(limiter.stat())
+	_, _ = w.Write(jsonBytes)
+}
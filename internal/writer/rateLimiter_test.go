@@ -0,0 +1,43 @@
+package writer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"redisFlutter/internal/entry"
+)
+
+func Test_tokenBucket(t *testing.T) {
+	b := tokenBucket{}
+	b.setRate(100)
+	now := b.last
+	// the burst of 100 tokens is used up, 50 more are a debt of half a second
+	assert.Equal(t, time.Duration(0), b.reserve(100, now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(50, now))
+	// one second refills 100 tokens, 50 pay the debt and 50 are taken, none are left
+	assert.Equal(t, time.Duration(0), b.reserve(50, now.Add(time.Second)))
+	assert.Equal(t, 10*time.Millisecond, b.reserve(1, now.Add(time.Second)))
+
+	unlimited := tokenBucket{}
+	unlimited.setRate(0)
+	assert.Equal(t, time.Duration(0), unlimited.reserve(1e9, time.Now()))
+}
+
+func Test_RateLimiter_rdbPhase(t *testing.T) {
+	l := new(RateLimiter)
+	l.SetLimits(RateLimits{Ops: 0, Bytes: 0, RdbOps: 1, RdbBytes: 0})
+
+	aofEntry := entry.NewEntry()
+	aofEntry.SerializedSize = 10
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Duration(0), l.Reserve(aofEntry))
+	}
+
+	rdbEntry := entry.NewEntry()
+	rdbEntry.FromRdb = true
+	assert.Equal(t, time.Duration(0), l.Reserve(rdbEntry))
+	assert.True(t, l.Reserve(rdbEntry) > 0)
+	assert.Equal(t, int64(1), l.stat().ThrottledCount)
+}
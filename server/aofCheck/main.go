@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	rotate "redisFlutter/internal/utils/file_rotate"
+)
+
+// aofCheck checks the aof segment dirs given as arguments, like redis-check-aof.
+// It prints a json report per dir and exits 1 when a problem is left.
+func main() {
+	full := flag.Bool("full", false, "check every segment, not only the last")
+	fix := flag.Bool("fix", false, "truncate a damaged tail to the last complete command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-full] [-fix] dir...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ok := true
+	for _, dir := range flag.Args() {
+		report, err := rotate.VerifyDir(dir, *full, *fix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check %s error: %v\n", dir, err)
+			ok = false
+			if report == nil {
+				continue
+			}
+		}
+		jsonBytes, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(jsonBytes))
+		ok = ok && report.OK()
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -3,6 +3,7 @@ package http
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"log/slog"
 	"mime/multipart"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"path"
 	"redisFlutter/constDefine"
+	"redisFlutter/internal/aofStorage"
+	"redisFlutter/internal/utils/encrypt"
 	rotate "redisFlutter/internal/utils/file_rotate"
 	"strconv"
 	"strings"
@@ -31,26 +34,34 @@ import (
 //
 
 type redisStorageInfo struct {
-	locker       *sync.Mutex
-	aofAddWriter *rotate.AofAddIndexWriter
-	deployType   int
-	uploadIndex  int64
-	clusterSize  int //cluster only
-	shareIndex   int //cluster only
+	locker        *sync.Mutex
+	storage       aofStorage.Storage
+	stopRetention func()
+	deployType    int
+	uploadIndex   int64
+	clusterSize   int //cluster only
+	shareIndex    int //cluster only
 }
 
 func newRedisStorageInfo(name string, dir string) (*redisStorageInfo, error) {
-	w, err := rotate.NewAofAddIndexWriter(name, dir, 32*1024*1024)
+	s, err := aofStorage.NewStorage(name, dir, 32*1024*1024)
 	if err != nil {
 		return nil, err
 	}
 	m := &redisStorageInfo{
-		locker:       new(sync.Mutex),
-		aofAddWriter: w,
-		uploadIndex:  -1,
+		locker:      new(sync.Mutex),
+		storage:     s,
+		uploadIndex: -1,
 	}
+	m.stopRetention = aofStorage.RunRetention(context.Background(), name, s, rotate.ConfigRetentionPolicy())
 	return m, nil
 }
+
+// Close stops the retention of the storage and closes it.
+func (c *redisStorageInfo) Close() error {
+	c.stopRetention()
+	return c.storage.Close()
+}
 func (c *redisStorageInfo) InitStandaloneNonLock() {
 	c.deployType = constDefine.REDIS_TYPE_STANDALONE_VAL
 	c.uploadIndex = -1
@@ -263,13 +274,13 @@ func (c *SyncSaveHttpServer) saveAofStream(w http.ResponseWriter, sinfo *redisSt
 			return err
 		}
 		defer gzReader.Close()
-		_, err = io.Copy(sinfo.aofAddWriter, gzReader)
+		_, err = io.Copy(aofStorage.NewStorageWriter(sinfo.storage), gzReader)
 		if err != nil {
 			http.Error(w, "Write File Error", http.StatusInternalServerError)
 			return err
 		}
 	} else {
-		_, err = io.Copy(sinfo.aofAddWriter, reader)
+		_, err = io.Copy(aofStorage.NewStorageWriter(sinfo.storage), reader)
 		if err != nil {
 			http.Error(w, "Write File Error", http.StatusInternalServerError)
 			return err
@@ -325,9 +336,9 @@ func (c *SyncSaveHttpServer) processStandaloneRdbUpload(w http.ResponseWriter, f
 	}
 
 	//remove all aof files
-	err = sinfo.aofAddWriter.Reinit()
+	err = sinfo.storage.TruncateBefore(sinfo.storage.NextSeq())
 	if err != nil {
-		http.Error(w, "aof writer reinit error", http.StatusInternalServerError)
+		http.Error(w, "aof storage truncate error", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("Upload Success"))
@@ -341,6 +352,11 @@ func (c *SyncSaveHttpServer) saveFile(w http.ResponseWriter, savePath string, fi
 		return err
 	}
 	defer fi.Close()
+	out, err := encrypt.ConfigWriter(fi)
+	if err != nil {
+		http.Error(w, "Encrypt File Error", http.StatusInternalServerError)
+		return err
+	}
 
 	aheadBuff := make([]byte, 2)
 	n, err := filePart.Read(aheadBuff)
@@ -362,13 +378,13 @@ func (c *SyncSaveHttpServer) saveFile(w http.ResponseWriter, savePath string, fi
 			return err
 		}
 		defer gzReader.Close()
-		_, err = io.Copy(fi, gzReader)
+		_, err = io.Copy(out, gzReader)
 		if err != nil {
 			http.Error(w, "Write File Error", http.StatusInternalServerError)
 			return err
 		}
 	} else {
-		_, err := io.Copy(fi, reader)
+		_, err := io.Copy(out, reader)
 		if err != nil {
 			http.Error(w, "Write File Error", http.StatusInternalServerError)
 			return err